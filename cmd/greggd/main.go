@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"text/tabwriter"
 
 	"github.com/olcf/greggd/pkg/communication"
 	"github.com/olcf/greggd/pkg/config"
@@ -36,32 +39,34 @@ func parseConfig() *config.GreggdConfig {
 			*configPath, err)
 		os.Exit(1)
 	}
+	for _, warning := range configStruct.Warnings {
+		fmt.Fprintf(os.Stderr, "main.go: Warning in config file %s: %s\n",
+			*configPath, warning)
+	}
 
 	return configStruct
 }
 
-func main() {
-	// Overwrite the flag packages' usage function so we can give extra info about
-	// greggd
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(),
-			`Greggd:
-
-Greggd collects and exports low-level tracing data from the eBPF in-kernel virtual machine to a user defined socket. It compilies and loads configured user-programs into the eBPF VM while polling memory tables for performance events.`)
-		fmt.Fprintf(flag.CommandLine.Output(), "\n\nUsage of %s:\n", os.Args[0])
-		flag.PrintDefaults()
+// Parse flags in args, allowing positional arguments between them. Returns
+// the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
+}
 
-	// Parse flags
-	flag.Parse()
-
-	// Load config
-	configStruct := parseConfig()
-
-	// If cli says verbose and config doesn't, set config to verbose
-	if *verbose && !configStruct.Globals.Verbose {
-		configStruct.Globals.Verbose = true
-	}
+// Trace every configured program, handing the collected data to sink. Runs
+// until interrupted or a goroutine reports an error
+func run(configStruct *config.GreggdConfig,
+	sink func(ctx context.Context, dataChan chan config.SocketInput,
+		errChan chan error, wg *sync.WaitGroup)) {
 
 	// Create background context with cancel function
 	ctx, cancel := context.WithCancel(context.Background())
@@ -84,10 +89,9 @@ Greggd collects and exports low-level tracing data from the eBPF in-kernel virtu
 	// Create wait group to watch goroutine progress
 	var wg sync.WaitGroup
 
-	// Create goroutine for sending to socket
+	// Create goroutine for consuming data
 	wg.Add(1)
-	go communication.BytesToSock(ctx, dataChan, errChan, configStruct.Globals,
-		&wg)
+	go sink(ctx, dataChan, errChan, &wg)
 
 	// Create goroutine for each program, increment number of running procs, do
 	// the work
@@ -110,3 +114,325 @@ Greggd collects and exports low-level tracing data from the eBPF in-kernel virtu
 	// Wait until goroutines exited
 	//wg.Wait()
 }
+
+// Check a config file, printing every problem found with its location
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(configPath, "config", *configPath, "Path to config file")
+	parseInterspersed(flags, args)
+
+	source, err := os.Open(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: Failed to open config file from %s: %s\n",
+			*configPath, err)
+		os.Exit(1)
+	}
+	defer source.Close()
+
+	failed := false
+	for _, err := range config.Validate(source) {
+		fmt.Fprintf(os.Stderr, "%s:%s\n", *configPath, err)
+		failed = failed || !err.Warning
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", *configPath)
+}
+
+// Trace configured programs and save the raw events to a capture file
+func record(args []string) {
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	flags.StringVar(configPath, "config", *configPath, "Path to config file")
+	outPath := flags.String("o", "capture.bin", "Path to write the capture to")
+	parseInterspersed(flags, args)
+
+	configStruct := parseConfig()
+
+	out, err := os.Create(*outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: Failed to create capture %s: %s\n",
+			*outPath, err)
+		os.Exit(1)
+	}
+	defer out.Close()
+
+	run(configStruct, func(ctx context.Context,
+		dataChan chan config.SocketInput, errChan chan error,
+		wg *sync.WaitGroup) {
+
+		communication.RecordToFile(ctx, dataChan, errChan, out, wg)
+	})
+}
+
+// Feed a capture file through decoding, filtering, formatting and the
+// configured socket without loading anything into the kernel
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.StringVar(configPath, "config", *configPath, "Path to config file")
+	flags.BoolVar(verbose, "v", *verbose, "Log messages to stdout")
+	speedFlag := flags.String("speed", "1x",
+		"Replay speed as a multiple of the recorded rate, or `max`")
+	stdout := flags.Bool("stdout", false,
+		"Write formatted output to stdout instead of the configured sinks")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s replay capture.bin [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	speed, err := communication.ParseReplaySpeed(*speedFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+		os.Exit(2)
+	}
+
+	configStruct := parseConfig()
+	if *verbose {
+		configStruct.Globals.Verbose = true
+	}
+	if *stdout {
+		// Keep the encoding of the first configured sink
+		sink := config.SinkConfig{Type: "stdout"}
+		if len(configStruct.Globals.Sinks) != 0 {
+			sink.Encoding = configStruct.Globals.Sinks[0].Encoding
+		}
+		configStruct.Globals.Sinks = []config.SinkConfig{sink}
+	}
+
+	in, err := os.Open(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: Failed to open capture %s: %s\n",
+			positional[0], err)
+		os.Exit(1)
+	}
+	defer in.Close()
+	capture, err := communication.NewCaptureReader(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: Failed to read capture %s: %s\n",
+			positional[0], err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	// Errors from the sink end the replay
+	errChan := make(chan error, 1)
+	dataChan := make(chan config.SocketInput)
+
+	// Pin the recording host's clock before the sink calibrates its own
+	communication.PinClock(capture.ClockOffset)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go communication.BytesToSock(ctx, dataChan, errChan, configStruct.Globals,
+		&wg)
+
+	replayErr := make(chan error, 1)
+	go func() {
+		replayErr <- communication.Replay(ctx, capture, configStruct.Programs,
+			dataChan, speed)
+	}()
+
+	exitCode := 0
+	select {
+	case err = <-replayErr:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "main.go: Error replaying capture: %s\n", err)
+			exitCode = 1
+		}
+	case err = <-errChan:
+		fmt.Fprintf(os.Stderr, "main.go: Error received from sink: %s\n", err)
+		exitCode = 1
+	}
+	// Let the sink finish the last record before exiting, discarding any errors
+	// it reports meanwhile
+	go func() {
+		for range errChan {
+		}
+	}()
+	cancel()
+	wg.Wait()
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// List the sensors bundled into greggd, or show the events and fields of one
+func sensors(args []string) {
+	flags := flag.NewFlagSet("sensors", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s sensors list\n       %s sensors show NAME\n"+
+				"       %s sensors schema [NAME...]\n", os.Args[0], os.Args[0],
+			os.Args[0])
+	}
+	positional := parseInterspersed(flags, args)
+
+	switch {
+	case len(positional) == 1 && positional[0] == "list":
+		library, err := config.Sensors()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+			os.Exit(1)
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, sensor := range library {
+			fmt.Fprintf(out, "%s\t%s\n", sensor.Name, sensor.Description)
+		}
+		out.Flush()
+	case len(positional) == 2 && positional[0] == "show":
+		sensor, err := config.LoadSensor(positional[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+			os.Exit(1)
+		}
+		showSensor(sensor)
+	case len(positional) >= 1 && positional[0] == "schema":
+		sensorSchemas(positional[1:])
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// Print the measurements written by the named sensors, or every sensor, as
+// JSON
+func sensorSchemas(names []string) {
+	schemas, err := config.FieldSchemas()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+		os.Exit(1)
+	}
+	var library []config.Sensor
+	if len(names) == 0 {
+		library, err = config.Sensors()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, name := range names {
+		sensor, err := config.LoadSensor(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+			os.Exit(1)
+		}
+		library = append(library, *sensor)
+	}
+
+	sensorSchemas := []config.SensorSchema{}
+	for i := range library {
+		sensorSchemas = append(sensorSchemas, library[i].Schema(schemas))
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(sensorSchemas)
+}
+
+// Print a sensor's events and the fields each of its outputs emits
+func showSensor(sensor *config.Sensor) {
+	// Describe fields from the schema registry where it knows them
+	schemas, err := config.FieldSchemas()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "main.go: %s\n", err)
+		os.Exit(1)
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(out, "%s: %s\nsource: %s\n\nevents:\n", sensor.Name,
+		sensor.Description, sensor.Program.Source)
+	for _, event := range sensor.Program.Events {
+		fmt.Fprintf(out, "  %s\t%s\t%s\n", event.Type, event.LoadFunc,
+			event.AttachTo)
+	}
+	for _, output := range sensor.Program.Outputs {
+		fmt.Fprintf(out, "\noutput %s (%s", output.Id, output.Type)
+		if output.Poll != "" {
+			fmt.Fprintf(out, ", every %s", output.Poll)
+		}
+		fmt.Fprintf(out, "):\n")
+		fields := output.KeyFormat
+		if output.Key.Name != "" {
+			fields = append(fields, output.Key)
+		}
+		for _, field := range append(fields, output.Format...) {
+			var notes []string
+			if field.IsTag || field.IsIP {
+				notes = append(notes, "tag")
+			}
+			if field.IsIP {
+				notes = append(notes, "ip")
+			}
+			fmt.Fprintf(out, "  %s\t%s\t%s\t%s\n", field.Name, field.Type,
+				strings.Join(notes, ","), schemas[field.Name].Short)
+		}
+	}
+	out.Flush()
+}
+
+func main() {
+	// Overwrite the flag packages' usage function so we can give extra info about
+	// greggd
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			`Greggd:
+
+Greggd collects and exports low-level tracing data from the eBPF in-kernel virtual machine to a user defined socket. It compilies and loads configured user-programs into the eBPF VM while polling memory tables for performance events.`)
+		fmt.Fprintf(flag.CommandLine.Output(), "\n\nUsage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"  %s [flags]\n  %s record -o capture.bin [flags]\n"+
+				"  %s replay capture.bin [flags]\n  %s validate [flags]\n"+
+				"  %s sensors list|show NAME|schema [NAME...]\n\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "record":
+			record(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "validate":
+			validate(os.Args[2:])
+			return
+		case "sensors":
+			sensors(os.Args[2:])
+			return
+		}
+	}
+
+	// Parse flags
+	flag.Parse()
+
+	// Load config
+	configStruct := parseConfig()
+
+	// If cli says verbose and config doesn't, set config to verbose
+	if *verbose && !configStruct.Globals.Verbose {
+		configStruct.Globals.Verbose = true
+	}
+
+	run(configStruct, func(ctx context.Context,
+		dataChan chan config.SocketInput, errChan chan error,
+		wg *sync.WaitGroup) {
+
+		communication.BytesToSock(ctx, dataChan, errChan, configStruct.Globals,
+			wg)
+	})
+}
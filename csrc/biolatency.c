@@ -15,7 +15,7 @@ typedef struct disk_key {
     u64 slot;
 } disk_key_t;
 BPF_HASH(start, struct request *);
-BPF_HISTOGRAM(dist, disk_key_t);
+BPF_HISTOGRAM(biolatency_dist, disk_key_t);
 
 // time block I/O
 int trace_req_start(struct pt_regs *ctx, struct request *req)
@@ -38,11 +38,19 @@ int trace_req_done(struct pt_regs *ctx, struct request *req)
     delta = bpf_ktime_get_ns() - *tsp;
     delta /= 1000;
 
+    // Skip fast I/O in kernel when greggd passes a MIN_LATENCY_US define
+#ifdef MIN_LATENCY_US
+    if (delta < MIN_LATENCY_US) {
+        start.delete(&req);
+        return 0;
+    }
+#endif
+
     // store as histogram
     disk_key_t key = {.slot = bpf_log2l(delta)};
     void *__tmp = (void *)req->rq_disk->disk_name;
     bpf_probe_read(&key.disk, sizeof(key.disk), __tmp);
-    dist.increment(key);
+    biolatency_dist.increment(key);
 
     start.delete(&req);
     return 0;
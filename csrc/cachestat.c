@@ -13,14 +13,14 @@ struct key_t {
     u64 ip;
 };
 
-BPF_HASH(dist, struct key_t);
+BPF_HASH(cachestat_dist, struct key_t);
 
 int do_count(struct pt_regs *ctx) {
     struct key_t key = {};
     u64 ip;
 
     key.ip = PT_REGS_IP(ctx);
-    dist.increment(key); // update counter
+    cachestat_dist.increment(key); // update counter
     return 0;
 }
 
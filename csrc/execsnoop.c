@@ -39,6 +39,12 @@ int syscall__execve(struct pt_regs *ctx,
     int zero = 0;
     u64 id = bpf_get_current_pid_tgid();
 
+    // Filter in kernel when greggd passes a TARGET_UID define
+#ifdef TARGET_UID
+    if ((u32)bpf_get_current_uid_gid() != TARGET_UID)
+        return 0;
+#endif
+
     struct task_struct *task;
     struct data_t* data = argtmp.lookup(&zero);
     if (!data)
@@ -40,6 +40,16 @@ int trace_entry(struct pt_regs *ctx, int dfd, const char __user *filename, int f
     //u32 tid = id;       // Cast and get the lower part
     u32 uid = bpf_get_current_uid_gid();
 
+    // Filter in kernel when greggd passes TARGET_PID or TARGET_UID defines
+#ifdef TARGET_PID
+    if (id >> 32 != TARGET_PID)
+        return 0;
+#endif
+#ifdef TARGET_UID
+    if (uid != TARGET_UID)
+        return 0;
+#endif
+
     if (bpf_get_current_comm(&val.comm, sizeof(val.comm)) == 0) {
         val.id = id;
         val.fname = filename;
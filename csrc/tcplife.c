@@ -92,7 +92,10 @@ int kprobe__tcp_set_state(struct pt_regs *ctx, struct sock *sk, int state)
     // record PID & comm on SYN_SENT
     if (state == TCP_SYN_SENT || state == TCP_LAST_ACK) {
         // now we can PID filter, both here and a little later on for CLOSE
-        //FILTER_PID
+#ifdef TARGET_PID
+        if (pid != TARGET_PID)
+            return 0;
+#endif
         struct id_t me = {.pid = pid};
         bpf_get_current_comm(&me.comm, sizeof(me.comm));
         whoami.update(&sk, &me);
@@ -116,7 +119,12 @@ int kprobe__tcp_set_state(struct pt_regs *ctx, struct sock *sk, int state)
     mep = whoami.lookup(&sk);
     if (mep != 0)
         pid = mep->pid;
-    //FILTER_PID
+#ifdef TARGET_PID
+    if (pid != TARGET_PID) {
+        whoami.delete(&sk);
+        return 0;
+    }
+#endif
 
     // get throughput stats. see tcp_get_info().
     u64 rx_b = 0, tx_b = 0, sport = 0;
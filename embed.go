@@ -0,0 +1,9 @@
+// Package greggd bundles the sensor library into the binary: the eBPF
+// programs under csrc, a canonical config for each under sensors and the
+// field schemas under api/schemas
+package greggd
+
+import "embed"
+
+//go:embed csrc/*.c sensors/*.yaml api/schemas/fields/*.yaml
+var Library embed.FS
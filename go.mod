@@ -1,9 +1,19 @@
 module github.com/olcf/greggd
 
+go 1.23.0
+
 require (
-	github.com/google/go-cmp v0.4.0
-	github.com/iovisor/gobpf v0.0.0-20191110090744-d63e8dd5f0a5 // indirect
-	github.com/onsi/gomega v1.7.1
+	github.com/cilium/ebpf v0.19.0
+	github.com/google/go-cmp v0.6.0
 	github.com/josephvoss/gobpf v0.14.0-1
+	github.com/onsi/gomega v1.7.1
+	golang.org/x/net v0.38.0
 	gopkg.in/yaml.v2 v2.2.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/iovisor/gobpf v0.0.0-20191110090744-d63e8dd5f0a5 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -10,6 +10,10 @@ import (
 	"github.com/olcf/greggd/pkg/config"
 )
 
+// Package path given to blank padding fields. reflect requires unexported
+// struct fields to have one
+const padPkgPath = "github.com/olcf/greggd/pkg/communication"
+
 // Use reflect package to build a new type for binary output unmarshalling at
 // runtime
 func BuildStructFromArray(inputArray []config.BPFOutputFormat) (reflect.Type,
@@ -49,19 +53,35 @@ func BuildStructFromArray(inputArray []config.BPFOutputFormat) (reflect.Type,
 			itemType = uint32(0)
 		case "u16":
 			itemType = uint16(0)
+		case "u8":
+			itemType = uint8(0)
+		case "int64":
+			itemType = int64(0)
 		case "int":
 			itemType = int(0)
 		case "int32":
 			itemType = int32(0)
-		case "char":
+		case "int16":
+			itemType = int16(0)
+		case "char", "pad":
 			itemType = byte(0)
 		default:
 			return nil, fmt.Errorf("tracer.go: Format type %s is not supported",
 				item.Type)
 		}
 
-		// Create struct fields for correct data type
-		if isArrayofArrays {
+		// Create struct fields for correct data type. Padding is a blank field so
+		// binary decoding skips over it
+		if itemTypeString == "pad" {
+			if !isArray {
+				return nil, fmt.Errorf("tracer.go: Padding %s must have a size",
+					item.Type)
+			}
+			fields = append(fields, reflect.StructField{
+				Name: "_", PkgPath: padPkgPath, Type: reflect.ArrayOf(intSize,
+					reflect.TypeOf(itemType)),
+			})
+		} else if isArrayofArrays {
 			fields = append(fields, reflect.StructField{
 				Name: strings.Title(item.Name), Type: reflect.ArrayOf(intSize,
 					reflect.ArrayOf(intInnerSize, reflect.TypeOf(itemType))),
@@ -81,6 +101,19 @@ func BuildStructFromArray(inputArray []config.BPFOutputFormat) (reflect.Type,
 	return reflect.StructOf(fields), nil
 }
 
+// Build the type hash keys of an output are decoded into. Struct keys are
+// decoded whole, single value keys as the bare value
+func BuildKeyType(output config.BPFOutput) (reflect.Type, error) {
+	if len(output.KeyFormat) != 0 {
+		return BuildStructFromArray(output.KeyFormat)
+	}
+	keyType, err := BuildStructFromArray([]config.BPFOutputFormat{output.Key})
+	if err != nil {
+		return nil, err
+	}
+	return keyType.Field(0).Type, nil
+}
+
 func writeBinaryToStruct(inBytes []byte, outType reflect.Type) (*reflect.Value,
 	error) {
 
@@ -87,3 +87,47 @@ func TestWriteBinaryToStruct(t *testing.T) {
 		}
 	}
 }
+
+// Confirm padding formats become blank fields that decoding skips
+func TestBuildStructFromArrayPadding(t *testing.T) {
+	input := []config.BPFOutputFormat{
+		config.BPFOutputFormat{Name: "flag", Type: "u8"},
+		config.BPFOutputFormat{Type: "pad[3]"},
+		config.BPFOutputFormat{Name: "pid", Type: "u32"},
+	}
+	actual, err := BuildStructFromArray(input)
+	if err != nil {
+		t.Fatalf("Error got trying to build struct: %v", err)
+	}
+	if actual.Field(1).Name != "_" {
+		t.Errorf("Padding field is not blank: %s", actual.Field(1).Name)
+	}
+
+	outVal, err := writeBinaryToStruct([]byte{1, 9, 9, 9, 42, 0, 0, 0}, actual)
+	if err != nil {
+		t.Fatalf("Error got trying to write binary: %v", err)
+	}
+	if outVal.Field(2).Uint() != 42 {
+		t.Errorf("Field after padding decoded as %v, expected 42",
+			outVal.Field(2).Uint())
+	}
+
+	_, err = BuildStructFromArray([]config.BPFOutputFormat{{Type: "pad"}})
+	if err == nil {
+		t.Errorf("Padding without a size did not throw error")
+	}
+}
+
+// Confirm every format type the config accepts can be decoded
+func TestBuildStructFormatTypes(t *testing.T) {
+	for _, formatType := range config.FormatTypes {
+		if formatType == "pad" {
+			formatType = "pad[4]"
+		}
+		_, err := BuildStructFromArray([]config.BPFOutputFormat{
+			{Name: "value", Type: formatType}})
+		if err != nil {
+			t.Errorf("Config format type %s can't be decoded: %v", formatType, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package communication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Magic bytes at the start of every capture file. The last byte is the format
+// version
+var captureMagic = []byte("GREGGDC\x03")
+
+// Raw event read out of the kernel, as saved by `greggd record`
+type CaptureRecord struct {
+	// Program or sensor the output belongs to
+	Program     string
+	OutputId    string
+	KeyData     []byte
+	DataBytes   []byte
+	ReceiveTime time.Time
+	// Start of the poll a hash record was read in. Zero for perf records
+	PollTime time.Time
+}
+
+// Writes records to a capture file. The file starts with the magic bytes and
+// the kernel clock offset at record time, followed by one record per event:
+//
+//	int64  receive time, unix nanoseconds
+//	int64  poll time, unix nanoseconds or 0 for perf records
+//	uint16 program name length, then the name
+//	uint16 output id length, then the id
+//	uint32 key length, then the key bytes
+//	uint32 data length, then the data bytes
+//
+// All integers are little endian
+type CaptureWriter struct {
+	w io.Writer
+}
+
+// Start a capture on w, saving the clock offset kernel timestamps were
+// recorded against
+func NewCaptureWriter(w io.Writer, clockOffset int64) (*CaptureWriter, error) {
+	header := make([]byte, len(captureMagic)+8)
+	copy(header, captureMagic)
+	binary.LittleEndian.PutUint64(header[len(captureMagic):],
+		uint64(clockOffset))
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("capture.go: Error writing capture header: %s", err)
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Append a record. Each record is written with a single call so a capture cut
+// short by a signal only loses whole records
+func (cw *CaptureWriter) Write(record CaptureRecord) error {
+	if len(record.Program) > 0xffff {
+		return fmt.Errorf("capture.go: Program name %.32s... is too long",
+			record.Program)
+	}
+	if len(record.OutputId) > 0xffff {
+		return fmt.Errorf("capture.go: Output id %.32s... is too long",
+			record.OutputId)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, record.ReceiveTime.UnixNano())
+	var pollNanos int64
+	if !record.PollTime.IsZero() {
+		pollNanos = record.PollTime.UnixNano()
+	}
+	binary.Write(&buf, binary.LittleEndian, pollNanos)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(record.Program)))
+	buf.WriteString(record.Program)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(record.OutputId)))
+	buf.WriteString(record.OutputId)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(record.KeyData)))
+	buf.Write(record.KeyData)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(record.DataBytes)))
+	buf.Write(record.DataBytes)
+
+	if _, err := cw.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("capture.go: Error writing capture record: %s", err)
+	}
+	return nil
+}
+
+// Reads records back out of a capture file
+type CaptureReader struct {
+	r           *bufio.Reader
+	ClockOffset int64
+}
+
+// Open a capture, checking its header
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(captureMagic)+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("capture.go: Error reading capture header: %s", err)
+	}
+	magicLen := len(captureMagic) - 1
+	if !bytes.Equal(header[:magicLen], captureMagic[:magicLen]) {
+		return nil, fmt.Errorf("capture.go: Not a greggd capture file")
+	}
+	if version := header[magicLen]; version != captureMagic[magicLen] {
+		return nil, fmt.Errorf(
+			"capture.go: Capture format version %d is not supported, expected %d",
+			version, captureMagic[magicLen])
+	}
+	return &CaptureReader{r: br, ClockOffset: int64(
+		binary.LittleEndian.Uint64(header[len(captureMagic):]))}, nil
+}
+
+// Read the next record. Returns io.EOF once the capture is exhausted
+func (cr *CaptureReader) Next() (CaptureRecord, error) {
+	var record CaptureRecord
+	var nanos int64
+	err := binary.Read(cr.r, binary.LittleEndian, &nanos)
+	if err == io.EOF {
+		return record, io.EOF
+	}
+	if err != nil {
+		return record, fmt.Errorf("capture.go: Error reading record: %s", err)
+	}
+	record.ReceiveTime = time.Unix(0, nanos)
+	if err = binary.Read(cr.r, binary.LittleEndian, &nanos); err != nil {
+		return record, fmt.Errorf("capture.go: Truncated record: %s", err)
+	}
+	if nanos != 0 {
+		record.PollTime = time.Unix(0, nanos)
+	}
+
+	program, err := cr.readBlock(2)
+	if err != nil {
+		return record, err
+	}
+	record.Program = string(program)
+	id, err := cr.readBlock(2)
+	if err != nil {
+		return record, err
+	}
+	record.OutputId = string(id)
+	if record.KeyData, err = cr.readBlock(4); err != nil {
+		return record, err
+	}
+	if record.DataBytes, err = cr.readBlock(4); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// Read a length prefixed block, where the length is sizeLen bytes wide
+func (cr *CaptureReader) readBlock(sizeLen int) ([]byte, error) {
+	var length uint32
+	var err error
+	if sizeLen == 2 {
+		var short uint16
+		err = binary.Read(cr.r, binary.LittleEndian, &short)
+		length = uint32(short)
+	} else {
+		err = binary.Read(cr.r, binary.LittleEndian, &length)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("capture.go: Truncated record: %s", err)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, block); err != nil {
+		return nil, fmt.Errorf("capture.go: Truncated record: %s", err)
+	}
+	return block, nil
+}
+
+// Write every event tracers send on dataChan to a capture instead of a socket
+func RecordToFile(ctx context.Context, dataChan chan config.SocketInput,
+	errChan chan error, w io.Writer, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	// Save the offset the kernel timestamps in this capture are relative to, so
+	// they convert the same way on replay
+	err := CalibrateClock()
+	if err != nil {
+		errChan <- fmt.Errorf("capture.go: Error calibrating clock: %s\n", err)
+		return
+	}
+	capture, err := NewCaptureWriter(w, ClockOffset())
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case socketInput := <-dataChan:
+			err = capture.Write(CaptureRecord{
+				Program:     socketInput.Program,
+				OutputId:    socketInput.OutputConfig.Id,
+				KeyData:     socketInput.KeyData,
+				DataBytes:   socketInput.DataBytes,
+				ReceiveTime: socketInput.ReceiveTime,
+				PollTime:    socketInput.PollTime,
+			})
+			if err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}
+}
+
+// Parse a replay speed such as `10x`, `0.5` or `max`. Speed is a multiple of
+// the recorded rate, `max` replays without waiting between records and is
+// returned as zero
+func ParseReplaySpeed(speed string) (float64, error) {
+	if speed == "max" {
+		return 0, nil
+	}
+	multiple, err := strconv.ParseFloat(strings.TrimSuffix(speed, "x"), 64)
+	if err != nil || multiple <= 0 {
+		return 0, fmt.Errorf("capture.go: Invalid replay speed %s", speed)
+	}
+	return multiple, nil
+}
+
+// Identifies the output a record was read from
+type replayKey struct {
+	program  string
+	outputId string
+}
+
+// Decoding types for one output, built once per replay
+type replayOutput struct {
+	output   *config.BPFOutput
+	keyType  reflect.Type
+	dataType reflect.Type
+}
+
+// Send every record in a capture down dataChan as if a tracer had just read
+// it, keeping the recorded gaps between records scaled by speed. A speed of
+// zero replays as fast as the consumer allows. Records are matched to outputs
+// by program and output id, records for outputs missing from programs are an
+// error
+func Replay(ctx context.Context, capture *CaptureReader,
+	programs []config.BPFProgram, dataChan chan config.SocketInput,
+	speed float64) error {
+
+	// Convert kernel timestamps against the recording host's clock
+	PinClock(capture.ClockOffset)
+
+	outputs := make(map[replayKey]*replayOutput)
+	seen := make(map[string]string)
+	for i := range programs {
+		name := programs[i].Name()
+		for j := range programs[i].Outputs {
+			output := &programs[i].Outputs[j]
+			if other, ok := seen[output.Id]; ok {
+				return fmt.Errorf(
+					"capture.go: Programs %s and %s both have an output %s, output ids must be unique",
+					other, name, output.Id)
+			}
+			seen[output.Id] = name
+			dataType, err := BuildStructFromArray(output.Format)
+			if err != nil {
+				return fmt.Errorf("capture.go: Error building output %s: %s",
+					output.Id, err)
+			}
+			replay := &replayOutput{output: output, dataType: dataType}
+			if config.IsPolledType(output.Type) {
+				replay.keyType, err = BuildKeyType(*output)
+				if err != nil {
+					return fmt.Errorf("capture.go: Error building key of %s: %s",
+						output.Id, err)
+				}
+			}
+			outputs[replayKey{name, output.Id}] = replay
+		}
+	}
+
+	var firstRecord, start time.Time
+	for {
+		record, err := capture.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		replay, ok := outputs[replayKey{record.Program, record.OutputId}]
+		if !ok {
+			return fmt.Errorf("capture.go: Output %s of %s is not in the config",
+				record.OutputId, record.Program)
+		}
+
+		// Wait until this record is due
+		if firstRecord.IsZero() {
+			firstRecord, start = record.ReceiveTime, time.Now()
+		} else if speed > 0 {
+			offset := record.ReceiveTime.Sub(firstRecord)
+			due := start.Add(time.Duration(float64(offset) / speed))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(due)):
+			}
+		}
+
+		socketInput := config.SocketInput{
+			MeasurementName: record.OutputId,
+			Program:         record.Program,
+			KeyData:         record.KeyData,
+			KeyType:         replay.keyType,
+			DataBytes:       record.DataBytes,
+			DataType:        replay.dataType,
+			OutputConfig:    replay.output,
+			ReceiveTime:     record.ReceiveTime,
+			PollTime:        record.PollTime,
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case dataChan <- socketInput:
+		}
+	}
+}
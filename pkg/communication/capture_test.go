@@ -0,0 +1,204 @@
+package communication
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Confirm records read back the way they were written
+func TestCaptureRoundTrip(t *testing.T) {
+	records := []CaptureRecord{
+		{Program: "events.c", OutputId: "events",
+			DataBytes: []byte{1, 2, 3, 4}, ReceiveTime: time.Unix(10, 5)},
+		{Program: "biolatency", OutputId: "counts", KeyData: []byte{7, 0, 0, 0},
+			DataBytes:   []byte{9, 0, 0, 0, 0, 0, 0, 0},
+			ReceiveTime: time.Unix(11, 0),
+			PollTime:    time.Unix(10, 999)},
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewCaptureWriter(&buf, 1234)
+	if err != nil {
+		t.Fatalf("Error starting capture: %v", err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatalf("Error writing record: %v", err)
+		}
+	}
+
+	reader, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatalf("Error opening capture: %v", err)
+	}
+	if reader.ClockOffset != 1234 {
+		t.Errorf("Clock offset %d does not match 1234", reader.ClockOffset)
+	}
+	for _, expected := range records {
+		actual, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Error reading record: %v", err)
+		}
+		if actual.Program != expected.Program ||
+			actual.OutputId != expected.OutputId ||
+			!bytes.Equal(actual.KeyData, expected.KeyData) ||
+			!bytes.Equal(actual.DataBytes, expected.DataBytes) ||
+			!actual.ReceiveTime.Equal(expected.ReceiveTime) ||
+			!actual.PollTime.Equal(expected.PollTime) {
+			t.Errorf("Record %+v does not match expected %+v", actual, expected)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected EOF after last record, got %v", err)
+	}
+}
+
+// Confirm bad headers and truncated records are reported
+func TestCaptureErrors(t *testing.T) {
+	if _, err := NewCaptureReader(strings.NewReader("not a capture file")); err == nil {
+		t.Errorf("Expected error opening a file without the capture header")
+	}
+	for _, version := range []string{"\x01", "\x02"} {
+		oldVersion := "GREGGDC" + version + strings.Repeat("\x00", 8)
+		if _, err := NewCaptureReader(strings.NewReader(oldVersion)); err == nil {
+			t.Errorf("Expected error opening a capture of format version %q",
+				version)
+		}
+	}
+
+	var buf bytes.Buffer
+	writer, _ := NewCaptureWriter(&buf, 0)
+	writer.Write(CaptureRecord{OutputId: "events", DataBytes: []byte{1, 2, 3, 4}})
+	truncated := buf.Bytes()[:buf.Len()-2]
+	reader, err := NewCaptureReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatalf("Error opening capture: %v", err)
+	}
+	if _, err := reader.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected error reading truncated record, got %v", err)
+	}
+}
+
+func TestParseReplaySpeed(t *testing.T) {
+	tables := []struct {
+		input    string
+		expected float64
+		isErr    bool
+	}{
+		{"10x", 10, false},
+		{"0.5", 0.5, false},
+		{"max", 0, false},
+		{"0x", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tbl := range tables {
+		actual, err := ParseReplaySpeed(tbl.input)
+		if (err != nil) != tbl.isErr || actual != tbl.expected {
+			t.Errorf("Speed %s parsed to %v, %v", tbl.input, actual, err)
+		}
+	}
+}
+
+// Confirm replayed records decode and format like live ones, using the
+// recorded receive time as the record time
+func TestReplay(t *testing.T) {
+	defer atomic.StoreInt32(&clockPinned, 0)
+
+	programs := []config.BPFProgram{{Source: "test.c",
+		Outputs: []config.BPFOutput{
+			{Id: "events", Type: "BPF_PERF_OUTPUT", Format: []config.BPFOutputFormat{
+				{Name: "pid", Type: "u32"}}},
+			{Id: "counts", Type: "BPF_HASH",
+				Key:    config.BPFOutputFormat{Name: "cpu", Type: "u32"},
+				Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}},
+		}}}
+
+	var capture bytes.Buffer
+	writer, _ := NewCaptureWriter(&capture, 0)
+	writer.Write(CaptureRecord{Program: "test.c", OutputId: "events",
+		DataBytes: []byte{42, 0, 0, 0}, ReceiveTime: time.Unix(100, 0)})
+	writer.Write(CaptureRecord{Program: "test.c", OutputId: "counts",
+		KeyData: []byte{3, 0, 0, 0}, DataBytes: []byte{5, 0, 0, 0, 0, 0, 0, 0},
+		ReceiveTime: time.Unix(101, 0), PollTime: time.Unix(100, 500)})
+
+	reader, err := NewCaptureReader(&capture)
+	if err != nil {
+		t.Fatalf("Error opening capture: %v", err)
+	}
+
+	// Replay at max speed, formatting each record as the sink would
+	ctx := context.Background()
+	dataChan := make(chan config.SocketInput)
+	errChan := make(chan error, 2)
+	replayErr := make(chan error)
+	go func() {
+		replayErr <- Replay(ctx, reader, programs, dataChan, 0)
+	}()
+
+	var output bytes.Buffer
+	for done := false; !done; {
+		select {
+		case socketInput := <-dataChan:
+			// Hash records keep the poll they were read in
+			if socketInput.MeasurementName == "counts" &&
+				!socketInput.PollTime.Equal(time.Unix(100, 500)) {
+				t.Errorf("Replayed hash record has poll time %v",
+					socketInput.PollTime)
+			}
+			bytesToSocket(ctx, socketInput, errChan, config.GlobalOptions{},
+				influxSinks(&output), nil)
+		case err := <-replayErr:
+			if err != nil {
+				t.Fatalf("Error replaying capture: %v", err)
+			}
+			done = true
+		}
+	}
+	select {
+	case err := <-errChan:
+		t.Fatalf("Error formatting replayed record: %v", err)
+	default:
+	}
+
+	expected := "bpf,sensor=events pid=42u 100000000000\n" +
+		"bpf,sensor=counts count=5u,cpu=3u 101000000000\n"
+	actual := output.String()
+	if actual != expected {
+		t.Errorf("Replay output %q does not match %q", actual, expected)
+	}
+
+	// Records for outputs missing from the config are an error, including
+	// outputs of the same id in another program
+	for _, missing := range []CaptureRecord{
+		{Program: "test.c", OutputId: "missing", DataBytes: []byte{0}},
+		{Program: "other.c", OutputId: "events", DataBytes: []byte{0}},
+	} {
+		capture.Reset()
+		writer, _ = NewCaptureWriter(&capture, 0)
+		writer.Write(missing)
+		reader, _ = NewCaptureReader(&capture)
+		err = Replay(ctx, reader, programs, dataChan, 0)
+		if err == nil {
+			t.Errorf("Expected error replaying output %s of %s", missing.OutputId,
+				missing.Program)
+		}
+	}
+
+	// Outputs can't be told apart if two programs share an id
+	capture.Reset()
+	writer, _ = NewCaptureWriter(&capture, 0)
+	reader, _ = NewCaptureReader(&capture)
+	shared := append(programs, config.BPFProgram{Source: "other.c",
+		Outputs: []config.BPFOutput{programs[0].Outputs[0]}})
+	err = Replay(ctx, reader, shared, dataChan, 0)
+	if err == nil {
+		t.Errorf("Expected error replaying programs with a shared output id")
+	}
+}
@@ -0,0 +1,94 @@
+package communication
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// CLOCK_MONOTONIC from linux/time.h. This is the clock bpf_ktime_get_ns() reads
+const clockMonotonic = 1
+
+// Number of samples to take when calibrating. The sample with the tightest
+// window around the monotonic read wins
+const calibrationSamples = 5
+
+// Offset in nanoseconds to add to a kernel monotonic timestamp to get unix
+// time. Zero until CalibrateClock has been called
+var bootOffset int64
+
+// Set once the offset has been pinned by PinClock. Calibration is skipped from
+// then on
+var clockPinned int32
+
+// Held while the offset is stored, so a calibration that started before the
+// clock was pinned can't overwrite the pinned offset
+var clockMu sync.Mutex
+
+// Read CLOCK_MONOTONIC in nanoseconds
+func monotonicNow() (int64, error) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic,
+		uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, fmt.Errorf("clock.go: Error reading monotonic clock: %s", errno)
+	}
+	return ts.Nano(), nil
+}
+
+// Measure the offset between wall-clock and kernel monotonic time. Bracket
+// each monotonic read with wall-clock reads and keep the offset from the
+// narrowest bracket, so scheduling delays don't leak into the offset
+func CalibrateClock() error {
+	if atomic.LoadInt32(&clockPinned) != 0 {
+		return nil
+	}
+	var bestOffset, bestWindow int64
+	for i := 0; i < calibrationSamples; i++ {
+		before := time.Now().UnixNano()
+		mono, err := monotonicNow()
+		if err != nil {
+			return err
+		}
+		after := time.Now().UnixNano()
+
+		window := after - before
+		if i == 0 || window < bestWindow {
+			bestWindow = window
+			bestOffset = before + window/2 - mono
+		}
+	}
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	if atomic.LoadInt32(&clockPinned) == 0 {
+		atomic.StoreInt64(&bootOffset, bestOffset)
+	}
+	return nil
+}
+
+// Convert a bpf_ktime_get_ns() value to wall-clock time. Returns the zero time
+// if the clock hasn't been calibrated or the value is empty
+func KtimeToTime(ktime uint64) time.Time {
+	offset := atomic.LoadInt64(&bootOffset)
+	if offset == 0 || ktime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ktime)+offset)
+}
+
+// Current offset between kernel monotonic time and unix time in nanoseconds
+func ClockOffset() int64 {
+	return atomic.LoadInt64(&bootOffset)
+}
+
+// Fix the kernel time offset, e.g. to the one a capture was recorded with.
+// Later calls to CalibrateClock leave it unchanged
+func PinClock(offset int64) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	atomic.StoreInt32(&clockPinned, 1)
+	atomic.StoreInt64(&bootOffset, offset)
+}
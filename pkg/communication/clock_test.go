@@ -0,0 +1,122 @@
+package communication
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Confirm calibrated kernel times land close to the current wall-clock time
+func TestKtimeToTime(t *testing.T) {
+	if !KtimeToTime(0).IsZero() {
+		t.Errorf("Empty kernel time did not convert to zero time")
+	}
+
+	err := CalibrateClock()
+	if err != nil {
+		t.Fatalf("Error calibrating clock: %v", err)
+	}
+	mono, err := monotonicNow()
+	if err != nil {
+		t.Fatalf("Error reading monotonic clock: %v", err)
+	}
+	converted := KtimeToTime(uint64(mono))
+	if diff := time.Since(converted); diff < -time.Second || diff > time.Second {
+		t.Errorf("Converted kernel time %v is %v from now", converted, diff)
+	}
+}
+
+// Confirm timestamp fields are used as the record time and dropped from fields
+func TestDecodeOutputTimestamp(t *testing.T) {
+	err := CalibrateClock()
+	if err != nil {
+		t.Fatalf("Error calibrating clock: %v", err)
+	}
+	mono, err := monotonicNow()
+	if err != nil {
+		t.Fatalf("Error reading monotonic clock: %v", err)
+	}
+	outType := reflect.StructOf([]reflect.StructField{
+		{Name: "Ts", Type: reflect.TypeOf(uint64(0))},
+		{Name: "Pid", Type: reflect.TypeOf(uint32(0))},
+	})
+	outFormat := []config.BPFOutputFormat{
+		{Name: "ts", Type: "u64", Timestamp: true},
+		{Name: "pid", Type: "u32"},
+	}
+	receiveTime := time.Unix(0, 1000)
+
+	tables := []struct {
+		ktime    uint64
+		expected int64
+	}{
+		// Kernel timestamp is set, use it
+		{uint64(mono), KtimeToTime(uint64(mono)).UnixNano()},
+		// Kernel timestamp is empty, fall back to receive time
+		{0, receiveTime.UnixNano()},
+	}
+	for _, tbl := range tables {
+		outStruct := reflect.New(outType).Elem()
+		outStruct.Field(0).SetUint(tbl.ktime)
+		outStruct.Field(1).SetUint(42)
+
+		output, err := formatInflux(NewRecord("test"), outStruct, outFormat,
+			receiveTime)
+		if err != nil {
+			t.Errorf("Error formatting output: %v", err)
+			continue
+		}
+		if strings.Contains(output, "ts=") {
+			t.Errorf("Timestamp field was written as a field: %s", output)
+		}
+		fields := strings.Fields(output)
+		actual := fields[len(fields)-1]
+		if actual != strconv.FormatInt(tbl.expected, 10) {
+			t.Errorf("Record timestamp %s does not match expected %d", actual,
+				tbl.expected)
+		}
+	}
+}
+
+// Confirm calibrations running while the clock is pinned never replace the
+// pinned offset
+func TestPinClockConcurrent(t *testing.T) {
+	defer atomic.StoreInt32(&clockPinned, 0)
+
+	const pinned = int64(12345)
+	for trial := 0; trial < 50; trial++ {
+		atomic.StoreInt32(&clockPinned, 0)
+		var stop int32
+		var wg sync.WaitGroup
+		started := make(chan bool, 2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				started <- true
+				for atomic.LoadInt32(&stop) == 0 {
+					if err := CalibrateClock(); err != nil {
+						t.Errorf("Error calibrating clock: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < 2; i++ {
+			<-started
+		}
+		PinClock(pinned)
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+		if offset := ClockOffset(); offset != pinned {
+			t.Fatalf("Clock offset is %d after calibrating, expected pinned %d",
+				offset, pinned)
+		}
+	}
+}
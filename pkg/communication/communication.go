@@ -2,9 +2,11 @@ package communication
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,36 +18,82 @@ func BytesToSock(ctx context.Context, dataChan chan config.SocketInput,
 
 	defer wg.Done()
 
-	var c net.Conn
-	// Try to open socket
-	err := retry(0, globals.CompiledRetryDelay, globals, func() error {
-		conn, err := net.Dial("unix", globals.SocketPath)
-		// Save open conn to var outside our scope
-		c = conn
-		return err
-	})
-
+	// Calibrate kernel time conversion before any data is formatted, then
+	// recalibrate periodically to follow wall-clock adjustments
+	err := CalibrateClock()
 	if err != nil {
-		errChan <- fmt.Errorf("communication.go: Error dialing socket %s: %s\n",
-			globals.SocketPath, err)
+		errChan <- fmt.Errorf("communication.go: Error calibrating clock: %s\n",
+			err)
 		return
 	}
+	clockTicker := time.NewTicker(globals.CompiledClockSyncInterval)
+	defer clockTicker.Stop()
+
+	// Open every sink before reading data
+	var sinks []*Sink
+	for _, sinkConfig := range globals.Sinks {
+		sink, err := OpenSink(sinkConfig, globals)
+		if err != nil {
+			errChan <- fmt.Errorf("communication.go: %s\n", err)
+			return
+		}
+		defer sink.Close()
+		sinks = append(sinks, sink)
+	}
+
+	// Serve hash and histogram outputs as metrics if asked to
+	var metrics *MetricStore
+	if globals.Prometheus.Listen != "" {
+		listener, err := net.Listen("tcp", globals.Prometheus.Listen)
+		if err != nil {
+			errChan <- fmt.Errorf("communication.go: Error listening for metrics: %s\n",
+				err)
+			return
+		}
+		metrics = NewMetricStore()
+		go func() {
+			err := ServeMetrics(ctx, listener, metrics)
+			if err != nil {
+				errChan <- fmt.Errorf("communication.go: %s\n", err)
+			}
+		}()
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-clockTicker.C:
+			err = CalibrateClock()
+			if err != nil {
+				errChan <- fmt.Errorf(
+					"communication.go: Error recalibrating clock: %s\n", err)
+				return
+			}
 		case socketInput := <-dataChan:
-			bytesToSocket(ctx, socketInput, errChan, globals, c)
+			bytesToSocket(ctx, socketInput, errChan, globals, sinks, metrics)
 		}
 	}
 }
 
+// Decode, filter and encode a record, writing it to every sink and adding it
+// to metrics when they are served
 func bytesToSocket(ctx context.Context, socketInput config.SocketInput,
-	errChan chan error, globals config.GlobalOptions, c net.Conn) {
+	errChan chan error, globals config.GlobalOptions, sinks []*Sink,
+	metrics *MetricStore) {
 
-	// Write key to struct
-	if len(socketInput.KeyData) != 0 {
+	record := NewRecord(socketInput.MeasurementName)
+	record.MetricType = socketInput.OutputConfig.Metric.Type
+	record.Cleared = socketInput.OutputConfig.Clear
+	if socketInput.OutputConfig.CompiledMeasurement != "" {
+		record.Measurement = socketInput.OutputConfig.CompiledMeasurement
+	}
+	addGlobalTags(record, globals)
+
+	// Write key to struct. Struct keys are split into tags and fields like the
+	// data, single value keys are saved as a field
+	if len(socketInput.KeyData) != 0 &&
+		len(socketInput.OutputConfig.KeyFormat) != 0 {
 		keyData, err := writeBinaryToStruct(socketInput.KeyData,
 			socketInput.KeyType)
 		if err != nil {
@@ -53,13 +101,41 @@ func bytesToSocket(ctx context.Context, socketInput config.SocketInput,
 				err)
 			return
 		}
-		keyDataString, err := getFieldValue(*keyData, socketInput.OutputConfig.Key)
+		_, keep, err := formatStructFields(*keyData, record,
+			socketInput.OutputConfig.KeyFormat)
 		if err != nil {
 			errChan <- fmt.Errorf("tracer.go: Error writing key to string: %s\n",
 				err)
 			return
 		}
-		socketInput.Fields[socketInput.OutputConfig.Key.Name] = keyDataString
+		if !keep {
+			return
+		}
+		for _, format := range socketInput.OutputConfig.KeyFormat {
+			name := strings.ToLower(format.Name)
+			if _, ok := record.Fields[name]; ok {
+				record.KeyFields = append(record.KeyFields, name)
+			}
+		}
+	} else if len(socketInput.KeyData) != 0 {
+		keyData, err := writeBinaryToStruct(socketInput.KeyData,
+			socketInput.KeyType)
+		if err != nil {
+			errChan <- fmt.Errorf("tracer.go: Error writing key to struct: %s\n",
+				err)
+			return
+		}
+		keyValue, err := getFieldValue(*keyData, socketInput.OutputConfig.Key)
+		if err != nil {
+			errChan <- fmt.Errorf("tracer.go: Error writing key to string: %s\n",
+				err)
+			return
+		}
+		if keyValue == nil {
+			return
+		}
+		record.Fields[socketInput.OutputConfig.Key.Name] = keyValue
+		record.KeyFields = []string{socketInput.OutputConfig.Key.Name}
 	}
 
 	// Write data to struct
@@ -71,54 +147,126 @@ func bytesToSocket(ctx context.Context, socketInput config.SocketInput,
 		return
 	}
 
-	// Influx format
-	outputString, err := FormatOutput(socketInput.MeasurementName, *outputStruct,
-		socketInput.Tags, socketInput.Fields, socketInput.OutputConfig.Format)
+	// Apply the output's filter expression before formatting
+	if socketInput.OutputConfig.CompiledFilter != nil {
+		values, err := decodedRecord(socketInput, *outputStruct)
+		if err != nil {
+			errChan <- fmt.Errorf("tracer.go: Error building filter record: %s\n",
+				err)
+			return
+		}
+		if config.FilterDrops(socketInput.OutputConfig.FilterAction,
+			socketInput.OutputConfig.CompiledFilter.Eval(values)) {
+			return
+		}
+	}
+
+	keep, err := DecodeOutput(record, *outputStruct,
+		socketInput.OutputConfig.Format, socketInput.ReceiveTime)
 	if err != nil {
 		errChan <- fmt.Errorf("tracer.go: Error formatting output: %s\n", err)
 		return
 	}
+	if !keep {
+		return
+	}
+
+	if metrics != nil {
+		err = metrics.Observe(record, socketInput.OutputConfig,
+			socketInput.PollTime)
+		if err != nil {
+			errChan <- fmt.Errorf("tracer.go: %s\n", err)
+			return
+		}
+	}
 
-	// Send to socket
-	err = sendOutputToSock(outputString, c, 0, globals)
+	// Outputs can pick their own encoding for every sink
+	outputFormatter, err := OutputFormatter(socketInput.OutputConfig)
 	if err != nil {
-		errChan <- fmt.Errorf("tracer.go: Error sending output to socket: %s\n",
-			err)
+		errChan <- fmt.Errorf("tracer.go: %s\n", err)
 		return
 	}
+	encoded := make(map[Formatter][]byte)
+	for _, sink := range sinks {
+		if sink.otlp != nil {
+			err = sink.otlp.Export(record, socketInput.OutputConfig,
+				socketInput.PollTime)
+			if err != nil {
+				errChan <- fmt.Errorf("tracer.go: %s\n", err)
+				return
+			}
+			continue
+		}
+		formatter := sink.formatter
+		if outputFormatter != nil && !sink.ownEncoding {
+			formatter = outputFormatter
+		}
+		// Sinks sharing an encoding share the encoded record
+		output, ok := encoded[formatter]
+		if !ok {
+			output, err = formatter.Format(record)
+			if err != nil {
+				errChan <- fmt.Errorf("tracer.go: Error formatting output: %s\n",
+					err)
+				return
+			}
+			encoded[formatter] = output
+		}
+		err = sink.Write(output)
+		if err != nil {
+			errChan <- fmt.Errorf("tracer.go: Error sending output to sink: %s\n",
+				err)
+			return
+		}
+	}
 
 	// Verbose print
 	if globals.Verbose {
-		switch globals.VerboseFormat {
-		case "json":
-			// Get raw JSON output, does not convert byte arrays to strings
-			outputJson, _ := json.Marshal(outputStruct.Interface())
-			fmt.Printf("%s\n", outputJson)
-		default:
-			fmt.Printf(outputString)
+		formatter, err := NewFormatter(globals.VerboseFormat)
+		if err == nil {
+			output, err := formatter.Format(record)
+			if err == nil {
+				os.Stdout.Write(output)
+			}
 		}
 	}
 }
 
-func sendOutputToSock(outString string, c net.Conn, errCount int,
-	globals config.GlobalOptions) error {
-
-	// Drop empty strings
-	if outString == "" {
-		return nil
-	}
+// Collect the raw decoded key and data values of a record by field name, for
+// evaluating filter expressions
+func decodedRecord(socketInput config.SocketInput,
+	outputStruct reflect.Value) (map[string]interface{}, error) {
 
-	// Try to write to socket, retrying on failures
-	err := retry(0, globals.CompiledRetryDelay, globals, func() error {
-		_, err := c.Write([]byte(outString))
-		return err
-	})
+	record := make(map[string]interface{})
+	addStructFields(record, outputStruct, socketInput.OutputConfig.Format)
 
+	if len(socketInput.KeyData) == 0 {
+		return record, nil
+	}
+	keyData, err := writeBinaryToStruct(socketInput.KeyData,
+		socketInput.KeyType)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if len(socketInput.OutputConfig.KeyFormat) != 0 {
+		addStructFields(record, *keyData, socketInput.OutputConfig.KeyFormat)
+	} else {
+		record[socketInput.OutputConfig.Key.Name] = keyData.Interface()
+	}
+	return record, nil
+}
 
-	return nil
+// Add each field of a decoded struct to record under its format name,
+// skipping padding
+func addStructFields(record map[string]interface{}, structVal reflect.Value,
+	formats []config.BPFOutputFormat) {
+
+	for i := 0; i < structVal.NumField(); i++ {
+		if structVal.Type().Field(i).Name == "_" {
+			continue
+		}
+		record[formats[i].Name] = structVal.Field(i).Interface()
+	}
 }
 
 // Retry a given function for a number of attempts with a given delay
@@ -3,9 +3,9 @@ package communication
 import (
 	"bytes"
 	"context"
+	"io"
 	"net"
 	"reflect"
-	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -14,6 +14,11 @@ import (
 	"github.com/olcf/greggd/pkg/config"
 )
 
+// Sinks writing influx to w
+func influxSinks(w io.Writer) []*Sink {
+	return []*Sink{NewWriterSink(w, InfluxFormatter{})}
+}
+
 func TestBytesToSocket(t *testing.T) {
 	// Set up system vars
 	ctx := context.Background()
@@ -32,10 +37,9 @@ func TestBytesToSocket(t *testing.T) {
 	}{
 		{
 			// Basic test to make sure everything works
-			"bpf,sensor=test key=25601,testdata=16836864",
+			"bpf,sensor=test key=25601u,testdata=16836864u",
 			config.SocketInput{
-				MeasurementName: "test", Fields: map[string]string{},
-				Tags: map[string]string{}, KeyType: reflect.TypeOf(uint32(0)),
+				MeasurementName: "test", KeyType: reflect.TypeOf(uint32(0)),
 				KeyData: []byte{1, 100, 0, 0},
 				DataType: reflect.StructOf([]reflect.StructField{{Name: "Testdata",
 					Type: reflect.TypeOf(uint32(0))}}), DataBytes: []byte{0, 233, 0, 1},
@@ -54,9 +58,9 @@ func TestBytesToSocket(t *testing.T) {
 		// Read output from socket byte by byte until newline
 		var wg sync.WaitGroup
 		actualOutput := bytes.NewBuffer([]byte{})
+		wg.Add(2)
 		go func() {
 			tmp := make([]byte, 1)
-			wg.Add(1)
 			for {
 				_, err := server.Read(tmp)
 				if err != nil {
@@ -71,7 +75,6 @@ func TestBytesToSocket(t *testing.T) {
 		}()
 		// Check the error channel output from socket
 		go func() {
-			wg.Add(1)
 			select {
 			case err := <-errChan:
 				if err != nil {
@@ -82,27 +85,276 @@ func TestBytesToSocket(t *testing.T) {
 			wg.Done()
 		}()
 		// Really run the test
-		bytesToSocket(ctx, tbl.socketInput, errChan, config.GlobalOptions{}, client)
+		bytesToSocket(ctx, tbl.socketInput, errChan, config.GlobalOptions{},
+			influxSinks(client), nil)
 		wg.Wait()
 
-		// Parse the output
-		stringOutput := actualOutput.String()
-		// Output is filtered through a map internally, not guaranteed to have same
-		// output consistently. Sort each section of output and join
-		spaceSplit := strings.Split(stringOutput, " ")
-		var sortedOutputArr []string
-		for _, statement := range spaceSplit {
-			commaSplit := strings.Split(statement, ",")
-			sort.Strings(commaSplit)
-			sortedOutputArr = append(sortedOutputArr, strings.Join(commaSplit, ","))
-		}
-		sortedOutputString := strings.Join(sortedOutputArr, " ")
 		// Drop timestamp field
-		lastSpace := strings.LastIndex(sortedOutputString, " ")
+		stringOutput := actualOutput.String()
+		lastSpace := strings.LastIndex(stringOutput, " ")
 		// Compare values
-		if sortedOutputString[:lastSpace] != tbl.expectedOutput {
+		if stringOutput[:lastSpace] != tbl.expectedOutput {
 			t.Errorf("String output '%v' does not match expected value '%v'",
-				sortedOutputString[:lastSpace], tbl.expectedOutput)
+				stringOutput[:lastSpace], tbl.expectedOutput)
+		}
+	}
+}
+
+// Confirm every record gets the global and host tags, and that the output's
+// own tags win
+func TestBytesToSocketGlobalTags(t *testing.T) {
+	output := &config.BPFOutput{Id: "counts", Type: "BPF_HASH",
+		Format: []config.BPFOutputFormat{{Name: "rack", Type: "u8", IsTag: true},
+			{Name: "count", Type: "u8"}}}
+	dataType, _ := BuildStructFromArray(output.Format)
+	globals := config.GlobalOptions{HostTags: []string{"host", "machine_id"},
+		Tags: map[string]string{"cluster": "frontier", "rack": "r1", "role": ""}}
+
+	var buf bytes.Buffer
+	errChan := make(chan error, 1)
+	bytesToSocket(context.Background(), config.SocketInput{
+		MeasurementName: "counts", DataType: dataType, DataBytes: []byte{7, 3},
+		OutputConfig: output}, errChan, globals, influxSinks(&buf), nil)
+	select {
+	case err := <-errChan:
+		t.Fatalf("Error sending record: %v", err)
+	default:
+	}
+
+	expected := map[string]string{"sensor": "counts", "cluster": "frontier",
+		"rack": "7", "host": hostName()}
+	if machineID := hostMetadata()["machine_id"]; machineID != "" {
+		expected["machine_id"] = machineID
+	}
+	line := strings.SplitN(buf.String(), " ", 2)[0]
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(line, ",")[1:] {
+		name, value, _ := strings.Cut(pair, "=")
+		tags[name] = value
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Record has tags %v, expected %v", tags, expected)
+	}
+}
+
+// Confirm records are written to their output's measurement, keeping the
+// sensor tag
+func TestBytesToSocketMeasurement(t *testing.T) {
+	output := &config.BPFOutput{Id: "counts", Type: "BPF_HASH",
+		Format:              []config.BPFOutputFormat{{Name: "count", Type: "u8"}},
+		CompiledMeasurement: "greggd_counts"}
+	dataType, _ := BuildStructFromArray(output.Format)
+	var buf bytes.Buffer
+	errChan := make(chan error, 1)
+	bytesToSocket(context.Background(), config.SocketInput{
+		MeasurementName: "counts", DataType: dataType, DataBytes: []byte{3},
+		OutputConfig: output, ReceiveTime: time.Unix(1, 0)}, errChan,
+		config.GlobalOptions{}, influxSinks(&buf), nil)
+	select {
+	case err := <-errChan:
+		t.Fatalf("Error sending record: %v", err)
+	default:
+	}
+	expected := "greggd_counts,sensor=counts count=3u 1000000000\n"
+	if buf.String() != expected {
+		t.Errorf("Record written as %q, expected %q", buf.String(), expected)
+	}
+}
+
+// Confirm records matching the output filter expression are dropped before
+// formatting, looking at both key and data fields
+func TestBytesToSocketFilterExpression(t *testing.T) {
+	output := &config.BPFOutput{Id: "counts", Type: "BPF_HASH",
+		Key:    config.BPFOutputFormat{Name: "cpu", Type: "u32"},
+		Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}}
+	filter, err := config.CompileFilterExpression("cpu == 0 && count > 10",
+		map[string]string{"cpu": "u32", "count": "u64"})
+	if err != nil {
+		t.Fatalf("Error compiling filter: %v", err)
+	}
+	output.CompiledFilter = filter
+
+	dataType, _ := BuildStructFromArray(output.Format)
+	keyType, _ := BuildKeyType(*output)
+	tables := []struct {
+		key     byte
+		count   byte
+		dropped bool
+	}{
+		{0, 20, true},
+		{0, 5, false},
+		{1, 20, false},
+	}
+	for _, tbl := range tables {
+		var buf bytes.Buffer
+		errChan := make(chan error, 1)
+		bytesToSocket(context.Background(), config.SocketInput{
+			MeasurementName: "counts", KeyType: keyType,
+			KeyData: []byte{tbl.key, 0, 0, 0}, DataType: dataType,
+			DataBytes:    []byte{tbl.count, 0, 0, 0, 0, 0, 0, 0},
+			OutputConfig: output}, errChan, config.GlobalOptions{}, influxSinks(&buf), nil)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Error sending record: %v", err)
+		default:
+		}
+		if dropped := buf.Len() == 0; dropped != tbl.dropped {
+			t.Errorf("Record cpu=%d count=%d dropped is %v, expected %v", tbl.key,
+				tbl.count, dropped, tbl.dropped)
+		}
+	}
+}
+
+// Confirm keep and drop filters combine: any matching drop filter drops the
+// record, and every keep filter has to match for it to be kept
+func TestBytesToSocketFilterActions(t *testing.T) {
+	configStruct, err := config.ParseConfig(strings.NewReader(`
+programs:
+  - source: test.c
+    outputs:
+      - id: opens
+        type: BPF_PERF_OUTPUT
+        filter: uid < 5000
+        filterAction: keep
+        format:
+          - name: comm
+            type: char[16]
+            filter:
+              or: [{have-prefix: cp}, {have-prefix: rsync}]
+            filterAction: keep
+          - name: fname
+            type: char[32]
+            filter:
+              match-regexp: ^/lustre/
+            filterAction: keep
+          - name: cwd
+            type: char[16]
+            filter:
+              have-prefix: /tmp
+          - name: uid
+            type: u32
+`))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	output := &configStruct.Programs[0].Outputs[0]
+	dataType, err := BuildStructFromArray(output.Format)
+	if err != nil {
+		t.Fatalf("Error building struct: %v", err)
+	}
+
+	tables := []struct {
+		comm  string
+		fname string
+		cwd   string
+		kept  bool
+	}{
+		{"cp", "/lustre/a", "/home", true},
+		{"rsync", "/lustre/b", "/home", true},
+		{"cp", "/home/a", "/home", false},
+		{"bash", "/lustre/a", "/home", false},
+		{"cp", "/lustre/a", "/tmp/x", false},
+	}
+	for _, tbl := range tables {
+		data := make([]byte, 68)
+		copy(data[0:16], tbl.comm)
+		copy(data[16:48], tbl.fname)
+		copy(data[48:64], tbl.cwd)
+		data[64] = 100
+		var buf bytes.Buffer
+		errChan := make(chan error, 1)
+		bytesToSocket(context.Background(), config.SocketInput{
+			MeasurementName: "opens", DataType: dataType, DataBytes: data,
+			OutputConfig: output}, errChan, config.GlobalOptions{}, influxSinks(&buf), nil)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Error sending record: %v", err)
+		default:
+		}
+		if kept := buf.Len() != 0; kept != tbl.kept {
+			t.Errorf("Record %+v kept is %v, expected %v", tbl, kept, tbl.kept)
+		}
+	}
+
+	// The record filter keeps only uids under 5000
+	data := make([]byte, 68)
+	copy(data[0:16], "cp")
+	copy(data[16:48], "/lustre/a")
+	copy(data[48:64], "/home")
+	data[64], data[65] = 0x70, 0x17
+	var buf bytes.Buffer
+	bytesToSocket(context.Background(), config.SocketInput{
+		MeasurementName: "opens", DataType: dataType, DataBytes: data,
+		OutputConfig: output}, make(chan error, 1), config.GlobalOptions{}, influxSinks(&buf), nil)
+	if buf.Len() != 0 {
+		t.Errorf("Record with uid 6000 was not dropped by the keep expression")
+	}
+}
+
+// Confirm field filters see the raw decoded value, not the quoted or
+// formatted output
+func TestBytesToSocketRawFilters(t *testing.T) {
+	configStruct, err := config.ParseConfig(strings.NewReader(`
+programs:
+  - source: test.c
+    outputs:
+      - id: opens
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: fname
+            type: char[16]
+            filter:
+              have-prefix: /proc
+          - name: flags
+            type: u16
+            formatString: "%#o"
+            filter: 8
+          - name: uid
+            type: u32
+            filter:
+              gt: 60000
+`))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	output := &configStruct.Programs[0].Outputs[0]
+	dataType, err := BuildStructFromArray(output.Format)
+	if err != nil {
+		t.Fatalf("Error building struct: %v", err)
+	}
+
+	tables := []struct {
+		fname string
+		flags byte
+		uid   uint16
+		kept  bool
+	}{
+		{"/home/a", 0, 1000, true},
+		{"/proc/self", 0, 1000, false},
+		{"/home/a", 8, 1000, false},
+		{"/home/a", 0, 65000, false},
+	}
+	for _, tbl := range tables {
+		// Decoded structs are packed, uid directly follows flags
+		data := make([]byte, 22)
+		copy(data[0:16], tbl.fname)
+		data[16] = tbl.flags
+		data[18], data[19] = byte(tbl.uid), byte(tbl.uid>>8)
+		var buf bytes.Buffer
+		errChan := make(chan error, 1)
+		bytesToSocket(context.Background(), config.SocketInput{
+			MeasurementName: "opens", DataType: dataType, DataBytes: data,
+			OutputConfig: output}, errChan, config.GlobalOptions{}, influxSinks(&buf), nil)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Error sending record: %v", err)
+		default:
+		}
+		if kept := buf.Len() != 0; kept != tbl.kept {
+			t.Errorf("Record %+v kept is %v, expected %v", tbl, kept, tbl.kept)
+		}
+		if tbl.kept && !strings.Contains(buf.String(), `fname="/home/a"`) {
+			t.Errorf("String field was not quoted in output %q", buf.String())
 		}
 	}
 }
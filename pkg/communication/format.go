@@ -4,34 +4,75 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/olcf/greggd/pkg/config"
 )
 
-func formatValueField(value string) string {
-	value = strings.Replace(value, ",", "\\,", -1)
-	value = strings.Replace(value, "=", "\\=", -1)
-	value = strings.Replace(value, " ", "\\ ", -1)
-	return value
+// A decoded record ready to be encoded. Field values are int64, uint64,
+// float64, bool or string
+type Record struct {
+	// Id of the output the record was read from
+	Sensor      string
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Timestamp   time.Time
+	// Metric type of the output, from config.MetricTypes. Empty for perf
+	// outputs
+	MetricType string
+	// Set for hash and histogram records cleared on every poll, whose values
+	// count only since the last poll
+	Cleared bool
+	// Fields read from the key of hash and histogram records. Graphite and
+	// statsd name paths by them rather than writing them as values
+	KeyFields []string
 }
 
-func escapeField(field string) string {
-	var sb strings.Builder
-
-	sb.WriteString(strings.Replace(field, "\"", "\\\"", -1))
-	return sb.String()
+// Start a record for data read from a map. Records start in the bpf
+// measurement, told apart by their sensor tag, until their output's
+// measurement is set
+func NewRecord(mapName string) *Record {
+	return &Record{Sensor: mapName, Measurement: "bpf",
+		Tags: map[string]string{"sensor": mapName}, Fields: map[string]interface{}{}}
 }
 
-func formatTag(tag string) string {
-	var sb strings.Builder
-
-	sb.WriteString(tag)
-	return sb.String()
+// Metadata of this host by tag name, read once. Values that can't be read are
+// empty
+var hostMetadata = sync.OnceValue(func() map[string]string {
+	read := func(path string) string {
+		value, _ := os.ReadFile(path)
+		return strings.TrimSpace(string(value))
+	}
+	return map[string]string{
+		"host":           hostName(),
+		"kernel_release": read("/proc/sys/kernel/osrelease"),
+		"boot_id":        read("/proc/sys/kernel/random/boot_id"),
+		"machine_id":     read("/etc/machine-id"),
+	}
+})
+
+// Add the host and static tags globals set to a record. Empty values are left
+// out
+func addGlobalTags(record *Record, globals config.GlobalOptions) {
+	for _, name := range globals.HostTags {
+		if value := hostMetadata()[name]; value != "" {
+			record.Tags[name] = value
+		}
+	}
+	for name, value := range globals.Tags {
+		if value != "" {
+			record.Tags[name] = value
+		}
+	}
 }
+
 func Max(x, y int) int {
 	if x < y {
 		return y
@@ -39,9 +80,13 @@ func Max(x, y int) int {
 	return x
 }
 
-// Function to read in and parse values. Recursable
-func getFieldValue(fieldVal reflect.Value, fieldFormat config.BPFOutputFormat) (string, error) {
-	var sb strings.Builder
+// Read in a field and decode it to a typed value, recursing into arrays of
+// strings. Char arrays become strings, IPs their dotted form and numbers int64,
+// uint64 or float64. Fields with a format string become the formatted string.
+// Returns nil if the value was filtered out or is an empty string
+func getFieldValue(fieldVal reflect.Value,
+	fieldFormat config.BPFOutputFormat) (interface{}, error) {
+
 	var err error
 	var value interface{}
 
@@ -51,14 +96,15 @@ func getFieldValue(fieldVal reflect.Value, fieldFormat config.BPFOutputFormat) (
 		// Check if array of arrays or just an array
 		if fieldVal.Index(0).Kind() == reflect.Array {
 			childFieldFormat := fieldFormat
-			// Overload child formatting
-			childFieldFormat.FormatString = "%s"
+			// Overload child formatting. The filter applies to the joined value
+			childFieldFormat.FormatString = ""
+			childFieldFormat.CompiledFilter = nil
 			for i := 0; i < fieldVal.Len(); i++ {
 				value, err = getFieldValue(fieldVal.Index(i), childFieldFormat)
 				if err != nil {
-					return "", fmt.Errorf("tracer.go: Error getting field values: %s\n", err)
+					return nil, fmt.Errorf("tracer.go: Error getting field values: %s\n", err)
 				}
-				if len(value.(string)) == 0 {
+				if value == nil {
 					break
 				}
 				if i != 0 {
@@ -69,22 +115,19 @@ func getFieldValue(fieldVal reflect.Value, fieldFormat config.BPFOutputFormat) (
 			value = subBuilder.String()
 		} else {
 
-			// Convert byte array to string
+			// Convert byte array to string. Strings filling the array have no
+			// terminating null
 			bytesVal := fieldVal.Slice(0, fieldVal.Len()).Bytes()
 			n := bytes.IndexByte(bytesVal, 0)
-			value = string(bytesVal[:Max(n, 0)])
+			if n < 0 {
+				n = len(bytesVal)
+			}
+			value = string(bytesVal[:n])
 		}
 
 		// Filter strings on length
 		if len(value.(string)) == 0 {
-			return "", nil
-		}
-
-		// Add escaped quotes to strings
-		value = value.(string)
-		if !fieldFormat.IsTag && fieldFormat.FormatString == "" {
-			value = escapeField(value.(string))
-			fieldFormat.FormatString = "%q"
+			return nil, nil
 		}
 	} else if fieldFormat.IsIP {
 		ip := make(net.IP, 4)
@@ -92,25 +135,67 @@ func getFieldValue(fieldVal reflect.Value, fieldFormat config.BPFOutputFormat) (
 		value = ip
 	} else {
 		// Otherwise, save value as a value
-		value = fieldVal
+		value = fieldVal.Interface()
 	}
-	// Filter values
+	// Filter the raw value, before any formatting
 	value, err = filterValues(value, fieldFormat)
 	if err != nil {
-		return "", fmt.Errorf("tracer.go: Error filtering values: %s\n", err)
+		return nil, fmt.Errorf("tracer.go: Error filtering values: %s\n", err)
 	}
 	if value == nil {
-		return "", nil
+		return nil, nil
 	}
 
-	// Format value as string
-	if fieldFormat.FormatString == "" {
-		fieldFormat.FormatString = "%v"
+	if name, ok := enumName(fieldFormat, value); ok {
+		return name, nil
 	}
-	stringValue := fmt.Sprintf(fieldFormat.FormatString, value)
-	sb.WriteString(stringValue)
+	if fieldFormat.FormatString != "" {
+		return fmt.Sprintf(fieldFormat.FormatString, value), nil
+	}
+	if ip, ok := value.(net.IP); ok {
+		return ip.String(), nil
+	}
+	return typedValue(value), nil
+}
 
-	return sb.String(), nil
+// Look up the name the field's enum gives a value
+func enumName(fieldFormat config.BPFOutputFormat, value interface{}) (string,
+	bool) {
+
+	if len(fieldFormat.Enum) == 0 {
+		return "", false
+	}
+	var key int64
+	switch v := typedValue(value).(type) {
+	case int64:
+		key = v
+	case uint64:
+		if v > math.MaxInt64 {
+			return "", false
+		}
+		key = int64(v)
+	default:
+		return "", false
+	}
+	name, ok := fieldFormat.Enum[key]
+	return name, ok
+}
+
+// Widen a decoded number to int64, uint64 or float64. Other values are
+// returned as they are
+func typedValue(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return value
 }
 
 func filterValues(value interface{},
@@ -129,64 +214,47 @@ func filterValues(value interface{},
 			value, outFormat.CompiledFilter, err)
 	}
 
-	// If there's a match, return nothing
-	if filterMatch {
+	// If the filter drops the record, return nothing
+	if config.FilterDrops(outFormat.FilterAction, filterMatch) {
 		return nil, nil
 	}
 
-	// Value doesn't match filter. Return
+	// Value passed the filter. Return
 	return value, nil
 }
 
-// Print key name, tags, and fields to influx format with timestamp
-func influxFormat(keyName string, tags map[string]string,
-	fields map[string]string) string {
-
-	var sb strings.Builder
-	// Create influx format string from key name, tags, and fields
-	sb.WriteString("bpf")
-
-	tags["sensor"] = keyName
-
-	nt, nf := len(tags), len(fields)
-
-	for k, v := range tags {
-		nt--
-		if nt >= 0 {
-			sb.WriteString(",")
-		}
-		sb.WriteString(formatValueField(k))
-		sb.WriteString("=")
-		sb.WriteString(formatValueField(fmt.Sprintf("%v", v)))
-	}
-	if nt == 0 {
-		sb.WriteString(" ")
+// Loop over each struct, formatting byte arrays to strings, filtering output,
+// marking as tag or measurement field. Returns false if a value was filtered
+// out and the record should be dropped. The record is stamped with the
+// output's timestamp field if it has one, falling back to the time the data
+// was received
+func DecodeOutput(record *Record, outputStruct reflect.Value,
+	outputFormat []config.BPFOutputFormat, receiveTime time.Time) (bool,
+	error) {
+
+	timestamp, keep, err := formatStructFields(outputStruct, record,
+		outputFormat)
+	if err != nil || !keep {
+		return false, err
 	}
 
-	for k, v := range fields {
-		nf--
-		if nf >= 0 && nf < (len(fields)-1) {
-			sb.WriteString(",")
-		}
-		sb.WriteString(formatValueField(k))
-		sb.WriteString("=")
-		sb.WriteString(v)
+	if timestamp.IsZero() {
+		timestamp = receiveTime
 	}
-
-	sb.WriteString(fmt.Sprintf(" %d\n", time.Now().UnixNano()))
-
-	return sb.String()
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	record.Timestamp = timestamp
+	return true, nil
 }
 
-// Loop over each struct, formatting byte arrays to strings, filtering output,
-// marking as tag or measurement field. Return influx formatted measurement
-func FormatOutput(mapName string, outputStruct reflect.Value,
-	tags map[string]string, fields map[string]string,
-	outputFormat []config.BPFOutputFormat) (string, error) {
+// Iterate over values in struct. Format and filter data types and add them to
+// the record as tags or fields. Returns the kernel timestamp if the struct has
+// one, and false if a value was filtered out and the record should be dropped
+func formatStructFields(outputStruct reflect.Value, record *Record,
+	outputFormat []config.BPFOutputFormat) (time.Time, bool, error) {
 
-	var err error
-	// Iterate over values in struct. Format and filter data types and append to
-	// either tag or field maps
+	var timestamp time.Time
 	for i := 0; i < outputStruct.NumField(); i++ {
 		// Get data type and value of the field
 		fieldKind := outputStruct.Type().Field(i)
@@ -194,24 +262,34 @@ func FormatOutput(mapName string, outputStruct reflect.Value,
 		fieldName := strings.ToLower(fieldKind.Name)
 		fieldFormat := outputFormat[i]
 
-		stringValue, err := getFieldValue(fieldVal, fieldFormat)
+		// Skip padding
+		if fieldKind.Name == "_" {
+			continue
+		}
+
+		// Kernel timestamps become the record time rather than a field
+		if fieldFormat.Timestamp {
+			timestamp = KtimeToTime(fieldVal.Uint())
+			continue
+		}
+
+		value, err := getFieldValue(fieldVal, fieldFormat)
 		if err != nil {
-			return "", fmt.Errorf("tracer.go: Error getting field values: %s\n", err)
+			return timestamp, false, fmt.Errorf(
+				"tracer.go: Error getting field values: %s\n", err)
 		}
-		// Filter strings on length
-		if len(stringValue) == 0 {
-			return "", err
+		// Filtered out
+		if value == nil {
+			return timestamp, false, nil
 		}
 
 		// Add to appropriate map for tag or data field
 		if fieldFormat.IsTag || fieldFormat.IsIP {
-			tags[fieldName] = formatTag(stringValue)
+			record.Tags[fieldName] = fmt.Sprint(value)
 		} else {
-			fields[fieldName] = stringValue
+			record.Fields[fieldName] = value
 		}
-
 	}
 
-	// Format to influx
-	return influxFormat(mapName, tags, fields), err
+	return timestamp, true, nil
 }
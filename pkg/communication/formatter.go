@@ -0,0 +1,156 @@
+package communication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Encodes records for writing to a sink. Each call returns everything the
+// record is written as, ready to be written whole. Text encodings end every
+// line with a newline, and graphite and statsd write a line per value, which
+// may be none, leaving nothing to write. msgpack and protobuf records are
+// binary and have no newline
+type Formatter interface {
+	Format(record *Record) ([]byte, error)
+}
+
+// Name of this host, looked up once
+var hostName = sync.OnceValue(func() string {
+	name, _ := os.Hostname()
+	return name
+})
+
+// Get the formatter for an encoding from config.Encodings. Empty means influx
+func NewFormatter(encoding string) (Formatter, error) {
+	switch encoding {
+	case "", "influx":
+		return InfluxFormatter{}, nil
+	case "json":
+		return JSONFormatter{Host: hostName()}, nil
+	case "syslog":
+		facility, _ := config.SyslogFacility("")
+		return newSyslogFormatter(facility), nil
+	case "graphite":
+		return GraphiteFormatter{Host: hostName()}, nil
+	case "statsd":
+		return StatsDFormatter{Host: hostName()}, nil
+	case "msgpack":
+		return MsgpackFormatter{Host: hostName()}, nil
+	case "protobuf":
+		return ProtobufFormatter{Host: hostName()}, nil
+	}
+	return nil, fmt.Errorf("formatter.go: Unknown encoding %q", encoding)
+}
+
+// Writes records as influx line protocol
+type InfluxFormatter struct{}
+
+func (InfluxFormatter) Format(record *Record) ([]byte, error) {
+	line, err := EncodeInflux(record)
+	return []byte(line), err
+}
+
+// Writes records as JSON Lines, one object per record with its tags and fields
+// kept apart
+type JSONFormatter struct {
+	// Host the records were collected on
+	Host string
+}
+
+type jsonRecord struct {
+	Timestamp   string                 `json:"timestamp"`
+	Host        string                 `json:"host"`
+	Sensor      string                 `json:"sensor"`
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+func (f JSONFormatter) Format(record *Record) ([]byte, error) {
+	line := jsonRecord{
+		Timestamp:   record.Timestamp.UTC().Format(time.RFC3339Nano),
+		Host:        f.Host,
+		Sensor:      record.Sensor,
+		Measurement: record.Measurement,
+		Tags:        record.Tags,
+		Fields:      make(map[string]interface{}, len(record.Fields)),
+	}
+	// JSON has no NaN or infinity, leave them out like influx does
+	for key, value := range record.Fields {
+		if v, ok := value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			continue
+		}
+		line.Fields[key] = value
+	}
+	output, err := json.Marshal(line)
+	if err != nil {
+		return nil, fmt.Errorf("formatter.go: Error encoding record as JSON: %s",
+			err)
+	}
+	return append(output, '\n'), nil
+}
+
+// Renders records with an output's compiled template, one line per record
+type TemplateFormatter struct {
+	Output *config.BPFOutput
+}
+
+func (f TemplateFormatter) Format(record *Record) ([]byte, error) {
+	var buf bytes.Buffer
+	err := f.Output.CompiledTemplate.Execute(&buf, TemplateData(record,
+		f.Output))
+	if err != nil {
+		return nil, fmt.Errorf("formatter.go: Error rendering template for %s: %s",
+			f.Output.Id, err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Template data for a record: its fields and tags by name, over the output's
+// zero valued sample, with the record's host, sensor, measurement and
+// timestamp
+func TemplateData(record *Record,
+	output *config.BPFOutput) map[string]interface{} {
+
+	data := config.TemplateSample(output, nil)
+	tags := data["Tags"].(map[string]string)
+	fields := data["Fields"].(map[string]interface{})
+	for name, value := range record.Fields {
+		data[name] = value
+		fields[name] = value
+	}
+	for name, value := range record.Tags {
+		data[name] = value
+		tags[name] = value
+	}
+	data["Host"] = hostName()
+	data["Sensor"] = record.Sensor
+	data["Measurement"] = record.Measurement
+	data["Timestamp"] = record.Timestamp
+	return data
+}
+
+// Formatter for an output's own encoding, or nil if it has none
+func OutputFormatter(output *config.BPFOutput) (Formatter, error) {
+	switch output.Encoding {
+	case "":
+		return nil, nil
+	case "template":
+		if output.CompiledTemplate == nil {
+			return nil, fmt.Errorf("formatter.go: Output %s has no compiled template",
+				output.Id)
+		}
+		return TemplateFormatter{Output: output}, nil
+	}
+	return NewFormatter(output.Encoding)
+}
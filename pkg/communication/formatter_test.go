@@ -0,0 +1,288 @@
+package communication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Confirm every encoding the config accepts has a formatter. Templates belong
+// to an output, so they come from OutputFormatter
+func TestNewFormatter(t *testing.T) {
+	for _, encoding := range append(config.Encodings, "") {
+		output := &config.BPFOutput{Id: "events", Encoding: encoding,
+			CompiledTemplate: template.Must(template.New("events").Parse("{{.}}"))}
+		if _, err := OutputFormatter(output); err != nil {
+			t.Errorf("No output formatter for encoding %q: %v", encoding, err)
+		}
+		if encoding == "template" {
+			continue
+		}
+		if _, err := NewFormatter(encoding); err != nil {
+			t.Errorf("No formatter for encoding %q: %v", encoding, err)
+		}
+	}
+	if _, err := NewFormatter("xml"); err == nil {
+		t.Errorf("Unknown encoding did not throw error")
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	record := &Record{Sensor: "opensnoop", Measurement: "bpf",
+		Tags: map[string]string{"sensor": "opensnoop", "comm": "bash",
+			"saddr": "10.0.0.1"},
+		Fields: map[string]interface{}{"fname": `/tmp/"a"`, "ret": int64(-2),
+			"id": uint64(math.MaxUint64), "ratio": 0.5, "nan": math.NaN()},
+		Timestamp: time.Unix(1600000000, 123456789)}
+	output, err := JSONFormatter{Host: "node1"}.Format(record)
+	if err != nil {
+		t.Fatalf("Error formatting record: %v", err)
+	}
+	checkGolden(t, "json/record", string(output))
+
+	// Large unsigned values survive decoding
+	var decoded struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		t.Fatalf("Error decoding output: %v", err)
+	}
+	if id, _ := decoded.Fields["id"].(json.Number); id != "18446744073709551615" {
+		t.Errorf("Field id decoded as %s", decoded.Fields["id"])
+	}
+}
+
+// Confirm records go to every sink in its encoding, unless the output picks
+// its own
+func TestBytesToSocketSinks(t *testing.T) {
+	configStruct, err := config.ParseConfig(strings.NewReader(`
+programs:
+  - source: test.c
+    outputs:
+      - id: conns
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: state
+            type: u8
+            isTag: true
+            enum:
+              1: ESTABLISHED
+              7: CLOSE
+          - name: comm
+            type: char[8]
+`))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	output := &configStruct.Programs[0].Outputs[0]
+	dataType, err := BuildStructFromArray(output.Format)
+	if err != nil {
+		t.Fatalf("Error building struct: %v", err)
+	}
+	data := append([]byte{7}, []byte("curl\x00\x00\x00\x00")...)
+
+	var influxBuf, jsonBuf, journalBuf bytes.Buffer
+	journalSink := NewWriterSink(&journalBuf, JournalFormatter{})
+	journalSink.ownEncoding = true
+	sinks := []*Sink{NewWriterSink(&influxBuf, InfluxFormatter{}),
+		NewWriterSink(&jsonBuf, JSONFormatter{Host: "node1"}), journalSink}
+	send := func() {
+		errChan := make(chan error, 1)
+		bytesToSocket(context.Background(), config.SocketInput{
+			MeasurementName: "conns", DataType: dataType, DataBytes: data,
+			OutputConfig: output, ReceiveTime: time.Unix(1, 0)}, errChan,
+			config.GlobalOptions{}, sinks, nil)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Error sending record: %v", err)
+		default:
+		}
+	}
+
+	send()
+	expectedInflux := "bpf,sensor=conns,state=CLOSE comm=\"curl\" 1000000000\n"
+	if influxBuf.String() != expectedInflux {
+		t.Errorf("Influx sink got %q, expected %q", influxBuf.String(),
+			expectedInflux)
+	}
+	expectedJSON := `{"timestamp":"1970-01-01T00:00:01Z","host":"node1",` +
+		`"sensor":"conns","measurement":"bpf",` +
+		`"tags":{"sensor":"conns","state":"CLOSE"},"fields":{"comm":"curl"}}` + "\n"
+	if jsonBuf.String() != expectedJSON {
+		t.Errorf("JSON sink got %q, expected %q", jsonBuf.String(), expectedJSON)
+	}
+
+	// The output's encoding wins over the sinks', except those that encode
+	// their own
+	influxBuf.Reset()
+	jsonBuf.Reset()
+	journalBuf.Reset()
+	output.Encoding = "json"
+	send()
+	if !strings.HasPrefix(journalBuf.String(), "MESSAGE=conns ") {
+		t.Errorf("Journal sink got %q", journalBuf.String())
+	}
+	if !strings.HasPrefix(influxBuf.String(), "{") ||
+		influxBuf.String() != strings.Replace(jsonBuf.String(), "node1",
+			hostName(), 1) {
+		t.Errorf("Output encoding was not used on every sink: %q and %q",
+			influxBuf.String(), jsonBuf.String())
+	}
+}
+
+// Confirm outputs with a template render each record as a line, with values
+// the record leaves out rendered as zero
+func TestTemplateFormatter(t *testing.T) {
+	configStruct, err := config.ParseConfig(strings.NewReader(`
+programs:
+  - source: test.c
+    outputs:
+      - id: execs
+        type: BPF_PERF_OUTPUT
+        template: '{{.Sensor}}: {{upper .comm}} by uid {{.uid}} ran {{json .argv}}{{if .Tags.comm}} ({{logfmt .Fields.argv}}){{end}}'
+        format:
+          - {name: uid, type: u32}
+          - {name: comm, type: "char[8]", isTag: true}
+          - {name: argv, type: "char[16]"}
+`))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	output := &configStruct.Programs[0].Outputs[0]
+	dataType, err := BuildStructFromArray(output.Format)
+	if err != nil {
+		t.Fatalf("Error building struct: %v", err)
+	}
+
+	tables := []struct {
+		data     []byte
+		expected string
+	}{
+		{append([]byte{232, 3, 0, 0}, "bash\x00\x00\x00\x00ls -l /tmp\x00\x00\x00\x00\x00\x00"...),
+			"execs: BASH by uid 1000 ran \"ls -l /tmp\" (\"ls -l /tmp\")\n"},
+		{append([]byte{0, 0, 0, 0}, "sh\x00\x00\x00\x00\x00\x00true\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...),
+			"execs: SH by uid 0 ran \"true\" (true)\n"},
+	}
+	for _, tbl := range tables {
+		var buf bytes.Buffer
+		errChan := make(chan error, 1)
+		bytesToSocket(context.Background(), config.SocketInput{
+			MeasurementName: "execs", DataType: dataType, DataBytes: tbl.data,
+			OutputConfig: output, ReceiveTime: time.Unix(1, 0)}, errChan,
+			config.GlobalOptions{}, influxSinks(&buf), nil)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Error sending record: %v", err)
+		default:
+		}
+		if buf.String() != tbl.expected {
+			t.Errorf("Template rendered %q, expected %q", buf.String(), tbl.expected)
+		}
+	}
+
+	// Values the record doesn't have render as zero
+	record := NewRecord("execs")
+	rendered, err := TemplateFormatter{Output: output}.Format(record)
+	if err != nil {
+		t.Fatalf("Error rendering record without values: %v", err)
+	}
+	if expected := "execs:  by uid 0 ran \"\"\n"; string(rendered) != expected {
+		t.Errorf("Template rendered %q, expected %q", rendered, expected)
+	}
+}
+
+// Confirm network sinks deliver records
+func TestOpenSink(t *testing.T) {
+	globals := config.GlobalOptions{MaxRetryCount: 1}
+	record := []byte("bpf,sensor=test count=1u 1\n")
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on tcp: %v", err)
+	}
+	defer tcpListener.Close()
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on udp: %v", err)
+	}
+	defer udpConn.Close()
+	socketPath := filepath.Join(t.TempDir(), "greggd.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error listening on unix socket: %v", err)
+	}
+	defer unixListener.Close()
+
+	// Read one line from the first connection to a listener
+	readLine := func(listener net.Listener) chan string {
+		lines := make(chan string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				lines <- err.Error()
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+		}()
+		return lines
+	}
+	tcpLines, unixLines := readLine(tcpListener), readLine(unixListener)
+	udpLines := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _, _ := udpConn.ReadFrom(buf)
+		udpLines <- string(buf[:n])
+	}()
+
+	tables := []struct {
+		sink  config.SinkConfig
+		lines chan string
+	}{
+		{config.SinkConfig{Type: "tcp", Address: tcpListener.Addr().String()},
+			tcpLines},
+		{config.SinkConfig{Type: "udp", Address: udpConn.LocalAddr().String()},
+			udpLines},
+		{config.SinkConfig{Type: "unix", Address: socketPath}, unixLines},
+	}
+	for _, tbl := range tables {
+		sink, err := OpenSink(tbl.sink, globals)
+		if err != nil {
+			t.Errorf("Error opening %s sink: %v", tbl.sink.Type, err)
+			continue
+		}
+		if err := sink.Write(record); err != nil {
+			t.Errorf("Error writing to %s sink: %v", tbl.sink.Type, err)
+		}
+		select {
+		case line := <-tbl.lines:
+			if line != string(record) {
+				t.Errorf("%s sink delivered %q, expected %q", tbl.sink.Type, line,
+					record)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s sink delivered nothing", tbl.sink.Type)
+		}
+		sink.Close()
+	}
+
+	_, err = OpenSink(config.SinkConfig{Type: "unix",
+		Address: filepath.Join(os.TempDir(), "greggd-missing.sock")}, globals)
+	if err == nil {
+		t.Errorf("Opening a missing socket did not throw error")
+	}
+}
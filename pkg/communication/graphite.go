@@ -0,0 +1,187 @@
+package communication
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Writes each numeric field of a record as a graphite plaintext line,
+// `path value timestamp`, named by Template
+type GraphiteFormatter struct {
+	Host     string
+	Template string
+}
+
+// Writes each numeric field of a record as a statsd line, `name:value|type`,
+// named by Template. Counter and histogram outputs cleared on poll send counts
+// (c), other hash and histogram outputs gauges (g) and perf outputs timers (ms)
+type StatsDFormatter struct {
+	Host     string
+	Template string
+}
+
+func (f GraphiteFormatter) Format(record *Record) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, field := range valueFields(record) {
+		value, ok := metricNumber(record.Fields[field])
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %s %d\n",
+			expandMetricTemplate(f.Template, f.Host, record, field), value,
+			record.Timestamp.Unix())
+	}
+	return buf.Bytes(), nil
+}
+
+func (f StatsDFormatter) Format(record *Record) ([]byte, error) {
+	// Maps that aren't cleared hold running totals, which statsd would add up
+	// again on every poll
+	statType := "ms"
+	switch record.MetricType {
+	case "counter", "histogram":
+		statType = "g"
+		if record.Cleared {
+			statType = "c"
+		}
+	case "gauge", "none":
+		statType = "g"
+	}
+	var buf bytes.Buffer
+	for _, field := range valueFields(record) {
+		value, ok := metricNumber(record.Fields[field])
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:%s|%s\n",
+			expandMetricTemplate(f.Template, f.Host, record, field), value,
+			statType)
+	}
+	return buf.Bytes(), nil
+}
+
+// Fields of a record written as values, sorted by name. Key fields name the
+// path instead
+func valueFields(record *Record) []string {
+	var fields []string
+	for _, field := range sortedKeys(record.Fields) {
+		if !isKeyField(record, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func isKeyField(record *Record, field string) bool {
+	for _, key := range record.KeyFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Numeric record value as text. Strings, NaN and infinities aren't numbers
+func metricNumber(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+// Characters left out of metric path components
+var invalidMetricPathChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// Expand a metric template for one field of a record. Placeholders name the
+// host, sensor, measurement, field or any tag, key field or string field.
+// Their values are one path component each. {tags} expands to a name and a
+// value component for every tag and key field the template doesn't name.
+// Components left empty are dropped
+func expandMetricTemplate(template string, host string, record *Record,
+	field string) string {
+
+	if template == "" {
+		template = config.DefaultMetricTemplate
+	}
+	placeholders := config.MetricTemplatePlaceholder
+	named := make(map[string]bool)
+	for _, match := range placeholders.FindAllStringSubmatch(template, -1) {
+		named[match[1]] = true
+	}
+	path := placeholders.ReplaceAllStringFunc(template,
+		func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			switch name {
+			case "host":
+				return metricPathComponent(host)
+			case "sensor":
+				return metricPathComponent(record.Sensor)
+			case "measurement":
+				return metricPathComponent(record.Measurement)
+			case "field":
+				return metricPathComponent(field)
+			case "tags":
+				return remainingMetricTags(record, named)
+			}
+			if tag, ok := record.Tags[name]; ok {
+				return metricPathComponent(tag)
+			} else if isKeyField(record, name) {
+				return metricPathComponent(fmt.Sprint(record.Fields[name]))
+			} else if s, ok := record.Fields[name].(string); ok {
+				return metricPathComponent(s)
+			}
+			return ""
+		})
+	components := strings.Split(path, ".")
+	kept := components[:0]
+	for _, component := range components {
+		if component != "" {
+			kept = append(kept, component)
+		}
+	}
+	return strings.Join(kept, ".")
+}
+
+// Tags and key fields of a record not named in the template, as name and
+// value components sorted by name
+func remainingMetricTags(record *Record, named map[string]bool) string {
+	values := make(map[string]string)
+	for name, value := range record.Tags {
+		values[name] = value
+	}
+	for _, name := range record.KeyFields {
+		values[name] = fmt.Sprint(record.Fields[name])
+	}
+	var components []string
+	for _, name := range sortedKeys(values) {
+		if named[name] {
+			continue
+		}
+		components = append(components, metricPathComponent(name),
+			metricPathComponent(values[name]))
+	}
+	return strings.Join(components, ".")
+}
+
+func metricPathComponent(value string) string {
+	return invalidMetricPathChars.ReplaceAllString(value, "_")
+}
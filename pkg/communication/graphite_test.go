@@ -0,0 +1,107 @@
+package communication
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func graphiteRecord(metricType string) *Record {
+	return &Record{Sensor: "biolatency", Measurement: "bpf",
+		Tags: map[string]string{"sensor": "biolatency", "disk": "sda"},
+		Fields: map[string]interface{}{"count": uint64(5), "ret": int64(-2),
+			"ratio": 0.25, "nan": math.NaN(), "comm": "bash"},
+		Timestamp: time.Unix(1600000000, 123456789), MetricType: metricType}
+}
+
+// Confirm each numeric field becomes one line, named by the template
+func TestGraphiteFormatter(t *testing.T) {
+	output, err := GraphiteFormatter{Host: "node1.example.com",
+		Template: "greggd.{host}.{sensor}.{disk}.{field}"}.Format(
+		graphiteRecord(""))
+	if err != nil {
+		t.Fatalf("Error formatting record: %v", err)
+	}
+	expected := "greggd.node1_example_com.biolatency.sda.count 5 1600000000\n" +
+		"greggd.node1_example_com.biolatency.sda.ratio 0.25 1600000000\n" +
+		"greggd.node1_example_com.biolatency.sda.ret -2 1600000000\n"
+	if string(output) != expected {
+		t.Errorf("Got graphite lines:\n%s\nexpected:\n%s", output, expected)
+	}
+}
+
+// Confirm histogram buckets and other key fields name the path
+func TestGraphiteFormatterKeyFields(t *testing.T) {
+	record := &Record{Sensor: "nfsdist", Measurement: "bpf",
+		Tags:      map[string]string{"sensor": "nfsdist"},
+		Fields:    map[string]interface{}{"slot": uint64(3), "count": uint64(5)},
+		Timestamp: time.Unix(1600000000, 0), MetricType: "histogram",
+		KeyFields: []string{"slot"}}
+	output, err := GraphiteFormatter{Host: "node1"}.Format(record)
+	if err != nil {
+		t.Fatalf("Error formatting record: %v", err)
+	}
+	expected := "greggd.node1.nfsdist.slot.3.count 5 1600000000\n"
+	if string(output) != expected {
+		t.Errorf("Got graphite lines:\n%s\nexpected:\n%s", output, expected)
+	}
+}
+
+// Confirm the statsd type follows the output's metric type, and running
+// totals of outputs that aren't cleared are sent as gauges
+func TestStatsDFormatter(t *testing.T) {
+	tables := []struct {
+		metricType string
+		cleared    bool
+		statType   string
+	}{
+		{"", false, "ms"},
+		{"gauge", true, "g"},
+		{"counter", true, "c"},
+		{"histogram", true, "c"},
+		{"counter", false, "g"},
+		{"histogram", false, "g"},
+	}
+	for _, tbl := range tables {
+		record := graphiteRecord(tbl.metricType)
+		record.Cleared = tbl.cleared
+		output, err := StatsDFormatter{Host: "node1"}.Format(record)
+		if err != nil {
+			t.Fatalf("Error formatting record: %v", err)
+		}
+		expected := "greggd.node1.biolatency.disk.sda.count:5|" + tbl.statType +
+			"\ngreggd.node1.biolatency.disk.sda.ratio:0.25|" + tbl.statType +
+			"\ngreggd.node1.biolatency.disk.sda.ret:-2|" + tbl.statType + "\n"
+		if string(output) != expected {
+			t.Errorf("Metric type %q, cleared %v gave statsd lines:\n%s\nexpected:\n%s",
+				tbl.metricType, tbl.cleared, output, expected)
+		}
+	}
+}
+
+func TestExpandMetricTemplate(t *testing.T) {
+	record := graphiteRecord("")
+	record.Tags["fname"] = "/etc/pass wd"
+	tables := []struct {
+		template string
+		expected string
+	}{
+		// The default keeps the remaining tags, sorted by name
+		{"", "greggd.node1.biolatency.disk.sda.fname._etc_pass_wd.count"},
+		{"greggd.{host}.{sensor}.{fname}.{tags}.{field}",
+			"greggd.node1.biolatency._etc_pass_wd.disk.sda.count"},
+		{"{measurement}.{sensor}.{field}", "bpf.biolatency.count"},
+		// Tags and string fields are path components
+		{"greggd.{disk}.{comm}.{field}", "greggd.sda.bash.count"},
+		{"greggd.{fname}.{field}", "greggd._etc_pass_wd.count"},
+		// Missing values drop their component
+		{"greggd.{missing}.{field}", "greggd.count"},
+	}
+	for _, tbl := range tables {
+		path := expandMetricTemplate(tbl.template, "node1", record, "count")
+		if path != tbl.expected {
+			t.Errorf("Template %q expanded to %s, expected %s", tbl.template, path,
+				tbl.expected)
+		}
+	}
+}
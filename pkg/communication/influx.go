@@ -0,0 +1,89 @@
+package communication
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Escapes for each part of an influx line. Newlines would end the line, so
+// they are written as \n everywhere
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `,
+		"\n", `\n`)
+	stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Encode a record as a line of influx line protocol. Tags and fields are
+// sorted by key, integers carry their i or u suffix, strings are quoted and
+// tags with empty values are left out. Records need at least one field
+func EncodeInflux(record *Record) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(measurementEscaper.Replace(record.Measurement))
+
+	for _, key := range sortedKeys(record.Tags) {
+		if key == "" || record.Tags[key] == "" {
+			continue
+		}
+		sb.WriteString(",")
+		sb.WriteString(keyEscaper.Replace(key))
+		sb.WriteString("=")
+		sb.WriteString(keyEscaper.Replace(record.Tags[key]))
+	}
+
+	separator := " "
+	for _, key := range sortedKeys(record.Fields) {
+		value, ok := influxFieldValue(record.Fields[key])
+		if !ok || key == "" {
+			continue
+		}
+		sb.WriteString(separator)
+		sb.WriteString(keyEscaper.Replace(key))
+		sb.WriteString("=")
+		sb.WriteString(value)
+		separator = ","
+	}
+	if separator == " " {
+		return "", fmt.Errorf("influx.go: Record for %s has no fields to write",
+			record.Measurement)
+	}
+
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatInt(record.Timestamp.UnixNano(), 10))
+	sb.WriteString("\n")
+	return sb.String(), nil
+}
+
+// Write a field value in line protocol. Returns false for values influx can't
+// store, like NaN
+func influxFieldValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u", true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// Keys of a tag or field map in byte order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,130 @@
+package communication
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+var updateGolden = flag.Bool("update", false,
+	"Rewrite golden files under test/data with the current output")
+
+// Compare output against a golden file under test/data, rewriting it when
+// -update is set
+func checkGolden(t *testing.T, name string, actual string) {
+	t.Helper()
+	path := filepath.Join("..", "..", "test", "data", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatalf("Error writing golden file %s: %v", path, err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading golden file %s: %v", path, err)
+	}
+	if actual != string(expected) {
+		t.Errorf("Output for %s does not match golden file:\n%s\nexpected:\n%s",
+			name, actual, expected)
+	}
+}
+
+// Decode a struct into record and encode it as influx
+func formatInflux(record *Record, outputStruct reflect.Value,
+	outputFormat []config.BPFOutputFormat, receiveTime time.Time) (string,
+	error) {
+
+	keep, err := DecodeOutput(record, outputStruct, outputFormat, receiveTime)
+	if err != nil || !keep {
+		return "", err
+	}
+	return EncodeInflux(record)
+}
+
+func TestEncodeInflux(t *testing.T) {
+	timestamp := time.Unix(1600000000, 123456789)
+	tables := []struct {
+		name   string
+		record Record
+	}{
+		{"types", Record{Measurement: "bpf",
+			Tags: map[string]string{"sensor": "opensnoop", "pid": "42",
+				"comm": "bash"},
+			Fields: map[string]interface{}{"ret": int64(-2),
+				"id": uint64(math.MaxUint64), "ratio": 0.25, "big": 1e21,
+				"ok": true, "fname": "/proc/self/stat"},
+			Timestamp: timestamp}},
+		{"escaping", Record{Measurement: "my bpf,events",
+			Tags: map[string]string{"tag key": "a,b=c d", "line": "a\nb"},
+			Fields: map[string]interface{}{"field=key": `say "hi" C:\tmp`,
+				"multi line": "a\nb"},
+			Timestamp: timestamp}},
+		{"no_tags", Record{Measurement: "bpf", Tags: map[string]string{},
+			Fields: map[string]interface{}{"count": uint64(5)}, Timestamp: timestamp}},
+		{"skipped", Record{Measurement: "bpf",
+			Tags: map[string]string{"sensor": "dist", "disk": ""},
+			Fields: map[string]interface{}{"nan": math.NaN(),
+				"inf": math.Inf(1), "count": uint64(1)},
+			Timestamp: timestamp}},
+	}
+	for _, tbl := range tables {
+		actual, err := EncodeInflux(&tbl.record)
+		if err != nil {
+			t.Errorf("Error encoding %s: %v", tbl.name, err)
+			continue
+		}
+		checkGolden(t, "influx/"+tbl.name, actual)
+	}
+
+	// Lines need a field
+	record := Record{Measurement: "bpf", Tags: map[string]string{"a": "b"},
+		Fields: map[string]interface{}{"nan": math.NaN()}}
+	if _, err := EncodeInflux(&record); err == nil {
+		t.Errorf("Record without fields did not throw error")
+	}
+}
+
+// Confirm decoded structs come out as typed, sorted line protocol
+func TestDecodeOutputInflux(t *testing.T) {
+	format := []config.BPFOutputFormat{
+		{Name: "pid", Type: "u32", IsTag: true},
+		{Name: "saddr", Type: "u32", IsIP: true},
+		{Name: "ret", Type: "int32"},
+		{Name: "flags", Type: "int32", FormatString: "%#o"},
+		{Name: "comm", Type: "char[16]"},
+		{Name: "argv", Type: "char[3][8]"},
+		{Name: "span_us", Type: "u64"},
+	}
+	dataType, err := BuildStructFromArray(format)
+	if err != nil {
+		t.Fatalf("Error building struct: %v", err)
+	}
+	data := reflect.New(dataType).Elem()
+	data.Field(0).SetUint(42)
+	data.Field(1).SetUint(0x0100007f)
+	data.Field(2).SetInt(-13)
+	data.Field(3).SetInt(0100)
+	reflect.Copy(data.Field(4), reflect.ValueOf([]byte(`cat "x"`)))
+	reflect.Copy(data.Field(5).Index(0), reflect.ValueOf([]byte("cat")))
+	// Fills its array, so has no terminating null
+	reflect.Copy(data.Field(5).Index(1), reflect.ValueOf([]byte("/etc/hos")))
+	data.Field(6).SetUint(1500)
+
+	output, err := formatInflux(NewRecord("events"), data, format,
+		time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatalf("Error formatting output: %v", err)
+	}
+	checkGolden(t, "influx/format_output", output)
+
+	if strings.Count(output, "\n") != 1 {
+		t.Errorf("Expected a single line, got %q", output)
+	}
+}
@@ -0,0 +1,154 @@
+package communication
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Writes records as MessagePack maps with the same keys as JSON Lines. The
+// timestamp uses the MessagePack timestamp extension and values keep their
+// integer, float, bool or string type
+type MsgpackFormatter struct {
+	// Host the records were collected on
+	Host string
+}
+
+func (f MsgpackFormatter) Format(record *Record) ([]byte, error) {
+	var m msgpackBuffer
+	m.mapHeader(6)
+	m.str("timestamp")
+	m.timestamp(record.Timestamp.Unix(), uint32(record.Timestamp.Nanosecond()))
+	m.str("host")
+	m.str(f.Host)
+	m.str("sensor")
+	m.str(record.Sensor)
+	m.str("measurement")
+	m.str(record.Measurement)
+	m.str("tags")
+	m.mapHeader(len(record.Tags))
+	for _, name := range sortedKeys(record.Tags) {
+		m.str(name)
+		m.str(record.Tags[name])
+	}
+	m.str("fields")
+	m.mapHeader(len(record.Fields))
+	for _, name := range sortedKeys(record.Fields) {
+		m.str(name)
+		switch v := record.Fields[name].(type) {
+		case string:
+			m.str(v)
+		case bool:
+			m.bool(v)
+		case int64:
+			m.int(v)
+		case uint64:
+			m.uint(v)
+		case float64:
+			m.float(v)
+		default:
+			return nil, fmt.Errorf("msgpack.go: Can't encode field %s of type %T",
+				name, v)
+		}
+	}
+	return m.buf, nil
+}
+
+// Minimal MessagePack encoder. Values use their shortest encoding
+type msgpackBuffer struct {
+	buf []byte
+}
+
+func (m *msgpackBuffer) mapHeader(n int) {
+	switch {
+	case n < 16:
+		m.buf = append(m.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, 0xde)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	default:
+		m.buf = append(m.buf, 0xdf)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	}
+}
+
+func (m *msgpackBuffer) str(s string) {
+	switch n := len(s); {
+	case n < 32:
+		m.buf = append(m.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, 0xda)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	default:
+		m.buf = append(m.buf, 0xdb)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackBuffer) bool(v bool) {
+	if v {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+func (m *msgpackBuffer) uint(v uint64) {
+	switch {
+	case v < 128:
+		m.buf = append(m.buf, byte(v))
+	case v <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		m.buf = append(m.buf, 0xcd)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(v))
+	case v <= math.MaxUint32:
+		m.buf = append(m.buf, 0xce)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(v))
+	default:
+		m.buf = append(m.buf, 0xcf)
+		m.buf = binary.BigEndian.AppendUint64(m.buf, v)
+	}
+}
+
+func (m *msgpackBuffer) int(v int64) {
+	switch {
+	case v >= 0:
+		m.uint(uint64(v))
+	case v >= -32:
+		m.buf = append(m.buf, byte(v))
+	case v >= math.MinInt8:
+		m.buf = append(m.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		m.buf = append(m.buf, 0xd1)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(v))
+	case v >= math.MinInt32:
+		m.buf = append(m.buf, 0xd2)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(v))
+	default:
+		m.buf = append(m.buf, 0xd3)
+		m.buf = binary.BigEndian.AppendUint64(m.buf, uint64(v))
+	}
+}
+
+func (m *msgpackBuffer) float(v float64) {
+	m.buf = append(m.buf, 0xcb)
+	m.buf = binary.BigEndian.AppendUint64(m.buf, math.Float64bits(v))
+}
+
+// Timestamp extension (type -1), in its 64 bit form when the seconds fit in
+// 34 bits and the 96 bit form otherwise
+func (m *msgpackBuffer) timestamp(sec int64, nsec uint32) {
+	if sec >= 0 && sec < 1<<34 {
+		m.buf = append(m.buf, 0xd7, 0xff)
+		m.buf = binary.BigEndian.AppendUint64(m.buf,
+			uint64(nsec)<<34|uint64(sec))
+		return
+	}
+	m.buf = append(m.buf, 0xc7, 12, 0xff)
+	m.buf = binary.BigEndian.AppendUint32(m.buf, nsec)
+	m.buf = binary.BigEndian.AppendUint64(m.buf, uint64(sec))
+}
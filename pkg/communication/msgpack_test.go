@@ -0,0 +1,130 @@
+package communication
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Decode one MessagePack value from the start of data, returning the rest.
+// Handles what MsgpackFormatter writes
+func decodeMsgpack(t *testing.T, data []byte) (interface{}, []byte) {
+	t.Helper()
+	if len(data) == 0 {
+		t.Fatalf("MessagePack value is empty")
+	}
+	b := data[0]
+	data = data[1:]
+	// Lengths of maps and strings, and the bytes after them
+	length := func(size int) (int, []byte) {
+		switch size {
+		case 1:
+			return int(data[0]), data[1:]
+		case 2:
+			return int(binary.BigEndian.Uint16(data)), data[2:]
+		}
+		return int(binary.BigEndian.Uint32(data)), data[4:]
+	}
+	decodeMap := func(n int, rest []byte) (interface{}, []byte) {
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			var key, value interface{}
+			key, rest = decodeMsgpack(t, rest)
+			value, rest = decodeMsgpack(t, rest)
+			m[key.(string)] = value
+		}
+		return m, rest
+	}
+	switch {
+	case b < 0x80:
+		return uint64(b), data
+	case b >= 0xe0:
+		return int64(int8(b)), data
+	case b&0xf0 == 0x80:
+		return decodeMap(int(b&0x0f), data)
+	case b&0xe0 == 0xa0:
+		n := int(b & 0x1f)
+		return string(data[:n]), data[n:]
+	}
+	switch b {
+	case 0xc2, 0xc3:
+		return b == 0xc3, data
+	case 0xcc:
+		return uint64(data[0]), data[1:]
+	case 0xcd:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case 0xce:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case 0xcf:
+		return binary.BigEndian.Uint64(data), data[8:]
+	case 0xd0:
+		return int64(int8(data[0])), data[1:]
+	case 0xd1:
+		return int64(int16(binary.BigEndian.Uint16(data))), data[2:]
+	case 0xd2:
+		return int64(int32(binary.BigEndian.Uint32(data))), data[4:]
+	case 0xd3:
+		return int64(binary.BigEndian.Uint64(data)), data[8:]
+	case 0xcb:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:]
+	case 0xd9, 0xda, 0xdb:
+		n, rest := length(1 << (b - 0xd9))
+		return string(rest[:n]), rest[n:]
+	case 0xde, 0xdf:
+		return decodeMap(length(2 << (b - 0xde)))
+	case 0xd7:
+		v := binary.BigEndian.Uint64(data[1:])
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), data[9:]
+	case 0xc7:
+		return time.Unix(int64(binary.BigEndian.Uint64(data[6:])),
+			int64(binary.BigEndian.Uint32(data[2:]))), data[14:]
+	}
+	t.Fatalf("Unexpected MessagePack type %#x", b)
+	return nil, nil
+}
+
+// Confirm records decode to the same envelope as JSON Lines with their types
+// kept
+func TestMsgpackFormatter(t *testing.T) {
+	long := string(make([]byte, 300))
+	for _, timestamp := range []time.Time{time.Unix(1600000000, 123456789),
+		time.Unix(1<<35, 7)} {
+		record := &Record{Sensor: "opensnoop", Measurement: "bpf",
+			Tags: map[string]string{"sensor": "opensnoop", "comm": "bash"},
+			Fields: map[string]interface{}{"fname": "/etc/passwd", "long": long,
+				"ret": int64(-2), "big": int64(math.MinInt64), "small": uint64(3),
+				"id": uint64(math.MaxUint64), "ratio": 0.5, "ok": true},
+			Timestamp: timestamp}
+		output, err := MsgpackFormatter{Host: "node1"}.Format(record)
+		if err != nil {
+			t.Fatalf("Error formatting record: %v", err)
+		}
+		decoded, rest := decodeMsgpack(t, output)
+		if len(rest) != 0 {
+			t.Errorf("%d bytes left after record", len(rest))
+		}
+		expected := map[string]interface{}{"timestamp": timestamp,
+			"host": "node1", "sensor": "opensnoop", "measurement": "bpf",
+			"tags": map[string]interface{}{"sensor": "opensnoop", "comm": "bash"},
+			"fields": map[string]interface{}{"fname": "/etc/passwd", "long": long,
+				"ret": int64(-2), "big": int64(math.MinInt64), "small": uint64(3),
+				"id": uint64(math.MaxUint64), "ratio": 0.5, "ok": true}}
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Errorf("Record decoded as %v, expected %v", decoded, expected)
+		}
+	}
+
+	// Smaller than the same record as JSON
+	record := &Record{Sensor: "opensnoop", Measurement: "bpf",
+		Tags:      map[string]string{"sensor": "opensnoop", "comm": "bash"},
+		Fields:    map[string]interface{}{"pid": int64(4242), "ret": int64(3)},
+		Timestamp: time.Unix(1600000000, 123456789)}
+	packed, _ := MsgpackFormatter{Host: "node1"}.Format(record)
+	line, _ := JSONFormatter{Host: "node1"}.Format(record)
+	if len(packed) >= len(line) {
+		t.Errorf("Record is %d bytes as MessagePack and %d as JSON", len(packed),
+			len(line))
+	}
+}
@@ -0,0 +1,439 @@
+package communication
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Collector paths for each OTLP transport
+const (
+	otlpLogsGRPCPath    = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	otlpMetricsGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpLogsHTTPPath    = "/v1/logs"
+	otlpMetricsHTTPPath = "/v1/metrics"
+)
+
+// OTLP enum values greggd sends
+const (
+	otlpSeverityInfo          = 9
+	otlpTemporalityCumulative = 2
+)
+
+// Exports records to an OpenTelemetry collector. Records of outputs that
+// export metrics are aggregated like Prometheus metrics and exported every
+// metric interval. Other records are batched and exported as log records
+type OTLPExporter struct {
+	config  config.SinkConfig
+	globals config.GlobalOptions
+	client  *http.Client
+	// Collector URL without the path
+	endpoint string
+	// Attributes describing where records come from, from the host and static
+	// tags globals set
+	resource map[string]string
+	// Tags the resource carries, left out of each record's attributes
+	resourceTags map[string]bool
+	metrics      *MetricStore
+
+	mu sync.Mutex
+	// Log records waiting to be exported
+	logs []*Record
+	// Error from the last background export, returned by the next Export
+	err       error
+	batchSize int
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Start an exporter sending log batches every flushInterval, or when
+// batchSize records are waiting, and metrics every metricInterval
+func NewOTLPExporter(sinkConfig config.SinkConfig, globals config.GlobalOptions,
+	flushInterval time.Duration, metricInterval time.Duration,
+	batchSize int) *OTLPExporter {
+
+	e := &OTLPExporter{config: sinkConfig, globals: globals,
+		endpoint: otlpEndpoint(sinkConfig.Address),
+		resource: map[string]string{"service.name": "greggd"},
+		metrics:  NewMetricStore(), batchSize: batchSize,
+		done: make(chan struct{})}
+	e.resourceTags = make(map[string]bool)
+	for _, name := range globals.HostTags {
+		e.resourceTags[name] = true
+		if value := hostMetadata()[name]; value != "" {
+			e.resource[otlpResourceKey(name)] = value
+		}
+	}
+	for name, value := range globals.Tags {
+		e.resourceTags[name] = true
+		if value != "" {
+			e.resource[name] = value
+		}
+	}
+	if sinkConfig.Protocol == "http" {
+		e.client = &http.Client{Timeout: 10 * time.Second}
+	} else {
+		// gRPC without TLS, for collectors on the node
+		e.client = &http.Client{Timeout: 10 * time.Second,
+			Transport: &http2.Transport{AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string,
+					_ *tls.Config) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, addr)
+				}}}
+	}
+	e.wg.Add(1)
+	go e.run(flushInterval, metricInterval)
+	return e
+}
+
+// Resource attribute for a host tag. The host is named as OpenTelemetry
+// names it
+func otlpResourceKey(tag string) string {
+	if tag == "host" {
+		return "host.name"
+	}
+	return tag
+}
+
+// Collector URL for an address, which may already be a URL
+func otlpEndpoint(address string) string {
+	if strings.Contains(address, "://") {
+		return strings.TrimSuffix(address, "/")
+	}
+	return "http://" + address
+}
+
+// Queue a record for export. Returns the error of the last failed background
+// export, if any
+func (e *OTLPExporter) Export(record *Record, output *config.BPFOutput,
+	pollTime time.Time) error {
+
+	if config.ExportsMetrics(output) {
+		return e.metrics.Observe(record, output, pollTime)
+	}
+
+	e.mu.Lock()
+	err := e.err
+	e.err = nil
+	e.logs = append(e.logs, record)
+	var batch []*Record
+	if len(e.logs) >= e.batchSize {
+		batch = e.logs
+		e.logs = nil
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return e.sendLogs(batch)
+}
+
+// Stop exporting in the background and export what is left
+func (e *OTLPExporter) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	err := e.flushLogs()
+	if metricErr := e.sendMetrics(); err == nil {
+		err = metricErr
+	}
+	return err
+}
+
+func (e *OTLPExporter) run(flushInterval time.Duration,
+	metricInterval time.Duration) {
+
+	defer e.wg.Done()
+	flushTicker := time.NewTicker(flushInterval)
+	defer flushTicker.Stop()
+	metricTicker := time.NewTicker(metricInterval)
+	defer metricTicker.Stop()
+	for {
+		var err error
+		select {
+		case <-e.done:
+			return
+		case <-flushTicker.C:
+			err = e.flushLogs()
+		case <-metricTicker.C:
+			err = e.sendMetrics()
+		}
+		if err != nil {
+			e.mu.Lock()
+			e.err = err
+			e.mu.Unlock()
+		}
+	}
+}
+
+// Export every waiting log record
+func (e *OTLPExporter) flushLogs() error {
+	e.mu.Lock()
+	batch := e.logs
+	e.logs = nil
+	e.mu.Unlock()
+	return e.sendLogs(batch)
+}
+
+func (e *OTLPExporter) sendLogs(batch []*Record) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return e.send(otlpLogsGRPCPath, otlpLogsHTTPPath, e.encodeLogs(batch))
+}
+
+func (e *OTLPExporter) sendMetrics() error {
+	metrics := e.metrics.snapshot()
+	if len(metrics) == 0 {
+		return nil
+	}
+	return e.send(otlpMetricsGRPCPath, otlpMetricsHTTPPath,
+		e.encodeMetrics(metrics))
+}
+
+// Send an encoded export request, retrying on failures
+func (e *OTLPExporter) send(grpcPath string, httpPath string,
+	message []byte) error {
+
+	err := retry(0, e.globals.CompiledRetryDelay, e.globals, func() error {
+		if e.config.Protocol == "http" {
+			return e.post(httpPath, "application/x-protobuf", message)
+		}
+		// gRPC messages are framed with a compression flag and their length
+		frame := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		return e.post(grpcPath, "application/grpc", append(frame, message...))
+	})
+	if err != nil {
+		return fmt.Errorf("otlp.go: Error exporting to %s: %s", e.endpoint, err)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) post(path string, contentType string,
+	body []byte) error {
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentType == "application/grpc" {
+		req.Header.Set("TE", "trailers")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Trailers are only read once the body is
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	if contentType != "application/grpc" {
+		return nil
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("collector returned gRPC status %s: %s", status,
+			message)
+	}
+	return nil
+}
+
+// Encode an ExportLogsServiceRequest. Each record is a log record with the
+// sensor as its body and its tags and fields as attributes
+func (e *OTLPExporter) encodeLogs(records []*Record) []byte {
+	var request protoBuffer
+	request.message(1, func(resourceLogs *protoBuffer) {
+		resourceLogs.message(1, e.encodeResource)
+		resourceLogs.message(2, func(scopeLogs *protoBuffer) {
+			scopeLogs.message(1, encodeScope)
+			for _, record := range records {
+				scopeLogs.message(2, func(logRecord *protoBuffer) {
+					logRecord.fixed64(1, uint64(record.Timestamp.UnixNano()))
+					logRecord.varint(2, otlpSeverityInfo)
+					logRecord.string(3, "INFO")
+					logRecord.message(5, func(body *protoBuffer) {
+						encodeAnyValue(body, record.Sensor)
+					})
+					e.encodeTags(logRecord, 6, record.Tags)
+					for _, key := range sortedKeys(record.Fields) {
+						encodeAttribute(logRecord, 6, key, record.Fields[key])
+					}
+				})
+			}
+		})
+	})
+	return request.buf
+}
+
+// Encode an ExportMetricsServiceRequest. Gauges and counters have a metric
+// per value field, and histograms use the log2 slot bounds
+func (e *OTLPExporter) encodeMetrics(metrics map[string]outputMetric) []byte {
+	var request protoBuffer
+	request.message(1, func(resourceMetrics *protoBuffer) {
+		resourceMetrics.message(1, e.encodeResource)
+		resourceMetrics.message(2, func(scopeMetrics *protoBuffer) {
+			scopeMetrics.message(1, encodeScope)
+			for _, name := range sortedKeys(metrics) {
+				metric := metrics[name]
+				if metric.config.Type == "histogram" {
+					scopeMetrics.message(2, func(p *protoBuffer) {
+						e.encodeHistogram(p, metricName(name), &metric)
+					})
+					continue
+				}
+				byField := groupSamples(metric.samples, sampleField)
+				for _, field := range sortedKeys(byField) {
+					scopeMetrics.message(2, func(p *protoBuffer) {
+						e.encodeNumberMetric(p, metricName(name+"_"+field), &metric,
+							byField[field])
+					})
+				}
+			}
+		})
+	})
+	return request.buf
+}
+
+// Encode a Metric holding a gauge, or a cumulative monotonic sum for counters
+func (e *OTLPExporter) encodeNumberMetric(p *protoBuffer, name string,
+	metric *outputMetric, samples []*metricSample) {
+
+	p.string(1, name)
+	dataField := 5
+	if metric.config.Type == "counter" {
+		dataField = 7
+	}
+	p.message(dataField, func(data *protoBuffer) {
+		for _, sample := range samples {
+			data.message(1, func(point *protoBuffer) {
+				if metric.config.Type == "counter" {
+					point.fixed64(2, uint64(metric.startTime.UnixNano()))
+				}
+				point.fixed64(3, uint64(metric.pollTime.UnixNano()))
+				point.double(4, sample.value)
+				e.encodeTags(point, 7, sample.attributes)
+			})
+		}
+		if metric.config.Type == "counter" {
+			data.varint(2, otlpTemporalityCumulative)
+			data.varint(3, 1)
+		}
+	})
+}
+
+// Encode a Metric holding a cumulative histogram with a data point per label
+// set. Each present log2 slot is a bucket bounded by 2^slot-1
+func (e *OTLPExporter) encodeHistogram(p *protoBuffer, name string,
+	metric *outputMetric) {
+
+	p.string(1, name)
+	p.message(9, func(histogram *protoBuffer) {
+		byLabels := groupSamples(metric.samples, sampleLabels)
+		for _, labels := range sortedKeys(byLabels) {
+			samples := byLabels[labels]
+			var count uint64
+			counts := make([]uint64, 0, len(samples)+1)
+			bounds := make([]float64, 0, len(samples))
+			for _, sample := range samples {
+				count += uint64(sample.value)
+				counts = append(counts, uint64(sample.value))
+				bounds = append(bounds, float64(slotBound(sample.slot)))
+			}
+			counts = append(counts, 0)
+			histogram.message(1, func(point *protoBuffer) {
+				point.fixed64(2, uint64(metric.startTime.UnixNano()))
+				point.fixed64(3, uint64(metric.pollTime.UnixNano()))
+				point.fixed64(4, count)
+				point.packedFixed64(6, counts)
+				point.packedDouble(7, bounds)
+				e.encodeTags(point, 9, samples[0].attributes)
+			})
+		}
+		histogram.varint(2, otlpTemporalityCumulative)
+	})
+}
+
+// Encode a Resource with the exporter's attributes
+func (e *OTLPExporter) encodeResource(resource *protoBuffer) {
+	for _, key := range sortedKeys(e.resource) {
+		encodeAttribute(resource, 1, key, e.resource[key])
+	}
+}
+
+// Encode tags as attributes, leaving out those the resource carries
+func (e *OTLPExporter) encodeTags(p *protoBuffer, field int,
+	tags map[string]string) {
+
+	for _, key := range sortedKeys(tags) {
+		if !e.resourceTags[key] {
+			encodeAttribute(p, field, key, tags[key])
+		}
+	}
+}
+
+// Encode an InstrumentationScope naming greggd
+func encodeScope(scope *protoBuffer) {
+	scope.string(1, "greggd")
+}
+
+// Encode a KeyValue attribute
+func encodeAttribute(p *protoBuffer, field int, key string,
+	value interface{}) {
+
+	p.message(field, func(keyValue *protoBuffer) {
+		keyValue.string(1, key)
+		keyValue.message(2, func(anyValue *protoBuffer) {
+			encodeAnyValue(anyValue, value)
+		})
+	})
+}
+
+// Encode a record value as an AnyValue. Unsigned values too large for an
+// int64 are sent as doubles
+func encodeAnyValue(p *protoBuffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		p.string(1, v)
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		p.varint(2, b)
+	case int64:
+		p.varint(3, uint64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			p.double(4, float64(v))
+		} else {
+			p.varint(3, v)
+		}
+	case float64:
+		p.double(4, v)
+	default:
+		p.string(1, fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,314 @@
+package communication
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Decoded protocol buffer field. Varints and fixed64s are kept in n, length
+// delimited fields in b
+type protoValue struct {
+	n uint64
+	b []byte
+}
+
+// Decode one level of a protocol buffer message by field number
+func decodeProto(t *testing.T, data []byte) map[int][]protoValue {
+	t.Helper()
+	fields := make(map[int][]protoValue)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("Bad protobuf field key in %v", data)
+		}
+		data = data[n:]
+		var value protoValue
+		switch key & 7 {
+		case wireVarint:
+			value.n, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("Bad protobuf varint in %v", data)
+			}
+			data = data[n:]
+		case wireFixed64:
+			value.n = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || len(data) < n+int(length) {
+				t.Fatalf("Bad protobuf length in %v", data)
+			}
+			value.b = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("Unexpected protobuf wire type %d", key&7)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], value)
+	}
+	return fields
+}
+
+// Walk down the first value of each field in path
+func protoPath(t *testing.T, data []byte, path ...int) []byte {
+	t.Helper()
+	for _, field := range path {
+		values := decodeProto(t, data)[field]
+		if len(values) == 0 {
+			t.Fatalf("Protobuf message has no field %d", field)
+		}
+		data = values[0].b
+	}
+	return data
+}
+
+// Decode KeyValue attributes
+func protoAttributes(t *testing.T, values []protoValue) map[string]interface{} {
+	t.Helper()
+	attributes := make(map[string]interface{})
+	for _, value := range values {
+		keyValue := decodeProto(t, value.b)
+		anyValue := decodeProto(t, keyValue[2][0].b)
+		key := string(keyValue[1][0].b)
+		switch {
+		case len(anyValue[1]) != 0:
+			attributes[key] = string(anyValue[1][0].b)
+		case len(anyValue[2]) != 0:
+			attributes[key] = anyValue[2][0].n == 1
+		case len(anyValue[3]) != 0:
+			attributes[key] = int64(anyValue[3][0].n)
+		case len(anyValue[4]) != 0:
+			attributes[key] = math.Float64frombits(anyValue[4][0].n)
+		}
+	}
+	return attributes
+}
+
+// In-process collector keeping the export requests it receives. Answers gRPC
+// requests with status
+type fakeCollector struct {
+	mu      sync.Mutex
+	status  string
+	logs    [][]byte
+	metrics [][]byte
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	grpc := r.Header.Get("Content-Type") == "application/grpc"
+	if grpc {
+		if len(body) < 5 ||
+			int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			http.Error(w, "bad grpc frame", http.StatusBadRequest)
+			return
+		}
+		body = body[5:]
+	}
+	c.mu.Lock()
+	switch r.URL.Path {
+	case otlpLogsGRPCPath, otlpLogsHTTPPath:
+		c.logs = append(c.logs, body)
+	case otlpMetricsGRPCPath, otlpMetricsHTTPPath:
+		c.metrics = append(c.metrics, body)
+	default:
+		c.mu.Unlock()
+		http.NotFound(w, r)
+		return
+	}
+	status := c.status
+	c.mu.Unlock()
+
+	if !grpc {
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set("Grpc-Status", status)
+	if status != "0" {
+		w.Header().Set("Grpc-Message", "collector unavailable")
+	}
+}
+
+func startFakeCollector(t *testing.T) (*fakeCollector, string) {
+	collector := &fakeCollector{status: "0"}
+	server := httptest.NewServer(h2c.NewHandler(collector, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return collector, server.Listener.Addr().String()
+}
+
+// Confirm perf records are exported as log records and hash records as
+// metrics, over both transports
+func TestOTLPExporter(t *testing.T) {
+	perfOutput := &config.BPFOutput{Id: "opensnoop", Type: "BPF_PERF_OUTPUT"}
+	hashOutput := &config.BPFOutput{Id: "dist", Type: "BPF_HASH",
+		Metric: config.MetricConfig{Type: "gauge", Name: "cachestat_dist"},
+		Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}}
+	timestamp := time.Unix(1600000000, 123)
+
+	for _, protocol := range []string{"grpc", "http"} {
+		collector, address := startFakeCollector(t)
+		globals := config.GlobalOptions{HostTags: []string{"host"},
+			Tags: map[string]string{"cluster": "frontier"}}
+		exporter := NewOTLPExporter(config.SinkConfig{Type: "otlp",
+			Address: address, Protocol: protocol}, globals, time.Hour, time.Hour, 2)
+
+		for _, pid := range []int64{42, 43} {
+			record := NewRecord("opensnoop")
+			addGlobalTags(record, globals)
+			record.Tags["comm"] = "bash"
+			record.Fields["pid"] = pid
+			record.Fields["fname"] = "/etc/passwd"
+			record.Timestamp = timestamp
+			if err := exporter.Export(record, perfOutput, time.Time{}); err != nil {
+				t.Fatalf("Error exporting log record over %s: %v", protocol, err)
+			}
+		}
+		record := NewRecord("dist")
+		addGlobalTags(record, globals)
+		record.Fields["ip"] = "0x10"
+		record.Fields["count"] = uint64(7)
+		if err := exporter.Export(record, hashOutput, timestamp); err != nil {
+			t.Fatalf("Error exporting metric over %s: %v", protocol, err)
+		}
+		// A full batch is sent right away, metrics wait for the interval
+		collector.mu.Lock()
+		if len(collector.logs) != 1 || len(collector.metrics) != 0 {
+			t.Errorf("Over %s collector got %d log and %d metric requests, expected 1 and 0",
+				protocol, len(collector.logs), len(collector.metrics))
+		}
+		collector.mu.Unlock()
+		if err := exporter.Close(); err != nil {
+			t.Fatalf("Error closing exporter over %s: %v", protocol, err)
+		}
+		if len(collector.logs) != 1 || len(collector.metrics) != 1 {
+			t.Fatalf("Over %s collector got %d log and %d metric requests, expected 1 each",
+				protocol, len(collector.logs), len(collector.metrics))
+		}
+
+		// Log records carry their tags and fields as attributes, apart from
+		// the global tags the resource carries
+		expectedResource := map[string]interface{}{"service.name": "greggd",
+			"host.name": hostName(), "cluster": "frontier"}
+		for _, request := range [][]byte{collector.logs[0], collector.metrics[0]} {
+			resource := decodeProto(t, protoPath(t, request, 1, 1))
+			if attrs := protoAttributes(t, resource[1]); !reflect.DeepEqual(attrs,
+				expectedResource) {
+				t.Errorf("Over %s resource has attributes %v, expected %v", protocol,
+					attrs, expectedResource)
+			}
+		}
+		logRecords := decodeProto(t, protoPath(t, collector.logs[0], 1, 2))[2]
+		if len(logRecords) != 2 {
+			t.Fatalf("Over %s got %d log records, expected 2", protocol,
+				len(logRecords))
+		}
+		logRecord := decodeProto(t, logRecords[0].b)
+		if logRecord[1][0].n != uint64(timestamp.UnixNano()) {
+			t.Errorf("Over %s log record has time %d", protocol, logRecord[1][0].n)
+		}
+		if body := string(protoPath(t, logRecord[5][0].b, 1)); body != "opensnoop" {
+			t.Errorf("Over %s log record has body %s", protocol, body)
+		}
+		expected := map[string]interface{}{"comm": "bash",
+			"sensor": "opensnoop", "pid": int64(42), "fname": "/etc/passwd"}
+		if attrs := protoAttributes(t, logRecord[6]); !reflect.DeepEqual(attrs,
+			expected) {
+			t.Errorf("Over %s log record has attributes %v, expected %v", protocol,
+				attrs, expected)
+		}
+
+		// Map records become a gauge per value field
+		metric := decodeProto(t, protoPath(t, collector.metrics[0], 1, 2, 2))
+		if name := string(metric[1][0].b); name != "greggd_cachestat_dist_count" {
+			t.Errorf("Over %s metric is named %s", protocol, name)
+		}
+		point := decodeProto(t, protoPath(t, metric[5][0].b, 1))
+		if value := math.Float64frombits(point[4][0].n); value != 7 {
+			t.Errorf("Over %s gauge has value %v, expected 7", protocol, value)
+		}
+		expected = map[string]interface{}{"ip": "0x10", "sensor": "dist"}
+		if attrs := protoAttributes(t, point[7]); !reflect.DeepEqual(attrs,
+			expected) {
+			t.Errorf("Over %s gauge has attributes %v, expected %v", protocol, attrs,
+				expected)
+		}
+	}
+}
+
+// Confirm histograms use the log2 slot bounds and that gRPC errors are
+// returned
+func TestOTLPExporterHistogram(t *testing.T) {
+	collector, address := startFakeCollector(t)
+	exporter := NewOTLPExporter(config.SinkConfig{Type: "otlp",
+		Address: address}, config.GlobalOptions{}, time.Hour, time.Hour, 10)
+	output := &config.BPFOutput{Id: "dist", Type: "BPF_HISTOGRAM",
+		Metric: config.MetricConfig{Type: "histogram", Name: "biolatency_dist",
+			Bucket: "slot"},
+		Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}}
+	for slot, count := range map[string]uint64{"0": 1, "3": 2, "10": 5} {
+		record := NewRecord("dist")
+		record.Tags["disk"] = "sda"
+		record.Tags["slot"] = slot
+		record.Fields["count"] = count
+		if err := exporter.Export(record, output, time.Unix(10, 0)); err != nil {
+			t.Fatalf("Error exporting histogram: %v", err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatalf("Error closing exporter: %v", err)
+	}
+
+	metric := decodeProto(t, protoPath(t, collector.metrics[0], 1, 2, 2))
+	if name := string(metric[1][0].b); name != "greggd_biolatency_dist" {
+		t.Errorf("Histogram is named %s", name)
+	}
+	histogram := decodeProto(t, metric[9][0].b)
+	if histogram[2][0].n != otlpTemporalityCumulative {
+		t.Errorf("Histogram has temporality %d", histogram[2][0].n)
+	}
+	point := decodeProto(t, histogram[1][0].b)
+	if point[4][0].n != 8 {
+		t.Errorf("Histogram has count %d, expected 8", point[4][0].n)
+	}
+	var counts []uint64
+	for b := point[6][0].b; len(b) > 0; b = b[8:] {
+		counts = append(counts, binary.LittleEndian.Uint64(b))
+	}
+	var bounds []float64
+	for b := point[7][0].b; len(b) > 0; b = b[8:] {
+		bounds = append(bounds, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+	if !reflect.DeepEqual(counts, []uint64{1, 2, 5, 0}) ||
+		!reflect.DeepEqual(bounds, []float64{0, 7, 1023}) {
+		t.Errorf("Histogram has counts %v and bounds %v", counts, bounds)
+	}
+	expected := map[string]interface{}{"disk": "sda", "sensor": "dist"}
+	if attrs := protoAttributes(t, point[9]); !reflect.DeepEqual(attrs,
+		expected) {
+		t.Errorf("Histogram has attributes %v, expected %v", attrs, expected)
+	}
+
+	// Collector errors are reported
+	collector.status = "14"
+	exporter = NewOTLPExporter(config.SinkConfig{Type: "otlp",
+		Address: address}, config.GlobalOptions{}, time.Hour, time.Hour, 1)
+	err := exporter.Export(NewRecord("opensnoop"),
+		&config.BPFOutput{Id: "opensnoop"}, time.Time{})
+	if err == nil {
+		t.Errorf("Unavailable collector did not return error")
+	}
+	exporter.Close()
+}
@@ -0,0 +1,310 @@
+package communication
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Latest poll of each hash and histogram output, served as Prometheus
+// metrics in the text exposition format
+type MetricStore struct {
+	mu      sync.Mutex
+	metrics map[string]*outputMetric
+}
+
+// Samples of one output, keyed by value field, labels and bucket
+type outputMetric struct {
+	config config.MetricConfig
+	// Poll the samples started at, and the latest poll they include
+	startTime time.Time
+	pollTime  time.Time
+	samples   map[string]*metricSample
+}
+
+type metricSample struct {
+	// Value field the sample was read from
+	field string
+	// Rendered label pairs, sorted by name and without braces
+	labels     string
+	attributes map[string]string
+	// Log2 bucket of histogram samples
+	slot  uint64
+	value float64
+}
+
+func NewMetricStore() *MetricStore {
+	return &MetricStore{metrics: make(map[string]*outputMetric)}
+}
+
+// Add a record read in an output's poll at pollTime. Tags and key fields
+// become labels, numeric value fields the sample values. A newer poll
+// replaces the previous one, except that counters and histograms of outputs
+// cleared on poll add it to their running totals
+func (s *MetricStore) Observe(record *Record, output *config.BPFOutput,
+	pollTime time.Time) error {
+
+	if !config.ExportsMetrics(output) {
+		return nil
+	}
+	values := make(map[string]bool)
+	for _, format := range output.Format {
+		values[format.Name] = true
+	}
+
+	labels := make(map[string]string)
+	for key, value := range record.Tags {
+		labels[key] = value
+	}
+	samples := make(map[string]float64)
+	for key, value := range record.Fields {
+		number, ok := metricValue(value)
+		if ok && values[key] {
+			samples[key] = number
+		} else {
+			labels[key] = fmt.Sprint(value)
+		}
+	}
+
+	var slot uint64
+	if output.Metric.Type == "histogram" {
+		bucket, ok := labels[output.Metric.Bucket]
+		if !ok {
+			return nil
+		}
+		var err error
+		slot, err = strconv.ParseUint(bucket, 10, 64)
+		if err != nil {
+			return fmt.Errorf("prometheus.go: Bucket %s of output %s is not a slot: %s",
+				output.Metric.Bucket, output.Id, err)
+		}
+		delete(labels, output.Metric.Bucket)
+	}
+	rendered := renderLabels(labels)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metric, ok := s.metrics[output.Metric.Name]
+	accumulate := output.Clear && output.Metric.Type != "gauge"
+	if !ok || (pollTime.After(metric.pollTime) && !accumulate) {
+		metric = &outputMetric{startTime: pollTime,
+			samples: make(map[string]*metricSample)}
+		s.metrics[output.Metric.Name] = metric
+	}
+	metric.config = output.Metric
+	metric.pollTime = pollTime
+	for field, value := range samples {
+		key := fmt.Sprintf("%s\x00%s\x00%d", field, rendered, slot)
+		sample, ok := metric.samples[key]
+		if !ok {
+			sample = &metricSample{field: field, labels: rendered,
+				attributes: labels, slot: slot}
+			metric.samples[key] = sample
+		}
+		if accumulate {
+			sample.value += value
+		} else {
+			sample.value = value
+		}
+	}
+	return nil
+}
+
+// Write every metric in the Prometheus text format, sorted by name
+func (s *MetricStore) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	s.mu.Lock()
+	for _, name := range sortedKeys(s.metrics) {
+		metric := s.metrics[name]
+		if metric.config.Type == "histogram" {
+			writeHistogram(&buf, metricName(name), metric)
+		} else {
+			writeGauges(&buf, name, metric)
+		}
+	}
+	s.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// Copy of every output's metric by name, for exporters
+func (s *MetricStore) snapshot() map[string]outputMetric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := make(map[string]outputMetric, len(s.metrics))
+	for name, metric := range s.metrics {
+		samples := make(map[string]*metricSample, len(metric.samples))
+		for key, sample := range metric.samples {
+			copied := *sample
+			samples[key] = &copied
+		}
+		copied := *metric
+		copied.samples = samples
+		metrics[name] = copied
+	}
+	return metrics
+}
+
+func (s *MetricStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.WriteTo(w)
+}
+
+// Serve the store on /metrics until the context is cancelled
+func ServeMetrics(ctx context.Context, listener net.Listener,
+	store *MetricStore) error {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", store)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err := server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("prometheus.go: Error serving metrics: %s", err)
+	}
+	return nil
+}
+
+// Group samples by key, each group sorted by labels and then slot
+func groupSamples(samples map[string]*metricSample,
+	key func(*metricSample) string) map[string][]*metricSample {
+
+	groups := make(map[string][]*metricSample)
+	for _, sample := range samples {
+		groups[key(sample)] = append(groups[key(sample)], sample)
+	}
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].labels != group[j].labels {
+				return group[i].labels < group[j].labels
+			}
+			return group[i].slot < group[j].slot
+		})
+	}
+	return groups
+}
+
+func sampleField(sample *metricSample) string  { return sample.field }
+func sampleLabels(sample *metricSample) string { return sample.labels }
+
+// Upper bound of the values a log2 slot holds, 2^slot-1
+func slotBound(slot uint64) uint64 {
+	if slot >= 64 {
+		return math.MaxUint64
+	}
+	return 1<<slot - 1
+}
+
+// Write one gauge or counter per value field
+func writeGauges(buf *bytes.Buffer, name string, metric *outputMetric) {
+	byField := groupSamples(metric.samples, sampleField)
+	for _, field := range sortedKeys(byField) {
+		fieldName := metricName(name + "_" + field)
+		if metric.config.Type == "counter" {
+			fieldName += "_total"
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", fieldName, metric.config.Type)
+		for _, sample := range byField[field] {
+			fmt.Fprintf(buf, "%s%s %s\n", fieldName, braced(sample.labels),
+				formatMetricValue(sample.value))
+		}
+	}
+}
+
+// Write cumulative _bucket series and a _count for each label set. The kernel
+// only counts, so there is no _sum
+func writeHistogram(buf *bytes.Buffer, name string, metric *outputMetric) {
+	byLabels := groupSamples(metric.samples, sampleLabels)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	for _, labels := range sortedKeys(byLabels) {
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		total := 0.0
+		for _, sample := range byLabels[labels] {
+			total += sample.value
+			fmt.Fprintf(buf, "%s_bucket{%sle=\"%d\"} %s\n", name, prefix,
+				slotBound(sample.slot), formatMetricValue(total))
+		}
+		fmt.Fprintf(buf, "%s_bucket{%sle=\"+Inf\"} %s\n", name, prefix,
+			formatMetricValue(total))
+		fmt.Fprintf(buf, "%s_count%s %s\n", name, braced(labels),
+			formatMetricValue(total))
+	}
+}
+
+// Characters Prometheus doesn't allow in metric and label names
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Prefix a name with greggd_ and replace characters Prometheus doesn't allow
+func metricName(name string) string {
+	return "greggd_" + invalidMetricChars.ReplaceAllString(name, "_")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Render labels as sorted name="value" pairs
+func renderLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, name := range sortedKeys(labels) {
+		labelName := invalidMetricChars.ReplaceAllString(name, "_")
+		if labelName != "" && labelName[0] >= '0' && labelName[0] <= '9' {
+			labelName = "_" + labelName
+		}
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName,
+			labelValueEscaper.Replace(labels[name])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// Numeric value of a record field. Booleans count as 0 or 1
+func metricValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,155 @@
+package communication
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Record of a hash entry with the given tags and fields
+func metricRecord(tags map[string]string,
+	fields map[string]interface{}) *Record {
+
+	record := NewRecord("dist")
+	for key, value := range tags {
+		record.Tags[key] = value
+	}
+	for key, value := range fields {
+		record.Fields[key] = value
+	}
+	return record
+}
+
+func writeMetrics(t *testing.T, store *MetricStore) string {
+	t.Helper()
+	var buf strings.Builder
+	if _, err := store.WriteTo(&buf); err != nil {
+		t.Fatalf("Error writing metrics: %v", err)
+	}
+	return buf.String()
+}
+
+// Confirm key fields and tags become labels, and that a new poll replaces
+// gauges but adds to counters of cleared outputs
+func TestMetricStoreGauges(t *testing.T) {
+	output := &config.BPFOutput{Id: "dist", Type: "BPF_HASH", Clear: true,
+		Metric: config.MetricConfig{Type: "gauge", Name: "cachestat_dist"},
+		Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}}
+	counter := *output
+	counter.Metric = config.MetricConfig{Type: "counter", Name: "calls"}
+
+	store := NewMetricStore()
+	first := time.Unix(10, 0)
+	for _, poll := range []time.Time{first, first.Add(time.Second)} {
+		for _, out := range []*config.BPFOutput{output, &counter} {
+			for ip, count := range map[string]uint64{"0x10": 3, "0x20": 4} {
+				err := store.Observe(metricRecord(nil, map[string]interface{}{
+					"ip": ip, "count": count}), out, poll)
+				if err != nil {
+					t.Fatalf("Error observing record: %v", err)
+				}
+			}
+		}
+	}
+
+	expected := `# TYPE greggd_cachestat_dist_count gauge
+greggd_cachestat_dist_count{ip="0x10",sensor="dist"} 3
+greggd_cachestat_dist_count{ip="0x20",sensor="dist"} 4
+# TYPE greggd_calls_count_total counter
+greggd_calls_count_total{ip="0x10",sensor="dist"} 6
+greggd_calls_count_total{ip="0x20",sensor="dist"} 8
+`
+	if actual := writeMetrics(t, store); actual != expected {
+		t.Errorf("Got metrics:\n%s\nexpected:\n%s", actual, expected)
+	}
+
+	// Outputs without a metric type aren't exported
+	err := store.Observe(metricRecord(nil, map[string]interface{}{"count": 1}),
+		&config.BPFOutput{Id: "events"}, first)
+	if err != nil || strings.Contains(writeMetrics(t, store), "events") {
+		t.Errorf("Output without a metric type was exported, error %v", err)
+	}
+}
+
+// Confirm log2 slots become cumulative buckets per label set
+func TestMetricStoreHistogram(t *testing.T) {
+	output := &config.BPFOutput{Id: "dist", Type: "BPF_HISTOGRAM",
+		Metric: config.MetricConfig{Type: "histogram", Name: "biolatency_dist",
+			Bucket: "slot"},
+		Format: []config.BPFOutputFormat{{Name: "count", Type: "u64"}}}
+	entries := []struct {
+		disk  string
+		slot  string
+		count uint64
+	}{
+		{"sda", "3", 2}, {"sda", "0", 1}, {"sda", "10", 5}, {"nvme0n1", "1", 7},
+	}
+	store := NewMetricStore()
+	for _, entry := range entries {
+		err := store.Observe(metricRecord(
+			map[string]string{"disk": entry.disk, "slot": entry.slot},
+			map[string]interface{}{"count": entry.count}), output, time.Unix(10, 0))
+		if err != nil {
+			t.Fatalf("Error observing record: %v", err)
+		}
+	}
+	checkGolden(t, "prometheus/histogram", writeMetrics(t, store))
+
+	// Slots have to be numbers
+	err := store.Observe(metricRecord(map[string]string{"slot": "high"},
+		map[string]interface{}{"count": uint64(1)}), output, time.Unix(10, 0))
+	if err == nil {
+		t.Errorf("Non-numeric slot did not throw error")
+	}
+}
+
+// Confirm metrics are served over HTTP until the context is cancelled
+func TestServeMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	store := NewMetricStore()
+	store.Observe(metricRecord(nil, map[string]interface{}{"count": uint64(5)}),
+		&config.BPFOutput{Id: "dist", Format: []config.BPFOutputFormat{
+			{Name: "count", Type: "u64"}},
+			Metric: config.MetricConfig{Type: "gauge", Name: "dist"}},
+		time.Unix(10, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ServeMetrics(ctx, listener, store) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Error getting metrics: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading metrics: %v", err)
+	}
+	if !strings.Contains(string(body), `greggd_dist_count{sensor="dist"} 5`) {
+		t.Errorf("Served metrics missing gauge:\n%s", body)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Served metrics with content type %s",
+			resp.Header.Get("Content-Type"))
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serving metrics returned error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Serving metrics did not stop on cancel")
+	}
+}
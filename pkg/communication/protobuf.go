@@ -0,0 +1,154 @@
+package communication
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Minimal protocol buffer encoder, enough for the messages greggd sends.
+// Fields are appended in the order they are written
+type protoBuffer struct {
+	buf []byte
+}
+
+func (p *protoBuffer) tag(field int, wireType int) {
+	p.buf = binary.AppendUvarint(p.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (p *protoBuffer) varint(field int, v uint64) {
+	p.tag(field, wireVarint)
+	p.buf = binary.AppendUvarint(p.buf, v)
+}
+
+// Signed varint, zigzag encoded so small negative values stay short
+func (p *protoBuffer) sint64(field int, v int64) {
+	p.varint(field, uint64(v<<1)^uint64(v>>63))
+}
+
+func (p *protoBuffer) fixed64(field int, v uint64) {
+	p.tag(field, wireFixed64)
+	p.buf = binary.LittleEndian.AppendUint64(p.buf, v)
+}
+
+func (p *protoBuffer) double(field int, v float64) {
+	p.fixed64(field, math.Float64bits(v))
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.tag(field, wireBytes)
+	p.buf = binary.AppendUvarint(p.buf, uint64(len(b)))
+	p.buf = append(p.buf, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+// Write a nested message built by f
+func (p *protoBuffer) message(field int, f func(*protoBuffer)) {
+	var nested protoBuffer
+	f(&nested)
+	p.bytes(field, nested.buf)
+}
+
+func (p *protoBuffer) packedFixed64(field int, values []uint64) {
+	var packed []byte
+	for _, v := range values {
+		packed = binary.LittleEndian.AppendUint64(packed, v)
+	}
+	p.bytes(field, packed)
+}
+
+func (p *protoBuffer) packedDouble(field int, values []float64) {
+	bits := make([]uint64, len(values))
+	for i, v := range values {
+		bits[i] = math.Float64bits(v)
+	}
+	p.packedFixed64(field, bits)
+}
+
+// Writes records as greggd.v1.Record messages from api/proto/record.proto,
+// each preceded by its length as a varint
+type ProtobufFormatter struct {
+	// Host the records were collected on
+	Host string
+}
+
+// Field numbers of greggd.v1.Record and greggd.v1.Value
+const (
+	recordSensor       = 1
+	recordMeasurement  = 2
+	recordHost         = 3
+	recordTimeUnixNano = 4
+	recordTags         = 5
+	recordFields       = 6
+
+	valueString = 1
+	valueBool   = 2
+	valueInt    = 3
+	valueUint   = 4
+	valueDouble = 5
+)
+
+func (f ProtobufFormatter) Format(record *Record) ([]byte, error) {
+	var message protoBuffer
+	message.string(recordSensor, record.Sensor)
+	message.string(recordMeasurement, record.Measurement)
+	message.string(recordHost, f.Host)
+	message.fixed64(recordTimeUnixNano, uint64(record.Timestamp.UnixNano()))
+	// Maps are repeated entries with the key as field 1 and the value as 2
+	for _, name := range sortedKeys(record.Tags) {
+		message.message(recordTags, func(entry *protoBuffer) {
+			entry.string(1, name)
+			entry.string(2, record.Tags[name])
+		})
+	}
+	for _, name := range sortedKeys(record.Fields) {
+		var err error
+		message.message(recordFields, func(entry *protoBuffer) {
+			entry.string(1, name)
+			entry.message(2, func(value *protoBuffer) {
+				err = appendProtoValue(value, record.Fields[name])
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	output := binary.AppendUvarint(nil, uint64(len(message.buf)))
+	return append(output, message.buf...), nil
+}
+
+// Write a record value as the member of the greggd.v1.Value oneof for its
+// type
+func appendProtoValue(p *protoBuffer, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		p.string(valueString, v)
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		p.varint(valueBool, b)
+	case int64:
+		p.sint64(valueInt, v)
+	case uint64:
+		p.varint(valueUint, v)
+	case float64:
+		p.double(valueDouble, v)
+	default:
+		return fmt.Errorf("protobuf.go: Can't encode value %v of type %T", value,
+			value)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package communication
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Confirm records are written as length delimited greggd.v1.Record messages
+func TestProtobufFormatter(t *testing.T) {
+	timestamp := time.Unix(1600000000, 123456789)
+	records := []*Record{
+		{Sensor: "opensnoop", Measurement: "bpf",
+			Tags: map[string]string{"sensor": "opensnoop", "comm": "bash"},
+			Fields: map[string]interface{}{"fname": "/etc/passwd",
+				"ret": int64(-2), "id": uint64(math.MaxUint64), "ratio": 0.5,
+				"ok": true},
+			Timestamp: timestamp},
+		NewRecord("tcplife"),
+	}
+	var stream []byte
+	for _, record := range records {
+		output, err := ProtobufFormatter{Host: "node1"}.Format(record)
+		if err != nil {
+			t.Fatalf("Error formatting record: %v", err)
+		}
+		stream = append(stream, output...)
+	}
+
+	// Read the stream back one message at a time
+	reader := bytes.NewReader(stream)
+	var messages [][]byte
+	for reader.Len() > 0 {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			t.Fatalf("Error reading message length: %v", err)
+		}
+		message := make([]byte, length)
+		if _, err := reader.Read(message); err != nil {
+			t.Fatalf("Error reading message: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Stream has %d messages, expected 2", len(messages))
+	}
+
+	message := decodeProto(t, messages[0])
+	if string(message[recordSensor][0].b) != "opensnoop" ||
+		string(message[recordMeasurement][0].b) != "bpf" ||
+		string(message[recordHost][0].b) != "node1" ||
+		message[recordTimeUnixNano][0].n != uint64(timestamp.UnixNano()) {
+		t.Errorf("Record has envelope %v", message)
+	}
+	tags := make(map[string]string)
+	for _, entry := range message[recordTags] {
+		fields := decodeProto(t, entry.b)
+		tags[string(fields[1][0].b)] = string(fields[2][0].b)
+	}
+	if expected := records[0].Tags; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Record has tags %v, expected %v", tags, expected)
+	}
+	values := make(map[string]interface{})
+	for _, entry := range message[recordFields] {
+		fields := decodeProto(t, entry.b)
+		value := decodeProto(t, fields[2][0].b)
+		name := string(fields[1][0].b)
+		switch {
+		case len(value[valueString]) != 0:
+			values[name] = string(value[valueString][0].b)
+		case len(value[valueBool]) != 0:
+			values[name] = value[valueBool][0].n == 1
+		case len(value[valueInt]) != 0:
+			n := value[valueInt][0].n
+			values[name] = int64(n>>1) ^ -int64(n&1)
+		case len(value[valueUint]) != 0:
+			values[name] = value[valueUint][0].n
+		case len(value[valueDouble]) != 0:
+			values[name] = math.Float64frombits(value[valueDouble][0].n)
+		}
+	}
+	if expected := records[0].Fields; !reflect.DeepEqual(values, expected) {
+		t.Errorf("Record has fields %v, expected %v", values, expected)
+	}
+
+	message = decodeProto(t, messages[1])
+	if string(message[recordSensor][0].b) != "tcplife" ||
+		len(message[recordFields]) != 0 {
+		t.Errorf("Empty record has envelope %v", message)
+	}
+}
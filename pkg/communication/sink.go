@@ -0,0 +1,180 @@
+package communication
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// How often OTLP sinks export waiting log records and metrics, and how many
+// log records are exported at once
+const (
+	otlpFlushInterval  = time.Second
+	otlpMetricInterval = 10 * time.Second
+	otlpBatchSize      = 512
+)
+
+// Destination for encoded records, with the formatter records are encoded
+// with by default. OTLP sinks take whole records instead
+type Sink struct {
+	config    config.SinkConfig
+	globals   config.GlobalOptions
+	writer    io.Writer
+	formatter Formatter
+	otlp      *OTLPExporter
+	// Set for sinks whose encoding outputs can't override
+	ownEncoding bool
+	// Frames an encoded record for the connection, if it needs framing
+	frame func([]byte) []byte
+}
+
+// Open a sink, retrying the connection on failures
+func OpenSink(sinkConfig config.SinkConfig,
+	globals config.GlobalOptions) (*Sink, error) {
+
+	if sinkConfig.Type == "otlp" {
+		return &Sink{config: sinkConfig, globals: globals,
+			otlp: NewOTLPExporter(sinkConfig, globals, otlpFlushInterval,
+				otlpMetricInterval, otlpBatchSize)}, nil
+	}
+	sink := &Sink{config: sinkConfig, globals: globals}
+	switch sinkConfig.Type {
+	case "syslog":
+		facility, ok := config.SyslogFacility(sinkConfig.Facility)
+		if !ok {
+			return nil, fmt.Errorf("sink.go: Unknown syslog facility %q",
+				sinkConfig.Facility)
+		}
+		sink.formatter = newSyslogFormatter(facility)
+		sink.ownEncoding = true
+	case "journald":
+		sink.formatter = JournalFormatter{}
+		sink.ownEncoding = true
+	case "stdout", "unix", "tcp", "udp":
+		switch sinkConfig.Encoding {
+		case "graphite":
+			sink.formatter = GraphiteFormatter{Host: hostName(),
+				Template: sinkConfig.Template}
+		case "statsd":
+			sink.formatter = StatsDFormatter{Host: hostName(),
+				Template: sinkConfig.Template}
+		default:
+			formatter, err := NewFormatter(sinkConfig.Encoding)
+			if err != nil {
+				return nil, err
+			}
+			sink.formatter = formatter
+		}
+	default:
+		return nil, fmt.Errorf("sink.go: Unknown sink type %q", sinkConfig.Type)
+	}
+	if sinkConfig.Type == "stdout" {
+		sink.writer = os.Stdout
+		return sink, nil
+	}
+	err := retry(0, globals.CompiledRetryDelay, globals, sink.dial)
+	if err != nil {
+		return nil, fmt.Errorf("sink.go: Error dialing %s sink %s: %s",
+			sinkConfig.Type, sinkConfig.Address, err)
+	}
+	return sink, nil
+}
+
+// Sink writing to w, encoding records with formatter
+func NewWriterSink(w io.Writer, formatter Formatter) *Sink {
+	return &Sink{config: config.SinkConfig{Type: "stdout"}, writer: w,
+		formatter: formatter}
+}
+
+func (s *Sink) dial() error {
+	switch s.config.Type {
+	case "syslog":
+		return s.dialSyslog()
+	case "journald":
+		conn, err := net.Dial("unixgram", s.config.Address)
+		if err != nil {
+			return err
+		}
+		s.writer = conn
+		return nil
+	}
+	conn, err := net.Dial(s.config.Type, s.config.Address)
+	if err != nil {
+		return err
+	}
+	s.writer = conn
+	return nil
+}
+
+// Dial a syslog server. Datagrams hold one message without its newline, TCP
+// streams count octets (RFC 6587) and unix streams keep the newline
+func (s *Sink) dialSyslog() error {
+	network := s.config.Protocol
+	if network == "unix" || network == "" {
+		network = "unixgram"
+	}
+	conn, err := net.Dial(network, s.config.Address)
+	if err != nil && network == "unixgram" {
+		network = "unix"
+		conn, err = net.Dial(network, s.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.writer = conn
+	switch network {
+	case "unixgram", "udp":
+		s.frame = func(data []byte) []byte {
+			return bytes.TrimSuffix(data, []byte("\n"))
+		}
+	case "tcp":
+		s.frame = func(data []byte) []byte {
+			data = bytes.TrimSuffix(data, []byte("\n"))
+			return append([]byte(fmt.Sprintf("%d ", len(data))), data...)
+		}
+	default:
+		s.frame = nil
+	}
+	return nil
+}
+
+// Write an encoded record, retrying on failures. Connections that fail are
+// redialed
+func (s *Sink) Write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return retry(0, s.globals.CompiledRetryDelay, s.globals, func() error {
+		if s.writer == nil {
+			if err := s.dial(); err != nil {
+				return err
+			}
+		}
+		framed := data
+		if s.frame != nil {
+			framed = s.frame(data)
+		}
+		_, err := s.writer.Write(framed)
+		if conn, ok := s.writer.(net.Conn); ok && err != nil {
+			conn.Close()
+			s.writer = nil
+		}
+		return err
+	})
+}
+
+// Close the sink's connection, if it has one. OTLP sinks export what is left
+func (s *Sink) Close() error {
+	if s.otlp != nil {
+		return s.otlp.Close()
+	}
+	if conn, ok := s.writer.(net.Conn); ok {
+		return conn.Close()
+	}
+	return nil
+}
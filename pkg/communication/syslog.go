@@ -0,0 +1,159 @@
+package communication
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syslog severity of records, informational
+const syslogSeverityInfo = 6
+
+// Structured data ID holding record values. 32473 is the private enterprise
+// number RFC 5612 sets aside for documentation
+const syslogSDID = "greggd@32473"
+
+// Writes records as RFC 5424 syslog messages, with tags and fields as
+// parameters of a structured data element and a key=value summary as the
+// message. Syslog sinks drop the newline or count octets when they frame them
+type SyslogFormatter struct {
+	Host     string
+	Facility int
+	// Process ID of greggd
+	ProcID int
+}
+
+// Characters RFC 5424 doesn't allow in header fields and parameter names
+var invalidSyslogChars = regexp.MustCompile(`[^!-~]|[=\]"]`)
+
+// Escapes parameter values. Newlines are also escaped so messages stay on one
+// line for stream sinks
+var syslogValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`,
+	"\n", `\n`)
+
+// Printable ASCII for a header field, at most max characters. Empty fields are
+// written as the nil value
+func syslogHeaderField(value string, max int) string {
+	value = invalidSyslogChars.ReplaceAllString(value, "_")
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func (f SyslogFormatter) Format(record *Record) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s greggd %d %s [%s",
+		f.Facility*8+syslogSeverityInfo,
+		record.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(f.Host, 255), f.ProcID,
+		syslogHeaderField(record.Sensor, 32), syslogSDID)
+	for _, name := range sortedKeys(record.Tags) {
+		fmt.Fprintf(&buf, ` %s="%s"`, syslogHeaderField(name, 32),
+			syslogValueEscaper.Replace(record.Tags[name]))
+	}
+	for _, name := range sortedKeys(record.Fields) {
+		fmt.Fprintf(&buf, ` %s="%s"`, syslogHeaderField(name, 32),
+			syslogValueEscaper.Replace(fmt.Sprint(record.Fields[name])))
+	}
+	buf.WriteString("] ")
+	buf.WriteString(recordSummary(record))
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// Writes records as journald native protocol messages, with tags and fields as
+// upper case journal fields
+type JournalFormatter struct{}
+
+// Fields journald gives a meaning to. Record values with these names are
+// prefixed with GREGGD_
+var journalReserved = map[string]bool{"MESSAGE": true, "MESSAGE_ID": true,
+	"PRIORITY": true, "CODE_FILE": true, "CODE_LINE": true, "CODE_FUNC": true,
+	"ERRNO": true, "INVOCATION_ID": true, "USER_INVOCATION_ID": true,
+	"SYSLOG_FACILITY": true, "SYSLOG_IDENTIFIER": true, "SYSLOG_PID": true,
+	"SYSLOG_TIMESTAMP": true, "SYSLOG_RAW": true, "DOCUMENTATION": true,
+	"TID": true, "UNIT": true, "USER_UNIT": true}
+
+var invalidJournalChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// Journal field name for a record value. Names are upper case, can't start
+// with an underscore or digit, and at most 64 characters
+func journalFieldName(name string) string {
+	name = invalidJournalChars.ReplaceAllString(strings.ToUpper(name), "_")
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" || journalReserved[name] {
+		name = "GREGGD_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// Append a journal field. Values with newlines use the binary form, with the
+// value's length before it
+func appendJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (JournalFormatter) Format(record *Record) ([]byte, error) {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", recordSummary(record))
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(syslogSeverityInfo))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "greggd")
+	appendJournalField(&buf, "GREGGD_TIMESTAMP",
+		record.Timestamp.UTC().Format(time.RFC3339Nano))
+	for _, name := range sortedKeys(record.Tags) {
+		appendJournalField(&buf, journalFieldName(name), record.Tags[name])
+	}
+	for _, name := range sortedKeys(record.Fields) {
+		appendJournalField(&buf, journalFieldName(name),
+			fmt.Sprint(record.Fields[name]))
+	}
+	return buf.Bytes(), nil
+}
+
+// Sensor followed by the record's tags and then fields as sorted key=value
+// pairs. Values with spaces, quotes or equals signs are quoted
+func recordSummary(record *Record) string {
+	pairs := []string{record.Sensor}
+	value := func(v string) string {
+		if v == "" || strings.ContainsAny(v, " \"=\n") {
+			return strconv.Quote(v)
+		}
+		return v
+	}
+	for _, name := range sortedKeys(record.Tags) {
+		if name == "sensor" {
+			continue
+		}
+		pairs = append(pairs, name+"="+value(record.Tags[name]))
+	}
+	for _, name := range sortedKeys(record.Fields) {
+		pairs = append(pairs, name+"="+value(fmt.Sprint(record.Fields[name])))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Syslog formatter for this host and process
+func newSyslogFormatter(facility int) SyslogFormatter {
+	return SyslogFormatter{Host: hostName(), Facility: facility,
+		ProcID: os.Getpid()}
+}
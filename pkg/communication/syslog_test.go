@@ -0,0 +1,177 @@
+package communication
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Record with values that need escaping in both encodings
+func syslogRecord() *Record {
+	return &Record{Sensor: "execsnoop", Measurement: "bpf",
+		Tags: map[string]string{"sensor": "execsnoop", "comm": "bash"},
+		Fields: map[string]interface{}{"argv": `sh -c "echo ]"`, "pid": int64(42),
+			"uid": uint64(0)},
+		Timestamp: time.Unix(1600000000, 123456789)}
+}
+
+// Confirm records are written as RFC 5424 messages and journal fields
+func TestSyslogFormatters(t *testing.T) {
+	output, err := SyslogFormatter{Host: "node1", Facility: 10,
+		ProcID: 100}.Format(syslogRecord())
+	if err != nil {
+		t.Fatalf("Error formatting syslog message: %v", err)
+	}
+	checkGolden(t, "syslog/record", string(output))
+
+	output, err = JournalFormatter{}.Format(syslogRecord())
+	if err != nil {
+		t.Fatalf("Error formatting journal message: %v", err)
+	}
+	checkGolden(t, "syslog/journal", string(output))
+
+	// Values with newlines use the binary journal form
+	record := syslogRecord()
+	record.Fields["argv"] = "a\nb"
+	output, _ = JournalFormatter{}.Format(record)
+	binaryField := append([]byte("ARGV\n"), 3, 0, 0, 0, 0, 0, 0, 0)
+	binaryField = append(binaryField, "a\nb\n"...)
+	if !bytes.Contains(output, binaryField) {
+		t.Errorf("Journal message does not have binary ARGV field:\n%q", output)
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tables := []struct {
+		name     string
+		expected string
+	}{
+		{"comm", "COMM"},
+		{"rx-b", "RX_B"},
+		{"_pid", "PID"},
+		{"message", "GREGGD_MESSAGE"},
+		{"2nd", "ND"},
+	}
+	for _, tbl := range tables {
+		if name := journalFieldName(tbl.name); name != tbl.expected {
+			t.Errorf("Field %s has journal name %s, expected %s", tbl.name, name,
+				tbl.expected)
+		}
+	}
+}
+
+// Confirm syslog sinks frame messages for their transport and journald sinks
+// send datagrams
+func TestOpenSyslogSinks(t *testing.T) {
+	globals := config.GlobalOptions{MaxRetryCount: 1}
+	dir := t.TempDir()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on udp: %v", err)
+	}
+	defer udpConn.Close()
+	devLog, err := net.ListenPacket("unixgram", filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("Error listening on unixgram: %v", err)
+	}
+	defer devLog.Close()
+	journal, err := net.ListenPacket("unixgram", filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("Error listening on unixgram: %v", err)
+	}
+	defer journal.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on tcp: %v", err)
+	}
+	defer tcpListener.Close()
+
+	readPacket := func(conn net.PacketConn) chan string {
+		packets := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 4096)
+			n, _, _ := conn.ReadFrom(buf)
+			packets <- string(buf[:n])
+		}()
+		return packets
+	}
+	tcpMessages := make(chan string, 1)
+	go func() {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			tcpMessages <- err.Error()
+			return
+		}
+		defer conn.Close()
+		// Read a message using its octet count
+		reader := bufio.NewReader(conn)
+		length, _ := reader.ReadString(' ')
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			tcpMessages <- err.Error()
+			return
+		}
+		message := make([]byte, n)
+		io.ReadFull(reader, message)
+		tcpMessages <- string(message)
+	}()
+
+	tables := []struct {
+		sink     config.SinkConfig
+		messages chan string
+		check    func(string) bool
+	}{
+		{config.SinkConfig{Type: "syslog", Protocol: "udp",
+			Address: udpConn.LocalAddr().String(), Facility: "auth"},
+			readPacket(udpConn), func(m string) bool {
+				return strings.HasPrefix(m, "<38>1 ") && !strings.HasSuffix(m, "\n")
+			}},
+		{config.SinkConfig{Type: "syslog", Protocol: "unix",
+			Address: filepath.Join(dir, "log")},
+			readPacket(devLog), func(m string) bool {
+				return strings.HasPrefix(m, "<30>1 ") && !strings.HasSuffix(m, "\n")
+			}},
+		{config.SinkConfig{Type: "syslog", Protocol: "tcp",
+			Address: tcpListener.Addr().String()},
+			tcpMessages, func(m string) bool {
+				return strings.HasPrefix(m, "<30>1 ") && strings.HasSuffix(m, "uid=0")
+			}},
+		{config.SinkConfig{Type: "journald", Address: filepath.Join(dir, "journal")},
+			readPacket(journal), func(m string) bool {
+				return strings.Contains(m, "\nCOMM=bash\n")
+			}},
+	}
+	for _, tbl := range tables {
+		sink, err := OpenSink(tbl.sink, globals)
+		if err != nil {
+			t.Errorf("Error opening %+v: %v", tbl.sink, err)
+			continue
+		}
+		output, err := sink.formatter.Format(syslogRecord())
+		if err != nil {
+			t.Fatalf("Error formatting for %+v: %v", tbl.sink, err)
+		}
+		if err := sink.Write(output); err != nil {
+			t.Errorf("Error writing to %+v: %v", tbl.sink, err)
+		}
+		select {
+		case message := <-tbl.messages:
+			if !tbl.check(message) {
+				t.Errorf("Sink %+v got message %q", tbl.sink, message)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Sink %+v did not receive a message", tbl.sink)
+		}
+		sink.Close()
+	}
+
+}
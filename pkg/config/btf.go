@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// Map and type layouts read from the BTF of a compiled eBPF object
+type btfSource struct {
+	path string
+	spec *btf.Spec
+}
+
+// Load BTF type info from an ELF object, as emitted by `clang -g -target bpf`
+func loadBTFSource(path string) (*btfSource, error) {
+	spec, err := btf.LoadSpec(path)
+	if err != nil {
+		return nil, fmt.Errorf("btf.go: Error loading BTF from %s: %s", path, err)
+	}
+	return &btfSource{path: path, spec: spec}, nil
+}
+
+// Look up a named type. Accepts C style `struct name` as well as bare names
+func (src *btfSource) typeByName(name string) (btf.Type, error) {
+	name = strings.TrimSpace(strings.TrimPrefix(name, "struct "))
+	typ, err := src.spec.AnyTypeByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("btf.go: Error finding type %s in %s: %s", name,
+			src.path, err)
+	}
+	return typ, nil
+}
+
+// Find a libbpf style map definition in the .maps section. Returns the map
+// type and the key and value types it was declared with, which may be nil
+func (src *btfSource) mapDefinition(name string) (ebpf.MapType, btf.Type,
+	btf.Type, bool) {
+
+	var maps *btf.Datasec
+	if err := src.spec.TypeByName(".maps", &maps); err != nil {
+		return 0, nil, nil, false
+	}
+	for _, secinfo := range maps.Vars {
+		mapVar, ok := secinfo.Type.(*btf.Var)
+		if !ok || mapVar.Name != name {
+			continue
+		}
+		def, ok := btf.UnderlyingType(mapVar.Type).(*btf.Struct)
+		if !ok {
+			return 0, nil, nil, false
+		}
+
+		var mapType ebpf.MapType
+		var key, value btf.Type
+		for _, member := range def.Members {
+			pointer, ok := member.Type.(*btf.Pointer)
+			if !ok {
+				continue
+			}
+			switch member.Name {
+			case "type":
+				// __uint() encodes the value as the length of an array
+				if arr, ok := pointer.Target.(*btf.Array); ok {
+					mapType = ebpf.MapType(arr.Nelems)
+				}
+			case "key":
+				key = pointer.Target
+			case "value":
+				value = pointer.Target
+			}
+		}
+		return mapType, key, value, true
+	}
+	return 0, nil, nil, false
+}
+
+// Derive the output type, key layout and value layout of an output. Types
+// named in the output config win over the map definition
+func (src *btfSource) outputLayout(output *BPFOutput) (*sourceLayout, error) {
+	mapType, keyType, valueType, found := src.mapDefinition(output.Id)
+
+	var err error
+	if output.BTFType != "" {
+		valueType, err = src.typeByName(output.BTFType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if output.BTFKeyType != "" {
+		keyType, err = src.typeByName(output.BTFKeyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found && valueType == nil {
+		return nil, fmt.Errorf(
+			"btf.go: Map %s is not defined in %s and no btfType is set", output.Id,
+			src.path)
+	}
+
+	layout := &sourceLayout{outputType: "BPF_PERF_OUTPUT"}
+	switch {
+	case mapType == ebpf.PerfEventArray:
+		// Perf maps hold file descriptors, the data type has to be named
+		if output.BTFType == "" {
+			return nil, fmt.Errorf(
+				"btf.go: Perf output %s needs btfType to name the submitted struct",
+				output.Id)
+		}
+		keyType = nil
+	case mapType == ebpf.Hash || mapType == ebpf.LRUHash:
+		layout.outputType = "BPF_HASH"
+	case found:
+		// Other maps can't be iterated like a hash
+		return nil, fmt.Errorf(
+			"btf.go: Map %s has type %s, only hash, LRU hash and perf event array maps can be read",
+			output.Id, mapType)
+	case keyType != nil:
+		layout.outputType = "BPF_HASH"
+	}
+
+	if valueType == nil {
+		return nil, fmt.Errorf("btf.go: Map %s has no value type", output.Id)
+	}
+	layout.value, err = btfLayout(valueType, "value")
+	if err != nil {
+		return nil, err
+	}
+	if keyType != nil {
+		layout.key, err = btfLayout(keyType, "hash_key")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return layout, nil
+}
+
+// Lay out a BTF type as a list of formats. Struct members are placed at their
+// real offsets, with the gaps between them and any tail padding made explicit.
+// Scalars become a single format with the given name
+func btfLayout(typ btf.Type, scalarName string) ([]BPFOutputFormat, error) {
+	st, isStruct := btf.UnderlyingType(typ).(*btf.Struct)
+	if !isStruct {
+		formatType, _, err := btfScalar(typ)
+		if err != nil {
+			return nil, err
+		}
+		return []BPFOutputFormat{{Name: scalarName, Type: formatType}}, nil
+	}
+
+	var formats []BPFOutputFormat
+	offset := 0
+	for _, member := range st.Members {
+		if member.BitfieldSize != 0 || member.Offset%8 != 0 {
+			return nil, fmt.Errorf("btf.go: Bitfield %s.%s is not supported",
+				st.Name, member.Name)
+		}
+		memberOffset := int(member.Offset.Bytes())
+		if memberOffset < offset {
+			return nil, fmt.Errorf("btf.go: Overlapping member %s.%s is not supported",
+				st.Name, member.Name)
+		}
+		if memberOffset > offset {
+			formats = append(formats, padFormat(memberOffset-offset))
+		}
+
+		formatType, size, err := btfScalar(member.Type)
+		if err != nil {
+			return nil, fmt.Errorf("btf.go: Error laying out %s.%s: %s", st.Name,
+				member.Name, err)
+		}
+		formats = append(formats, BPFOutputFormat{Name: member.Name,
+			Type: formatType})
+		offset = memberOffset + size
+	}
+	if int(st.Size) > offset {
+		formats = append(formats, padFormat(int(st.Size)-offset))
+	}
+	return formats, nil
+}
+
+// Resolve a BTF type to a greggd format type and its size in bytes
+func btfScalar(typ btf.Type) (string, int, error) {
+	switch t := btf.UnderlyingType(typ).(type) {
+	case *btf.Int:
+		return intFormatType(int(t.Size), t.Encoding == btf.Signed,
+			t.Encoding == btf.Char)
+	case *btf.Enum:
+		return intFormatType(int(t.Size), t.Signed, false)
+	case *btf.Pointer:
+		return "u64", 8, nil
+	case *btf.Array:
+		elemType, elemSize, err := btfScalar(t.Type)
+		if err != nil {
+			return "", 0, err
+		}
+		// Arrays are decoded as strings, so only allow byte elements
+		var dims string
+		switch {
+		case strings.HasPrefix(elemType, "char"):
+			dims = strings.TrimPrefix(elemType, "char")
+		case strings.HasPrefix(elemType, "u8"):
+			dims = strings.TrimPrefix(elemType, "u8")
+		default:
+			return "", 0, fmt.Errorf("btf.go: Arrays of %s are not supported",
+				elemType)
+		}
+		return fmt.Sprintf("char[%d]%s", t.Nelems, dims),
+			int(t.Nelems) * elemSize, nil
+	default:
+		return "", 0, fmt.Errorf("btf.go: Type %s is not supported", typ)
+	}
+}
+
+// Map an integer's size and signedness to a greggd format type
+func intFormatType(size int, signed bool, char bool) (string, int, error) {
+	switch {
+	case size == 1 && (signed || char):
+		return "char", 1, nil
+	case size == 1:
+		return "u8", 1, nil
+	case size == 2 && signed:
+		return "int16", 2, nil
+	case size == 2:
+		return "u16", 2, nil
+	case size == 4 && signed:
+		return "int32", 4, nil
+	case size == 4:
+		return "u32", 4, nil
+	case size == 8 && signed:
+		return "int64", 8, nil
+	case size == 8:
+		return "u64", 8, nil
+	}
+	return "", 0, fmt.Errorf("btf.go: Integers of %d bytes are not supported",
+		size)
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const btfFixture = "../../test/data/btf/maps.o"
+
+// Confirm layouts come from real BTF offsets, including padding
+func TestBTFOutputLayout(t *testing.T) {
+	src, err := loadBTFSource(btfFixture)
+	if err != nil {
+		t.Fatalf("Error loading BTF fixture: %v", err)
+	}
+
+	tables := []struct {
+		output        BPFOutput
+		expectedType  string
+		expectedKey   []BPFOutputFormat
+		expectedValue []BPFOutputFormat
+	}{
+		// Hash map with key and value from the .maps definition
+		{
+			BPFOutput{Id: "dist"}, "BPF_HASH",
+			[]BPFOutputFormat{{Name: "disk", Type: "char[32]"},
+				{Name: "slot", Type: "u64"}},
+			[]BPFOutputFormat{{Name: "value", Type: "u64"}},
+		},
+		// LRU hash maps are read like hashes
+		{
+			BPFOutput{Id: "lru_dist"}, "BPF_HASH",
+			[]BPFOutputFormat{{Name: "disk", Type: "char[32]"},
+				{Name: "slot", Type: "u64"}},
+			[]BPFOutputFormat{{Name: "value", Type: "u64"}},
+		},
+		// Perf output struct named in the config
+		{
+			BPFOutput{Id: "events", BTFType: "struct data_t"}, "BPF_PERF_OUTPUT",
+			nil,
+			[]BPFOutputFormat{{Name: "id", Type: "u64"}, {Name: "pid", Type: "u32"},
+				{Name: "uid", Type: "u32"}, {Name: "ret", Type: "int32"},
+				{Name: "comm", Type: "char[16]"}, {Name: "fname", Type: "char[255]"},
+				{Type: "pad[1]"}, {Name: "flags", Type: "int32"}},
+		},
+	}
+	for _, tbl := range tables {
+		layout, err := src.outputLayout(&tbl.output)
+		if err != nil {
+			t.Errorf("Error deriving layout of %s: %v", tbl.output.Id, err)
+			continue
+		}
+		if layout.outputType != tbl.expectedType {
+			t.Errorf("Output type of %s is %s, expected %s", tbl.output.Id,
+				layout.outputType, tbl.expectedType)
+		}
+		if !cmp.Equal(layout.key, tbl.expectedKey) {
+			t.Errorf("Key layout of %s does not match: %s", tbl.output.Id,
+				cmp.Diff(tbl.expectedKey, layout.key))
+		}
+		if !cmp.Equal(layout.value, tbl.expectedValue) {
+			t.Errorf("Value layout of %s does not match: %s", tbl.output.Id,
+				cmp.Diff(tbl.expectedValue, layout.value))
+		}
+	}
+
+	// Unknown maps and types error out, as do maps that can't be read
+	badOutputs := []BPFOutput{
+		{Id: "missing"},
+		{Id: "events", BTFType: "missing_t"},
+		{Id: "counts"},
+	}
+	for _, output := range badOutputs {
+		_, err := src.outputLayout(&output)
+		if err == nil {
+			t.Errorf("Invalid output did not throw error: %+v", output)
+		}
+	}
+	_, err = src.outputLayout(&BPFOutput{Id: "counts"})
+	if err == nil || !strings.Contains(err.Error(), "Array") {
+		t.Errorf("Error %v does not name the map type", err)
+	}
+}
+
+// Confirm ParseConfig prefers BTF over the C source when set
+func TestParseConfigBTFFormat(t *testing.T) {
+	testConfig, err := ParseConfig(strings.NewReader(`programs:
+  - source: fake.c
+    btf: ` + btfFixture + `
+    outputs:
+      - id: dist
+        poll: 1s
+        keyFormat: [{name: disk, isTag: true}]
+`))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	output := testConfig.Programs[0].Outputs[0]
+	expectedKey := []BPFOutputFormat{{Name: "disk", Type: "char[32]",
+		IsTag: true}, {Name: "slot", Type: "u64"}}
+	if output.Type != "BPF_HASH" {
+		t.Errorf("Output type not derived: %s", output.Type)
+	}
+	if !cmp.Equal(output.KeyFormat, expectedKey) {
+		t.Errorf("Derived key format does not match: %s",
+			cmp.Diff(expectedKey, output.KeyFormat))
+	}
+
+	_, err = ParseConfig(strings.NewReader(
+		`programs: [{btf: missing.o, outputs: [{id: dist}]}]`))
+	if err == nil {
+		t.Errorf("Missing BTF object did not throw error")
+	}
+}
+
+// Confirm precompiled objects are used as their own BTF source
+func TestParseConfigObjectFormat(t *testing.T) {
+	testConfig, err := ParseConfig(strings.NewReader(`programs:
+  - object: ` + btfFixture + `
+    outputs:
+      - id: dist
+        poll: 1s
+`))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	if len(testConfig.Programs[0].Outputs[0].KeyFormat) != 2 {
+		t.Errorf("Key format not derived from object: %+v",
+			testConfig.Programs[0].Outputs[0])
+	}
+
+	_, err = ParseConfig(strings.NewReader(`programs:
+  - source: fake.c
+    object: ` + btfFixture + `
+`))
+	if err == nil {
+		t.Errorf("Program with both source and object did not throw error")
+	}
+}
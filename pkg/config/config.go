@@ -2,26 +2,46 @@ package config
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/onsi/gomega/types"
 	"gopkg.in/yaml.v2"
 )
 
+// Filter actions. Records are dropped if any drop filter matches, and kept
+// only if every keep filter matches
+const (
+	FilterDrop = "drop"
+	FilterKeep = "keep"
+)
+
 type GreggdConfig struct {
 	// Store global options for development
-	Globals GlobalOptions
+	Globals GlobalOptions `yaml:"globals"`
 	// List of the eBPF programs managed by this app
-	Programs []BPFProgram
+	Programs []BPFProgram `yaml:"programs"`
+	// Problems found by ParseConfig that don't stop the config loading
+	Warnings []string `yaml:"-"`
 }
 
 type GlobalOptions struct {
-	// Socket we're writing data out to
+	// Socket we're writing data out to. Used when no sinks are set
 	SocketPath string `yaml:"socketPath"`
-	// Format for verbose output.
+	// Where records are written, and how they are encoded for each. Defaults to
+	// an influx sink on SocketPath
+	Sinks []SinkConfig `yaml:"sinks"`
+	// Encoding for verbose output, influx or json. Binary encodings can't be
+	// used
 	VerboseFormat string `yaml:"verboseFormat"`
 	// Log measurements to stdout. Overwritten by command line value if set
 	Verbose bool `yaml:"verbose"`
@@ -33,17 +53,85 @@ type GlobalOptions struct {
 	RetryDelay string `yaml:"retryDelay"`
 	// Compiled retry as time.Duration
 	CompiledRetryDelay time.Duration
+	// How often to recalibrate the offset between kernel monotonic time and
+	// wall-clock time. Set to 1m by default
+	ClockSyncInterval string `yaml:"clockSyncInterval"`
+	// Compiled clock sync interval as time.Duration
+	CompiledClockSyncInterval time.Duration
+	// Serve hash and histogram outputs as Prometheus metrics
+	Prometheus PrometheusConfig `yaml:"prometheus"`
+	// Tags added to every record, e.g. cluster or rack. Values can reference
+	// environment variables as $VAR or ${VAR}
+	Tags map[string]string `yaml:"tags"`
+	// Metadata of this host added to every record as tags, from HostTagNames.
+	// Defaults to host
+	HostTags []string `yaml:"hostTags"`
+	// Prefix of every measurement name, e.g. greggd_
+	MeasurementPrefix string `yaml:"measurementPrefix"`
+	// How outputs are split into measurements, from MeasurementModes. single
+	// (the default) writes every output to bpf, told apart by the sensor tag.
+	// sensor writes the outputs of each program to a measurement named by the
+	// program or sensor
+	MeasurementMode string `yaml:"measurementMode"`
+}
+
+type PrometheusConfig struct {
+	// Address to serve /metrics on, e.g. `:9464`. Metrics aren't served when
+	// empty
+	Listen string `yaml:"listen"`
+}
+
+type SinkConfig struct {
+	// How to reach the sink: unix, tcp, udp, stdout, otlp, syslog or journald
+	Type string `yaml:"type"`
+	// Socket path for unix sinks, host:port for tcp, udp and otlp sinks. OTLP
+	// over HTTP also takes a URL. Syslog sinks default to /dev/log and journald
+	// sinks to the journal's socket
+	Address string `yaml:"address"`
+	// How records are encoded for the sink, one of Encodings. Defaults to
+	// influx. OTLP, syslog and journald sinks encode their own
+	Encoding string `yaml:"encoding"`
+	// Transport of OTLP sinks, grpc (the default) or http, and of syslog sinks,
+	// unix (the default), udp or tcp
+	Protocol string `yaml:"protocol"`
+	// Syslog facility, e.g. auth or local0. Defaults to daemon
+	Facility string `yaml:"facility"`
+	// Naming template for graphite and statsd encodings, e.g.
+	// `greggd.{host}.{sensor}.{disk}.{slot}.{field}`. Defaults to
+	// DefaultMetricTemplate
+	Template string `yaml:"template"`
 }
 
 type BPFProgram struct {
+	// Sensor from the bundled library to start from, e.g. `opensnoop`. Other
+	// settings of the program override the sensor's
+	Sensor string `yaml:"sensor"`
 	// Source of the eBPF program to load in. Will be compilied by BCC into eBPF
 	// byte code. Should point to a .c file
 	Source string `yaml:"source"`
+	// Precompiled eBPF ELF object to load instead of compiling Source with BCC.
+	// Should be a CO-RE object built with BTF
+	Object string `yaml:"object"`
+	// Extra flags passed to BCC when compiling Source
+	CFlags []string `yaml:"cflags"`
+	// Values passed to BCC as -D flags, e.g. `TARGET_UID: 1000`, so programs
+	// can filter in the kernel
+	Defines map[string]string `yaml:"defines"`
+	// Render Source as a text/template with Defines as its data, e.g.
+	// `{{ .TARGET_UID }}`, before compiling it
+	TemplateSource bool `yaml:"templateSource"`
+	// ELF object with BTF type info for this program. When set, output formats
+	// left out of the config are derived from it instead of the source
+	BTF string `yaml:"btf"`
 	// Events to trace with this eBPF program
 	Events []BPFEvent `yaml:"events"`
 	// Maps/tables to poll for this program. Should have the output data from the
 	// tracing program
 	Outputs []BPFOutput `yaml:"outputs"`
+	// Source file in the sensor library, used when Source isn't set
+	LibrarySource string `yaml:"-"`
+	// Flags the outputs set when the program overrides a sensor, by output
+	OutputOverrides []OutputOverride `yaml:"-"`
 }
 
 type BPFEvent struct {
@@ -66,8 +154,49 @@ type BPFOutput struct {
 	Clear bool `yaml:"clear"`
 	// Hash keys format
 	Key BPFOutputFormat `yaml:"key"`
+	// Format of hash keys that are structs. Used instead of Key when set
+	KeyFormat []BPFOutputFormat `yaml:"keyFormat"`
+	// BTF type names to derive the value and key formats from. Default to the
+	// types in the map's BTF definition
+	BTFType    string `yaml:"btfType"`
+	BTFKeyType string `yaml:"btfKeyType"`
 	// Format of the struct
 	Format []BPFOutputFormat `yaml:"format"`
+	// Expression evaluated against each whole decoded record, e.g.
+	// `uid == 0 && fname startsWith "/proc"`. Records it matches are dropped
+	Filter string `yaml:"filter"`
+	// What to do with records the filter matches, drop or keep. Defaults to
+	// drop
+	FilterAction string `yaml:"filterAction"`
+	// Filter expressions get compiled by ParseConfig
+	CompiledFilter *FilterExpression
+	// Encoding for this output's records on every sink, overriding the sinks'
+	// own encoding
+	Encoding string `yaml:"encoding"`
+	// How a hash or histogram output is exported as Prometheus metrics
+	Metric MetricConfig `yaml:"metric"`
+	// Go text/template rendering each record as a line, e.g.
+	// `Exec {{.comm}} by uid {{.uid}}: {{json .argv}}`. Sets the encoding to
+	// template
+	Template string `yaml:"template"`
+	// Templates get compiled by ParseConfig
+	CompiledTemplate *template.Template
+	// Measurement this output's records are written to, overriding
+	// globals.measurementMode
+	Measurement string `yaml:"measurement"`
+	// Measurement name with globals.measurementPrefix, set by ParseConfig
+	CompiledMeasurement string
+}
+
+type MetricConfig struct {
+	// Metric type: gauge, counter, histogram or none. Defaults to histogram for
+	// BPF_HISTOGRAM outputs and gauge for BPF_HASH outputs
+	Type string `yaml:"type"`
+	// Metric name, prefixed with greggd_. Defaults to the program name and the
+	// output id, e.g. biolatency_dist
+	Name string `yaml:"name"`
+	// Key field holding the log2 bucket of a histogram. Defaults to slot
+	Bucket string `yaml:"bucket"`
 }
 
 type BPFOutputFormat struct {
@@ -81,8 +210,17 @@ type BPFOutputFormat struct {
 	IsTag bool `yaml:"isTag"`
 	// Set if this field is an IP; assumed to be a tag
 	IsIP bool `yaml:"isIP"`
+	// Names for values of the field, e.g. `2: TCP_SYN_SENT`. Values with a
+	// name are written as the name
+	Enum map[int64]string `yaml:"enum"`
+	// Set if this field holds a bpf_ktime_get_ns() value. Converted to
+	// wall-clock time and used as the record timestamp instead of a field
+	Timestamp bool `yaml:"timestamp"`
 	// Filter to apply to values
 	Filter interface{} `yaml:"filter"`
+	// What to do with records the filter matches. Either drop (the default) or
+	// keep, which drops records the filter doesn't match
+	FilterAction string `yaml:"filterAction"`
 	// Filters get compiled by ParseConfig and iterated over to check
 	CompiledFilter types.GomegaMatcher
 	// Types get compiled by ParseConfig and iterated over to check
@@ -97,77 +235,843 @@ func ParseConfig(input io.Reader) (*GreggdConfig, error) {
 			err)
 	}
 
-	// Set config defaults
-	configStruct := GreggdConfig{
+	configStruct := defaultConfig()
+	err = yaml.Unmarshal(buf.Bytes(), &configStruct)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config.go: Error unmarshalling config into struct:\n%s", err)
+	}
+
+	for _, problem := range loadConfig(&configStruct) {
+		if !problem.warning {
+			return nil, problem.err
+		}
+		configStruct.Warnings = append(configStruct.Warnings,
+			problem.err.Error())
+	}
+	return &configStruct, nil
+}
+
+// Config holding the global defaults, for a config file to be decoded over
+func defaultConfig() GreggdConfig {
+	return GreggdConfig{
 		Globals: GlobalOptions{
 			MaxRetryCount:           8,
 			RetryExponentialBackoff: true,
 			RetryDelay:              "100ms",
+			ClockSyncInterval:       "1m",
+			HostTags:                []string{"host"},
 		},
 	}
+}
 
-	err = yaml.Unmarshal(buf.Bytes(), &configStruct)
+// Problem found while loading a config, with the path to the offending value,
+// e.g. programs[0].outputs[1].poll
+type configProblem struct {
+	path string
+	err  error
+	// Set for problems that don't stop the config loading
+	warning bool
+	// Set for warnings Validate reports as errors
+	strict bool
+}
+
+// Checks a decoded config and fills in everything derived from it
+type configLoader struct {
+	config   *GreggdConfig
+	problems []configProblem
+	schemas  map[string]FieldSchema
+	// Tags globals add to every record
+	globalTags []string
+	// Outputs by the metric name they export
+	metricOutputs map[string]string
+	// Programs by the ids of their outputs
+	outputPrograms map[string]string
+	// Programs by the measurement measurementMode sensor names for them
+	measurementPrograms map[string]string
+}
+
+// Apply sensors and defaults to a decoded config, derive missing formats and
+// check and compile every value. Loading carries on past errors, so every
+// problem is returned in the order it was found
+func loadConfig(configStruct *GreggdConfig) []configProblem {
+	l := &configLoader{config: configStruct,
+		metricOutputs:       make(map[string]string),
+		outputPrograms:      make(map[string]string),
+		measurementPrograms: make(map[string]string)}
+	var err error
+	l.schemas, err = FieldSchemas()
 	if err != nil {
-		return nil, fmt.Errorf(
-			"config.go: Error unmarshalling config into struct:\n%s", err)
+		l.report("", err)
 	}
-
-	// Set default for key type
+	l.loadGlobals()
 	for iProg := range configStruct.Programs {
-		prog := &configStruct.Programs[iProg]
-		for iOutput := range prog.Outputs {
-			output := &prog.Outputs[iOutput]
-			if output.Key.Type == "" {
-				output.Key.Type = "u32"
-			}
-			if output.Key.Name == "" {
-				output.Key.Name = "hash_key"
-			}
+		l.loadProgram(&configStruct.Programs[iProg],
+			fmt.Sprintf("programs[%d]", iProg))
+	}
+	return l.problems
+}
+
+func (l *configLoader) report(path string, err error) {
+	l.problems = append(l.problems, configProblem{path: path, err: err})
+}
+
+func (l *configLoader) warn(path string, warning string) {
+	l.problems = append(l.problems, configProblem{path: path,
+		err: errors.New(warning), warning: true})
+}
+
+func (l *configLoader) loadGlobals() {
+	globals := &l.config.Globals
+	var err error
+	globals.CompiledRetryDelay, err = time.ParseDuration(globals.RetryDelay)
+	if err != nil {
+		l.report("globals.retryDelay",
+			fmt.Errorf("config.go: Error parsing retry duration:\n%s", err))
+	}
+	globals.CompiledClockSyncInterval, err =
+		parseInterval(globals.ClockSyncInterval)
+	if err != nil {
+		l.report("globals.clockSyncInterval",
+			fmt.Errorf("config.go: Error parsing clock sync interval:\n%s", err))
+	}
+
+	// Without sinks, write influx to the socket path. A socket path of "-"
+	// writes to stdout
+	for iSink := range globals.Sinks {
+		sink := &globals.Sinks[iSink]
+		err = checkSink(*sink)
+		if err != nil {
+			l.report(fmt.Sprintf("globals.sinks[%d]", iSink), err)
+			continue
 		}
+		applySinkDefaults(sink)
+	}
+	if len(globals.Sinks) == 0 {
+		globals.Sinks = []SinkConfig{SocketSink(globals.SocketPath)}
 	}
+	err = checkVerboseFormat(globals.VerboseFormat)
+	if err != nil {
+		l.report("globals.verboseFormat",
+			fmt.Errorf("config.go: Verbose format: %s", err))
+	}
+	err = checkGlobalTags(*globals)
+	if err != nil {
+		l.report("globals.tags", err)
+	}
+	for _, warning := range expandGlobalTags(globals) {
+		l.warn("globals.tags", warning)
+	}
+	l.globalTags = GlobalTagNames(*globals)
+	err = checkMeasurementMode(globals.MeasurementMode)
+	if err != nil {
+		l.report("globals.measurementMode", err)
+	}
+}
 
-	// Compile time
-	configStruct.Globals.CompiledRetryDelay, err =
-		time.ParseDuration(configStruct.Globals.RetryDelay)
+// Start a sensor program from the library, fill in formats left out of the
+// config from its source and check its events and outputs
+func (l *configLoader) loadProgram(prog *BPFProgram, progPath string) {
+	written := writtenOutputs(prog, progPath)
+	err := applySensor(prog)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"config.go: Error parsing retry duration:\n%s", err)
+		l.report(progPath+".sensor", err)
+		return
+	}
+	switch {
+	case prog.Source != "" && prog.Object != "":
+		l.report(progPath+".object", fmt.Errorf(
+			"config.go: Program %s sets both source and object %s", prog.Source,
+			prog.Object))
+		return
+	case prog.Source == "" && prog.Object == "" && prog.LibrarySource == "":
+		l.report(progPath, errors.New(
+			"config.go: Program needs a source, an object or a sensor"))
+		return
+	case prog.Object != "" && (len(prog.CFlags) != 0 || len(prog.Defines) != 0 ||
+		prog.TemplateSource):
+		l.report(progPath+".object", fmt.Errorf(
+			"config.go: Program %s is precompiled, cflags, defines and templateSource only apply to sources",
+			prog.Object))
+	}
+	err = deriveProgramFormats(prog)
+	if err != nil {
+		l.report(progPath, fmt.Errorf(
+			"config.go: Error deriving formats from source:\n%s", err))
 	}
 
-	// Compile filters into go mega filters. Need to edit the struct for each
-	// filter. Iterate down to formats, using pointers to each item. Add compiled
-	// filter to format
-	for iProg := range configStruct.Programs {
-		prog := &configStruct.Programs[iProg]
-		for iOutput := range prog.Outputs {
-			output := &prog.Outputs[iOutput]
-			for iFormat := range output.Format {
-				format := &output.Format[iFormat]
-				// If there's no format filter, skip
-				if format.Filter == nil {
-					continue
-				}
-				compiledFilter, err := compileGomegaMatcher(format.Filter)
-				if err != nil {
-					return nil, fmt.Errorf(
-						"config.go: Error compiling filter %v for %s: %s\n", format.Filter,
-						prog.Source, err)
+	for iEvent, event := range prog.Events {
+		eventPath := fmt.Sprintf("%s.events[%d]", progPath, iEvent)
+		if event.AttachTo == "" {
+			l.report(eventPath, fmt.Errorf(
+				"config.go: Event in program %s is missing attachTo", prog.Name()))
+		}
+		if !containsFold(EventTypes, event.Type) {
+			l.report(eventPath+".type", fmt.Errorf(
+				"config.go: Unknown event type %q, expected one of %s", event.Type,
+				strings.Join(EventTypes, ", ")))
+		}
+	}
+
+	for iOutput := range prog.Outputs {
+		output := &prog.Outputs[iOutput]
+		var w writtenOutput
+		if prog.Sensor == "" {
+			w = written[iOutput]
+		} else {
+			// Sensor outputs the config leaves alone are reported at the sensor
+			w = writtenOutput{
+				path:    fmt.Sprintf("%s.sensor.outputs[%d]", progPath, iOutput),
+				derived: true}
+			for _, override := range written {
+				if override.id == output.Id {
+					w = override
 				}
-				format.CompiledFilter = compiledFilter
 			}
 		}
+		l.loadOutput(prog, output, w)
 	}
+}
 
-	return &configStruct, nil
+// Where an output was written in the config. Sensors and derivation rebuild
+// the formats of an output, so their fields are found by name
+type writtenOutput struct {
+	id   string
+	path string
+	// Set if the formats were rebuilt from a sensor or the source
+	derived bool
+	// Paths of the fields written in format and keyFormat, by name
+	format, keyFormat map[string]string
+}
+
+// Record where each output of a program and its fields were written, before
+// sensors and derivation rebuild them
+func writtenOutputs(prog *BPFProgram, progPath string) []writtenOutput {
+	written := make([]writtenOutput, len(prog.Outputs))
+	for iOutput := range prog.Outputs {
+		output := &prog.Outputs[iOutput]
+		outputPath := fmt.Sprintf("%s.outputs[%d]", progPath, iOutput)
+		written[iOutput] = writtenOutput{id: output.Id, path: outputPath,
+			derived:   prog.Sensor != "" || needsDerivedFormat(output),
+			format:    fieldPaths(output.Format, outputPath+".format"),
+			keyFormat: fieldPaths(output.KeyFormat, outputPath+".keyFormat")}
+	}
+	return written
+}
+
+func fieldPaths(formats []BPFOutputFormat, formatsPath string) map[string]string {
+	paths := make(map[string]string)
+	for iFormat, format := range formats {
+		if _, ok := paths[format.Name]; !ok && format.Name != "" {
+			paths[format.Name] = fmt.Sprintf("%s[%d]", formatsPath, iFormat)
+		}
+	}
+	return paths
+}
+
+// Check an output and compile its filters, template and measurement
+func (l *configLoader) loadOutput(prog *BPFProgram, output *BPFOutput,
+	written writtenOutput) {
+
+	outputPath := written.path
+
+	// Records are told apart by the id of their output
+	if output.Id == "" {
+		l.report(outputPath, fmt.Errorf(
+			"config.go: Output in program %s is missing id", prog.Name()))
+	} else if other, ok := l.outputPrograms[output.Id]; ok {
+		l.report(outputPath+".id", fmt.Errorf(
+			"config.go: Programs %s and %s both have an output %s, output ids must be unique",
+			other, prog.Name(), output.Id))
+	} else {
+		l.outputPrograms[output.Id] = prog.Name()
+	}
+	if !containsFold(OutputTypes, output.Type) {
+		l.report(outputPath+".type", fmt.Errorf(
+			"config.go: Unknown output type %q, expected one of %s", output.Type,
+			strings.Join(OutputTypes, ", ")))
+	}
+	if !strings.EqualFold(output.Type, "BPF_PERF_OUTPUT") {
+		if output.Poll == "" {
+			l.report(outputPath, fmt.Errorf(
+				"config.go: Output %s needs poll to be set", output.Id))
+		} else if _, err := parseInterval(output.Poll); err != nil {
+			l.report(outputPath+".poll", fmt.Errorf(
+				"config.go: Error parsing poll for output %s: %s", output.Id, err))
+		}
+	}
+
+	if output.Key.Type == "" {
+		output.Key.Type = "u32"
+	}
+	if output.Key.Name == "" {
+		output.Key.Name = "hash_key"
+	}
+	if IsPolledType(output.Type) && len(output.KeyFormat) == 0 {
+		l.checkFormatType(prog, output, &output.Key, outputPath+".key")
+	}
+	l.loadFormats(prog, output, output.KeyFormat, outputPath+".keyFormat",
+		written.derived, written.keyFormat)
+	l.loadFormats(prog, output, output.Format, outputPath+".format",
+		written.derived, written.format)
+	err := checkTimestampFields(output)
+	if err != nil {
+		l.report(outputPath+".format", err)
+	}
+
+	err = checkOutputEncoding(output)
+	if err != nil {
+		l.report(outputPath+".encoding", err)
+	} else if output.Template != "" {
+		output.Encoding = "template"
+		err = compileOutputTemplate(output, l.globalTags)
+		if err != nil {
+			l.report(outputPath+".template", err)
+		}
+	}
+	output.CompiledMeasurement = outputMeasurement(l.config.Globals, prog,
+		output)
+	if l.config.Globals.MeasurementMode == "sensor" && output.Measurement == "" {
+		// Programs that share a file name would share a measurement
+		measurement := ProgramMeasurement(prog)
+		if other, ok := l.measurementPrograms[measurement]; ok &&
+			other != prog.Name() {
+			l.report(outputPath, fmt.Errorf(
+				"config.go: Programs %s and %s both write to measurement %s, set measurement",
+				other, prog.Name(), measurement))
+		}
+		l.measurementPrograms[measurement] = prog.Name()
+	}
+
+	// Hash and histogram outputs are exported as metrics
+	applyMetricDefaults(prog, output)
+	err = checkMetric(output)
+	if err != nil {
+		l.report(outputPath+".metric", err)
+	} else if err = checkMetricTemplateBucket(l.config.Globals,
+		output); err != nil {
+		l.report(outputPath+".metric.bucket", err)
+	} else if l.config.Globals.Prometheus.Listen != "" && ExportsMetrics(output) {
+		if other, ok := l.metricOutputs[output.Metric.Name]; ok {
+			l.report(outputPath+".metric.name", fmt.Errorf(
+				"config.go: Outputs %s and %s both export metric %s, set metric.name",
+				other, output.Id, output.Metric.Name))
+		}
+		l.metricOutputs[output.Metric.Name] = output.Id
+	}
+
+	// Record filters can see every field, so compile them once the formats are
+	// complete
+	err = checkFilterAction(output.FilterAction)
+	if err != nil {
+		l.report(outputPath+".filterAction",
+			fmt.Errorf("config.go: Output %s: %s", output.Id, err))
+	}
+	if output.Filter != "" {
+		output.CompiledFilter, err = CompileFilterExpression(output.Filter,
+			outputFields(output))
+		if err != nil {
+			l.report(outputPath+".filter", fmt.Errorf(
+				"config.go: Error compiling filter for output %s: %s", output.Id,
+				err))
+		}
+	}
+}
+
+// Check the fields of an output and compile their filters. Problems with
+// derived fields are reported at the entry written for the field, or the list
+// if there is none
+func (l *configLoader) loadFormats(prog *BPFProgram, output *BPFOutput,
+	formats []BPFOutputFormat, formatsPath string, derived bool,
+	written map[string]string) {
+
+	for iFormat := range formats {
+		format := &formats[iFormat]
+		formatPath := fmt.Sprintf("%s[%d]", formatsPath, iFormat)
+		if derived {
+			formatPath = formatsPath
+			if path, ok := written[format.Name]; ok {
+				formatPath = path
+			}
+		}
+		if format.Name == "" && !strings.HasPrefix(format.Type, "pad") {
+			l.report(formatPath, fmt.Errorf(
+				"config.go: Field in output %s is missing name", output.Id))
+		}
+		l.checkFormatType(prog, output, format, formatPath)
+		err := checkFilterAction(format.FilterAction)
+		if err != nil {
+			l.report(formatPath+".filterAction", fmt.Errorf(
+				"config.go: Field %s in output %s: %s", format.Name, output.Id, err))
+		}
+		// If there's no format filter, skip
+		if format.Filter == nil {
+			continue
+		}
+		format.CompiledFilter, err = compileFilter(prog, output, format)
+		if err != nil {
+			l.report(formatPath+".filter", err)
+			continue
+		}
+		for _, warning := range quotedFilterWarnings(prog, output, format) {
+			l.warn(formatPath+".filter", warning)
+		}
+	}
+}
+
+// Check a field has a type the decoder understands, and the type the schema
+// registry declares if it knows the field
+func (l *configLoader) checkFormatType(prog *BPFProgram, output *BPFOutput,
+	format *BPFOutputFormat, formatPath string) {
+
+	err := CheckFormatType(format.Type)
+	if err != nil {
+		l.report(formatPath+".type", fmt.Errorf(
+			"config.go: Field %s in output %s: %s", format.Name, output.Id, err))
+		return
+	}
+	err = checkFieldSchema(format, l.schemas)
+	if err != nil {
+		l.problems = append(l.problems, configProblem{path: formatPath + ".type",
+			err: fmt.Errorf("config.go: Program %s, output %s: %s", prog.Name(),
+				output.Id, err),
+			warning: true, strict: true})
+	}
+}
+
+// Timestamp fields are read as raw kernel time, so they must be u64 and there
+// can only be one per output
+func checkTimestampFields(output *BPFOutput) error {
+	timestampCount := 0
+	for _, format := range output.Format {
+		if !format.Timestamp {
+			continue
+		}
+		timestampCount++
+		if format.Type != "u64" {
+			return fmt.Errorf(
+				"config.go: Timestamp field %s in output %s must be type u64, not %s",
+				format.Name, output.Id, format.Type)
+		}
+	}
+	if timestampCount > 1 {
+		return fmt.Errorf(
+			"config.go: Output %s has %d timestamp fields, expected at most 1",
+			output.Id, timestampCount)
+	}
+	return nil
+}
+
+// Whether an output is read by polling a hash map rather than as perf events
+func IsPolledType(outputType string) bool {
+	return strings.EqualFold(outputType, "BPF_HASH") ||
+		strings.EqualFold(outputType, "BPF_HISTOGRAM")
+}
+
+// Whether an output's records are exported as Prometheus metrics
+func ExportsMetrics(output *BPFOutput) bool {
+	return output.Metric.Type != "" && output.Metric.Type != "none"
+}
+
+// Fill in the metric type, name and bucket of hash and histogram outputs
+func applyMetricDefaults(prog *BPFProgram, output *BPFOutput) {
+	if !IsPolledType(output.Type) {
+		return
+	}
+	metric := &output.Metric
+	if metric.Type == "" {
+		metric.Type = "gauge"
+		if strings.EqualFold(output.Type, "BPF_HISTOGRAM") {
+			metric.Type = "histogram"
+		}
+	}
+	if metric.Name == "" {
+		metric.Name = ProgramMeasurement(prog) + "_" + output.Id
+	}
+	if metric.Type == "histogram" && metric.Bucket == "" {
+		metric.Bucket = "slot"
+	}
+}
+
+// Check an output's metric type is known and fits the output. Histograms
+// need a bucket key field and a single value field
+func checkMetric(output *BPFOutput) error {
+	metric := output.Metric
+	if metric.Type == "" {
+		return nil
+	}
+	if !contains(MetricTypes, metric.Type) {
+		return fmt.Errorf(
+			"config.go: Output %s has unknown metric type %q, expected one of %s",
+			output.Id, metric.Type, strings.Join(MetricTypes, ", "))
+	}
+	if !IsPolledType(output.Type) && metric.Type != "none" {
+		return fmt.Errorf(
+			"config.go: Output %s is %s, only hash and histogram outputs export metrics",
+			output.Id, output.Type)
+	}
+	if metric.Type != "histogram" {
+		return nil
+	}
+	keys := []string{output.Key.Name}
+	if len(output.KeyFormat) != 0 {
+		keys = nil
+		for _, format := range output.KeyFormat {
+			keys = append(keys, format.Name)
+		}
+	}
+	if !contains(keys, metric.Bucket) {
+		return fmt.Errorf(
+			"config.go: Histogram output %s has no key field %s to use as the bucket",
+			output.Id, metric.Bucket)
+	}
+	values := 0
+	for _, format := range output.Format {
+		if format.Name != "" {
+			values++
+		}
+	}
+	if values != 1 {
+		return fmt.Errorf(
+			"config.go: Histogram output %s needs one value field, not %d",
+			output.Id, values)
+	}
+	return nil
+}
+
+// Sink writing influx to a unix socket, or to stdout for a path of "-"
+func SocketSink(path string) SinkConfig {
+	if path == "-" {
+		return SinkConfig{Type: "stdout"}
+	}
+	return SinkConfig{Type: "unix", Address: path}
+}
+
+// Default socket journald reads native protocol messages from
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Check a sink has a known type and encoding, and an address if it needs one
+func checkSink(sink SinkConfig) error {
+	if !contains(SinkTypes, sink.Type) {
+		return fmt.Errorf("config.go: Unknown sink type %q, expected one of %s",
+			sink.Type, strings.Join(SinkTypes, ", "))
+	}
+	hasDefaultAddress := sink.Type == "stdout" || sink.Type == "journald" ||
+		(sink.Type == "syslog" && (sink.Protocol == "" || sink.Protocol == "unix"))
+	if !hasDefaultAddress && sink.Address == "" {
+		return fmt.Errorf("config.go: Sink of type %s needs an address",
+			sink.Type)
+	}
+	if sink.Facility != "" && sink.Type != "syslog" {
+		return fmt.Errorf("config.go: Only syslog sinks take a facility, not %s",
+			sink.Type)
+	}
+	switch sink.Type {
+	case "otlp", "syslog", "journald":
+		if sink.Encoding != "" {
+			return fmt.Errorf("config.go: %s sink %s can't set an encoding",
+				sink.Type, sink.Address)
+		}
+	}
+	switch sink.Type {
+	case "otlp":
+		if sink.Protocol != "" && !contains(OTLPProtocols, sink.Protocol) {
+			return fmt.Errorf(
+				"config.go: OTLP sink %s has unknown protocol %q, expected one of %s",
+				sink.Address, sink.Protocol, strings.Join(OTLPProtocols, ", "))
+		}
+		return nil
+	case "syslog":
+		if sink.Protocol != "" && !contains(SyslogProtocols, sink.Protocol) {
+			return fmt.Errorf(
+				"config.go: Syslog sink %s has unknown protocol %q, expected one of %s",
+				sink.Address, sink.Protocol, strings.Join(SyslogProtocols, ", "))
+		}
+		if _, ok := SyslogFacility(sink.Facility); !ok {
+			return fmt.Errorf("config.go: Syslog sink %s has unknown facility %q",
+				sink.Address, sink.Facility)
+		}
+		return nil
+	case "journald":
+		return nil
+	}
+	if sink.Protocol != "" {
+		return fmt.Errorf(
+			"config.go: Only OTLP and syslog sinks take a protocol, not %s",
+			sink.Type)
+	}
+	err := checkEncoding(sink.Encoding)
+	if err != nil {
+		return fmt.Errorf("config.go: Sink %s %s: %s", sink.Type, sink.Address,
+			err)
+	}
+	if sink.Encoding == "template" {
+		return fmt.Errorf(
+			"config.go: Sink %s %s can't use the template encoding, set template on outputs",
+			sink.Type, sink.Address)
+	}
+	if sink.Template != "" {
+		if sink.Encoding != "graphite" && sink.Encoding != "statsd" {
+			return fmt.Errorf(
+				"config.go: Sink %s %s has a template but isn't graphite or statsd",
+				sink.Type, sink.Address)
+		}
+		err = CheckMetricTemplate(sink.Template)
+		if err != nil {
+			return fmt.Errorf("config.go: Sink %s %s: %s", sink.Type, sink.Address,
+				err)
+		}
+	}
+	return nil
+}
+
+// Naming template graphite and statsd encodings use by default. {tags} keeps
+// records apart by their tags and key fields, such as histogram buckets
+const DefaultMetricTemplate = "greggd.{host}.{sensor}.{tags}.{field}"
+
+// Matches placeholders in metric templates, capturing the name
+var MetricTemplatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Check a metric template has balanced, named placeholders and names each
+// field apart with {field}
+func CheckMetricTemplate(template string) error {
+	names := MetricTemplatePlaceholder.FindAllStringSubmatch(template, -1)
+	rest := MetricTemplatePlaceholder.ReplaceAllString(template, "")
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("config.go: Template %q has unbalanced braces",
+			template)
+	}
+	hasField := false
+	for _, name := range names {
+		if name[1] == "" {
+			return fmt.Errorf("config.go: Template %q has an empty placeholder",
+				template)
+		}
+		hasField = hasField || name[1] == "field"
+	}
+	if !hasField {
+		return fmt.Errorf("config.go: Template %q needs a {field} placeholder",
+			template)
+	}
+	return nil
+}
+
+// Check every graphite and statsd sink writing a histogram output names its
+// bucket, else the buckets of a key would all write to one path
+func checkMetricTemplateBucket(globals GlobalOptions, output *BPFOutput) error {
+	if output.Metric.Type != "histogram" || output.Encoding != "" {
+		return nil
+	}
+	for _, sink := range globals.Sinks {
+		if sink.Template == "" ||
+			strings.Contains(sink.Template, "{tags}") ||
+			strings.Contains(sink.Template, "{"+output.Metric.Bucket+"}") {
+			continue
+		}
+		return fmt.Errorf(
+			"config.go: Sink %s %s template %q leaves out bucket %s of histogram output %s, add {%s} or {tags}",
+			sink.Type, sink.Address, sink.Template, output.Metric.Bucket, output.Id,
+			output.Metric.Bucket)
+	}
+	return nil
+}
+
+// Fill in the default transport and address of syslog and journald sinks
+func applySinkDefaults(sink *SinkConfig) {
+	switch sink.Type {
+	case "syslog":
+		if sink.Protocol == "" {
+			sink.Protocol = "unix"
+		}
+		if sink.Protocol == "unix" && sink.Address == "" {
+			sink.Address = "/dev/log"
+		}
+	case "journald":
+		if sink.Address == "" {
+			sink.Address = JournalSocket
+		}
+	}
+}
+
+// Code of a syslog facility name. Empty means daemon
+func SyslogFacility(name string) (int, bool) {
+	if name == "" {
+		name = "daemon"
+	}
+	for code, facility := range SyslogFacilities {
+		if facility == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// Check an output's encoding is known and that template encodings have a
+// template, which only they use
+func checkOutputEncoding(output *BPFOutput) error {
+	err := checkEncoding(output.Encoding)
+	if err != nil {
+		return fmt.Errorf("config.go: Output %s: %s", output.Id, err)
+	}
+	if output.Encoding == "template" && output.Template == "" {
+		return fmt.Errorf("config.go: Output %s uses the template encoding without a template",
+			output.Id)
+	}
+	if output.Template != "" && output.Encoding != "" &&
+		output.Encoding != "template" {
+		return fmt.Errorf("config.go: Output %s has a template but uses encoding %s",
+			output.Id, output.Encoding)
+	}
+	return nil
+}
+
+// Check global tags have names and don't clash with the sensor tag or host
+// tags, and that host tags are known
+func checkGlobalTags(globals GlobalOptions) error {
+	for _, name := range globals.HostTags {
+		if !contains(HostTagNames, name) {
+			return fmt.Errorf("config.go: Unknown host tag %q, expected one of %s",
+				name, strings.Join(HostTagNames, ", "))
+		}
+	}
+	for name := range globals.Tags {
+		switch {
+		case name == "":
+			return fmt.Errorf("config.go: Global tags need a name")
+		case name == "sensor":
+			return fmt.Errorf("config.go: Global tag sensor is set by each output")
+		case contains(globals.HostTags, name):
+			return fmt.Errorf("config.go: Global tag %s is also a host tag", name)
+		}
+	}
+	return nil
+}
+
+// Expand environment variables in global tag values. Returns a warning for
+// each variable that isn't set
+func expandGlobalTags(globals *GlobalOptions) []string {
+	var warnings []string
+	for name, value := range globals.Tags {
+		globals.Tags[name] = os.Expand(value, func(variable string) string {
+			expanded, ok := os.LookupEnv(variable)
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf(
+					"config.go: Global tag %s uses $%s, which is not set", name,
+					variable))
+			}
+			return expanded
+		})
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// Parse a duration that is used as an interval, which has to be positive
+func parseInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("config.go: Interval %s is not positive", value)
+	}
+	return interval, nil
+}
+
+// Check a measurement mode is known. Empty means single
+func checkMeasurementMode(mode string) error {
+	if mode == "" || contains(MeasurementModes, mode) {
+		return nil
+	}
+	return fmt.Errorf("config.go: Unknown measurement mode %q, expected one of %s",
+		mode, strings.Join(MeasurementModes, ", "))
+}
+
+// Measurement an output's records are written to: its own measurement, its
+// program's in sensor mode or bpf, after the global prefix
+func outputMeasurement(globals GlobalOptions, prog *BPFProgram,
+	output *BPFOutput) string {
+
+	measurement := "bpf"
+	switch {
+	case output.Measurement != "":
+		measurement = output.Measurement
+	case globals.MeasurementMode == "sensor":
+		measurement = ProgramMeasurement(prog)
+	}
+	return globals.MeasurementPrefix + measurement
+}
+
+// Measurement measurementMode sensor writes a program's outputs to: the
+// sensor name, or the file name of the program without its extension
+func ProgramMeasurement(prog *BPFProgram) string {
+	name := filepath.Base(prog.Name())
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Names of the tags globals add to every record
+func GlobalTagNames(globals GlobalOptions) []string {
+	names := append([]string{}, globals.HostTags...)
+	for name := range globals.Tags {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Check verbose output can use an encoding. Templates belong to outputs, and
+// verbose output is printed as text
+func checkVerboseFormat(encoding string) error {
+	if encoding == "template" {
+		return fmt.Errorf("config.go: Verbose output can't use the template encoding")
+	}
+	if encoding == "msgpack" || encoding == "protobuf" {
+		return fmt.Errorf("config.go: Verbose output can't use the binary encoding %s",
+			encoding)
+	}
+	return checkEncoding(encoding)
+}
+
+// Check an encoding is one greggd can write. Empty means influx
+func checkEncoding(encoding string) error {
+	if encoding == "" || contains(Encodings, encoding) {
+		return nil
+	}
+	return fmt.Errorf("config.go: Unknown encoding %q, expected one of %s",
+		encoding, strings.Join(Encodings, ", "))
+}
+
+// Check a filter action is one greggd knows. Empty means drop
+func checkFilterAction(action string) error {
+	switch action {
+	case "", FilterDrop, FilterKeep:
+		return nil
+	}
+	return fmt.Errorf("config.go: Unknown filterAction %q, expected %s or %s",
+		action, FilterDrop, FilterKeep)
+}
+
+// Whether a filter with this action drops the record, given whether the
+// filter matched it
+func FilterDrops(action string, matched bool) bool {
+	if action == FilterKeep {
+		return !matched
+	}
+	return matched
 }
 
 type SocketInput struct {
 	MeasurementName string
-	Fields          map[string]string
-	Tags            map[string]string
 	KeyData         []byte
 	KeyType         reflect.Type
 	DataBytes       []byte
 	DataType        reflect.Type
 	OutputConfig    *BPFOutput
+	// Name of the program or sensor the output belongs to
+	Program string
+	// When the tracer read this data out of the kernel. Used as the record
+	// timestamp if the output has no timestamp field
+	ReceiveTime time.Time
+	// When the poll this hash entry was read in started. Entries of one poll
+	// share it
+	PollTime time.Time
 }
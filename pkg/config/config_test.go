@@ -61,7 +61,7 @@ func TestParseConfigGlobalDefaults(t *testing.T) {
 // Confirm default values for key set
 func TestParseConfigProgramKeyDefaults(t *testing.T) {
 	emptyConfig := strings.NewReader(`globals: {}
-programs: [{source: fake, outputs: [type: fake]}]
+programs: [{source: fake, outputs: [{id: fake, type: BPF_HASH, poll: 1s}]}]
 `)
 	testConfig, err := ParseConfig(emptyConfig)
 	if err != nil {
@@ -102,17 +102,65 @@ func TestParseConfigRetryTimeCompile(t *testing.T) {
 	}
 }
 
+// Confirm clock sync interval compilation fails with bad value
+func TestParseConfigClockSyncCompileErr(t *testing.T) {
+	badConfig := strings.NewReader(`globals: {clockSyncInterval: fake}`)
+	_, err := ParseConfig(badConfig)
+	if err == nil {
+		t.Errorf("Invalid clock sync interval did not throw error: %v", err)
+	}
+
+	// The interval drives a ticker, so it has to be positive
+	for _, interval := range []string{"0s", "-1m"} {
+		input := "globals: {clockSyncInterval: " + interval + "}"
+		if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+			t.Errorf("Clock sync interval %s did not throw error", interval)
+		}
+		if errs := Validate(strings.NewReader(input)); len(errs) == 0 {
+			t.Errorf("Clock sync interval %s passed validation", interval)
+		}
+	}
+}
+
+// Confirm timestamp fields must be a single u64 per output
+func TestParseConfigTimestampField(t *testing.T) {
+	tables := []struct {
+		input     string
+		expectErr bool
+	}{
+		{`programs: [{source: test.c, outputs: [{id: a, type: BPF_PERF_OUTPUT, format: [
+  {name: ts, type: u64, timestamp: true}, {name: pid, type: u32}]}]}]`, false},
+		{`programs: [{source: test.c, outputs: [{id: a, type: BPF_PERF_OUTPUT, format: [
+  {name: ts, type: u32, timestamp: true}]}]}]`, true},
+		{`programs: [{source: test.c, outputs: [{id: a, type: BPF_PERF_OUTPUT, format: [
+  {name: ts, type: u64, timestamp: true},
+  {name: ts2, type: u64, timestamp: true}]}]}]`, true},
+	}
+	for _, tbl := range tables {
+		_, err := ParseConfig(strings.NewReader(tbl.input))
+		if tbl.expectErr && err == nil {
+			t.Errorf("Invalid timestamp config did not throw error: %s", tbl.input)
+		}
+		if !tbl.expectErr && err != nil {
+			t.Errorf("Error thrown when not expected: %v", err)
+		}
+	}
+}
+
 func TestParseConfigCompleteExample(t *testing.T) {
 	configFixture := &GreggdConfig{Globals: GlobalOptions{
 		SocketPath: "/run/greggd.sock", VerboseFormat: "influx", Verbose: true,
-		MaxRetryCount: 1, RetryDelay: "100ms", RetryExponentialBackoff: true},
+		MaxRetryCount: 1, RetryDelay: "100ms", RetryExponentialBackoff: true,
+		ClockSyncInterval: "1m", Sinks: []SinkConfig{{Type: "unix",
+			Address: "/run/greggd.sock"}}, HostTags: []string{"host"}},
 		Programs: []BPFProgram{{Source: "/usr/share/greggd/c/opensnoop.c",
 			Events: []BPFEvent{{Type: "kprobe", LoadFunc: "trace_entry",
 				AttachTo: "do_sys_open"}, {Type: "kretprobe", LoadFunc: "trace_return",
 				AttachTo: "do_sys_open"}}, Outputs: []BPFOutput{{
 				Type: "BPF_PERF_OUTPUT", Id: "opensnoop", Key: BPFOutputFormat{
 					Name: "hash_key", Type: "u32"}, Format: []BPFOutputFormat{
-					{Name: "id", Type: "u64"}, {Name: "fname", Type: "char[255]", IsTag: true}}}}},
+					{Name: "id", Type: "u64"}, {Name: "fname", Type: "char[255]", IsTag: true}},
+				CompiledMeasurement: "bpf"}}},
 		},
 	}
 	f, err := os.Open("../../test/data/example_config.yaml")
@@ -131,3 +179,336 @@ func TestParseConfigCompleteExample(t *testing.T) {
 		t.Errorf("Fixture and expected config do not match")
 	}
 }
+
+// Confirm sinks default to the socket path and unknown sinks and encodings
+// are rejected
+func TestParseConfigSinks(t *testing.T) {
+	tables := []struct {
+		globals   string
+		expected  []SinkConfig
+		expectErr bool
+	}{
+		{"socketPath: /run/greggd.sock",
+			[]SinkConfig{{Type: "unix", Address: "/run/greggd.sock"}}, false},
+		{"socketPath: \"-\"", []SinkConfig{{Type: "stdout"}}, false},
+		{"sinks: [{type: tcp, address: \"localhost:8094\", encoding: json}, " +
+			"{type: stdout}]",
+			[]SinkConfig{{Type: "tcp", Address: "localhost:8094",
+				Encoding: "json"}, {Type: "stdout"}}, false},
+		{"sinks: [{type: http, address: \"localhost:80\"}]", nil, true},
+		{"sinks: [{type: udp}]", nil, true},
+		{"sinks: [{type: stdout, encoding: xml}]", nil, true},
+		{"verboseFormat: xml", nil, true},
+		{"verboseFormat: msgpack", nil, true},
+		{"sinks: [{type: udp, address: \"localhost:8094\", encoding: protobuf}]",
+			[]SinkConfig{{Type: "udp", Address: "localhost:8094",
+				Encoding: "protobuf"}}, false},
+		{"sinks: [{type: otlp, address: \"localhost:4318\", protocol: http}]",
+			[]SinkConfig{{Type: "otlp", Address: "localhost:4318",
+				Protocol: "http"}}, false},
+		{"sinks: [{type: otlp, address: \"localhost:4317\", encoding: json}]",
+			nil, true},
+		{"sinks: [{type: otlp, address: \"localhost:4317\", protocol: thrift}]",
+			nil, true},
+		{"sinks: [{type: tcp, address: \"localhost:4317\", protocol: grpc}]",
+			nil, true},
+		{"sinks: [{type: syslog, facility: auth}, {type: journald}]",
+			[]SinkConfig{{Type: "syslog", Address: "/dev/log", Protocol: "unix",
+				Facility: "auth"}, {Type: "journald", Address: JournalSocket}}, false},
+		{"sinks: [{type: syslog, protocol: tcp, address: \"siem:6514\"}]",
+			[]SinkConfig{{Type: "syslog", Address: "siem:6514",
+				Protocol: "tcp"}}, false},
+		{"sinks: [{type: syslog, protocol: udp}]", nil, true},
+		{"sinks: [{type: syslog, facility: web}]", nil, true},
+		{"sinks: [{type: journald, encoding: json}]", nil, true},
+		{"sinks: [{type: tcp, address: \"localhost:514\", facility: auth}]",
+			nil, true},
+		{"sinks: [{type: udp, address: \"localhost:8125\", encoding: statsd, " +
+			"template: \"greggd.{sensor}.{disk}.{field}\"}]",
+			[]SinkConfig{{Type: "udp", Address: "localhost:8125",
+				Encoding: "statsd", Template: "greggd.{sensor}.{disk}.{field}"}},
+			false},
+		{"sinks: [{type: tcp, address: \"localhost:2003\", encoding: graphite, " +
+			"template: \"greggd.{sensor}\"}]", nil, true},
+		{"sinks: [{type: tcp, address: \"localhost:2003\", encoding: graphite, " +
+			"template: \"greggd.{sensor.{field}\"}]", nil, true},
+		{"sinks: [{type: tcp, address: \"localhost:2003\", encoding: json, " +
+			"template: \"greggd.{field}\"}]", nil, true},
+	}
+	for _, tbl := range tables {
+		input := "globals:\n  " + tbl.globals + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Globals %s returned error %v", tbl.globals, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(config.Globals.Sinks, tbl.expected) {
+			t.Errorf("Globals %s gave sinks %v, expected %v", tbl.globals,
+				config.Globals.Sinks, tbl.expected)
+		}
+		if errs := Validate(strings.NewReader(input)); (len(errs) != 0) !=
+			tbl.expectErr {
+			t.Errorf("Globals %s validated with errors %v", tbl.globals, errs)
+		}
+	}
+
+	input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        encoding: yaml
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Unknown output encoding did not throw error")
+	}
+}
+
+// Confirm hash and histogram outputs get metric defaults and bad metric
+// settings are rejected
+func TestParseConfigMetrics(t *testing.T) {
+	tables := []struct {
+		output    string
+		expected  MetricConfig
+		expectErr bool
+	}{
+		{"{id: counts, type: BPF_HASH, poll: 1s, format: [{name: count, type: u64}]}",
+			MetricConfig{Type: "gauge", Name: "test_counts"}, false},
+		{"{id: dist, type: BPF_HISTOGRAM, poll: 1s, key: {name: slot, type: u64}, " +
+			"format: [{name: count, type: u64}]}",
+			MetricConfig{Type: "histogram", Name: "test_dist", Bucket: "slot"}, false},
+		{"{id: counts, type: BPF_HASH, poll: 1s, metric: {type: counter, name: calls}, " +
+			"format: [{name: count, type: u64}]}",
+			MetricConfig{Type: "counter", Name: "calls"}, false},
+		{"{id: events, type: BPF_PERF_OUTPUT, format: [{name: pid, type: u32}]}",
+			MetricConfig{}, false},
+		{"{id: counts, type: BPF_HASH, poll: 1s, metric: {type: summary}, " +
+			"format: [{name: count, type: u64}]}", MetricConfig{}, true},
+		{"{id: events, type: BPF_PERF_OUTPUT, metric: {type: gauge}, " +
+			"format: [{name: pid, type: u32}]}", MetricConfig{}, true},
+		{"{id: dist, type: BPF_HISTOGRAM, poll: 1s, key: {name: bucket, type: u64}, " +
+			"format: [{name: count, type: u64}]}", MetricConfig{}, true},
+		{"{id: dist, type: BPF_HISTOGRAM, poll: 1s, key: {name: slot, type: u64}, " +
+			"format: [{name: count, type: u64}, {name: total, type: u64}]}",
+			MetricConfig{}, true},
+	}
+	for _, tbl := range tables {
+		input := "programs:\n  - source: test.c\n    outputs:\n      - " +
+			tbl.output + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Output %s returned error %v", tbl.output, err)
+			continue
+		}
+		if err == nil && config.Programs[0].Outputs[0].Metric != tbl.expected {
+			t.Errorf("Output %s has metric %+v, expected %+v", tbl.output,
+				config.Programs[0].Outputs[0].Metric, tbl.expected)
+		}
+	}
+
+	// Outputs can only share a metric name when metrics aren't served
+	input := `
+programs:
+  - source: test.c
+    outputs:
+      - {id: counts, type: BPF_HASH, poll: 1s, metric: {name: counts},
+         format: [{name: count, type: u64}]}
+  - source: test.c
+    outputs:
+      - {id: totals, type: BPF_HASH, poll: 1s, metric: {name: counts},
+         format: [{name: count, type: u64}]}
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err != nil {
+		t.Errorf("Shared metric name without prometheus threw error %v", err)
+	}
+	input = "globals:\n  prometheus:\n    listen: \":9464\"\n" + input
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Shared metric name with prometheus did not throw error")
+	}
+}
+
+// Confirm graphite and statsd templates must keep histogram buckets apart
+func TestParseConfigMetricTemplateBucket(t *testing.T) {
+	tables := []struct {
+		template  string
+		expectErr bool
+	}{
+		{"", false},
+		{"greggd.{host}.{sensor}.{slot}.{field}", false},
+		{"greggd.{host}.{tags}.{field}", false},
+		{"greggd.{host}.{sensor}.{field}", true},
+	}
+	for _, tbl := range tables {
+		input := fmt.Sprintf(`
+globals:
+  sinks:
+    - {type: udp, address: "localhost:8125", encoding: statsd, template: %q}
+programs:
+  - source: test.c
+    outputs:
+      - {id: dist, type: BPF_HISTOGRAM, poll: 1s, key: {name: slot, type: u64},
+         format: [{name: count, type: u64}]}
+`, tbl.template)
+		_, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Template %q returned error %v", tbl.template, err)
+		}
+	}
+}
+
+// Confirm global tags expand environment variables and can't clash with the
+// sensor or host tags
+func TestParseConfigGlobalTags(t *testing.T) {
+	t.Setenv("GREGGD_TEST_CLUSTER", "frontier")
+	tables := []struct {
+		globals   string
+		tags      map[string]string
+		hostTags  []string
+		warnings  int
+		expectErr bool
+	}{
+		{"verbose: false", nil, []string{"host"}, 0, false},
+		{"tags: {cluster: \"${GREGGD_TEST_CLUSTER}\", role: compute}",
+			map[string]string{"cluster": "frontier", "role": "compute"},
+			[]string{"host"}, 0, false},
+		{"tags: {rack: \"r$GREGGD_TEST_UNSET\"}\n  hostTags: []",
+			map[string]string{"rack": "r"}, []string{}, 1, false},
+		{"hostTags: [host, kernel_release, boot_id, machine_id]", nil,
+			[]string{"host", "kernel_release", "boot_id", "machine_id"}, 0, false},
+		{"hostTags: [rack]", nil, nil, 0, true},
+		{"tags: {sensor: test}", nil, nil, 0, true},
+		{"tags: {host: node1}", nil, nil, 0, true},
+	}
+	for _, tbl := range tables {
+		input := "globals:\n  " + tbl.globals + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Globals %s returned error %v", tbl.globals, err)
+			continue
+		}
+		errs := Validate(strings.NewReader(input))
+		if tbl.expectErr {
+			if len(errs) == 0 {
+				t.Errorf("Globals %s validated without errors", tbl.globals)
+			}
+			continue
+		}
+		if len(errs) != tbl.warnings || len(config.Warnings) != tbl.warnings {
+			t.Errorf("Globals %s gave warnings %v and %v, expected %d", tbl.globals,
+				config.Warnings, errs, tbl.warnings)
+		}
+		if !reflect.DeepEqual(config.Globals.Tags, tbl.tags) ||
+			!reflect.DeepEqual(config.Globals.HostTags, tbl.hostTags) {
+			t.Errorf("Globals %s gave tags %v and host tags %v", tbl.globals,
+				config.Globals.Tags, config.Globals.HostTags)
+		}
+	}
+
+	// Templates can use global tags
+	input := `
+globals:
+  tags: {cluster: frontier}
+programs:
+  - source: test.c
+    outputs:
+      - id: execs
+        type: BPF_PERF_OUTPUT
+        template: "{{.cluster}} {{.Tags.host}} {{.comm}}"
+        format:
+          - {name: comm, type: "char[16]", isTag: true}
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err != nil {
+		t.Errorf("Template using global tags threw error %v", err)
+	}
+}
+
+// Confirm outputs are written to bpf by default, or to a measurement named by
+// their program or their own, after the prefix
+func TestParseConfigMeasurements(t *testing.T) {
+	tables := []struct {
+		globals   string
+		expected  []string
+		expectErr bool
+	}{
+		{"verbose: false", []string{"bpf", "tcp"}, false},
+		{"measurementMode: single", []string{"bpf", "tcp"}, false},
+		{"measurementMode: sensor", []string{"test", "tcp"}, false},
+		{"measurementPrefix: greggd_", []string{"greggd_bpf", "greggd_tcp"}, false},
+		{"measurementMode: sensor\n  measurementPrefix: greggd_",
+			[]string{"greggd_test", "greggd_tcp"}, false},
+		{"measurementMode: output", nil, true},
+	}
+	for _, tbl := range tables {
+		input := "globals:\n  " + tbl.globals + `
+programs:
+  - source: test.c
+    outputs:
+      - {id: opensnoop, type: BPF_PERF_OUTPUT, format: [{name: pid, type: u32}]}
+      - {id: tcplife, type: BPF_PERF_OUTPUT, measurement: tcp,
+         format: [{name: pid, type: u32}]}
+`
+		config, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Globals %s returned error %v", tbl.globals, err)
+			continue
+		}
+		if err != nil {
+			found := false
+			for _, e := range Validate(strings.NewReader(input)) {
+				found = found || e.Path == "globals.measurementMode"
+			}
+			if !found {
+				t.Errorf("Globals %s did not fail validation", tbl.globals)
+			}
+			continue
+		}
+		var measurements []string
+		for _, output := range config.Programs[0].Outputs {
+			measurements = append(measurements, output.CompiledMeasurement)
+		}
+		if !reflect.DeepEqual(measurements, tbl.expected) {
+			t.Errorf("Globals %s gave measurements %v, expected %v", tbl.globals,
+				measurements, tbl.expected)
+		}
+	}
+
+	// Sensor outputs can be given a measurement
+	input := `
+programs:
+  - sensor: tcplife
+    outputs:
+      - id: ipv4_events
+        measurement: tcp
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error parsing sensor config: %v", err)
+	}
+	measurement := config.Programs[0].Outputs[0].CompiledMeasurement
+	if measurement != "tcp" {
+		t.Errorf("Sensor output has measurement %s, expected tcp", measurement)
+	}
+
+	// In sensor mode, programs with the same file name would share a
+	// measurement unless one is named
+	input = `
+globals:
+  measurementMode: sensor
+programs:
+  - source: a/test.c
+    outputs:
+      - {id: opens, type: BPF_PERF_OUTPUT, format: [{name: pid, type: u32}]}
+  - source: b/test.c
+    outputs:
+      - {id: execs, type: BPF_PERF_OUTPUT, format: [{name: pid, type: u32}]}
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Programs sharing a measurement did not throw error")
+	}
+	input = strings.Replace(input, "id: execs,", "id: execs, measurement: execs,",
+		1)
+	if _, err := ParseConfig(strings.NewReader(input)); err != nil {
+		t.Errorf("Error thrown when not expected: %v", err)
+	}
+}
@@ -0,0 +1,566 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Constants from kernel headers that BCC programs commonly size arrays with.
+// Sources can't be preprocessed without the headers, so keep the common ones
+var kernelDefines = map[string]int{
+	"TASK_COMM_LEN": 16,
+	"DISK_NAME_LEN": 32,
+	"NAME_MAX":      255,
+	"PATH_MAX":      4096,
+}
+
+// C scalar types mapped to greggd format types, with their size in bytes.
+// Alignment of a scalar is its size
+var cScalarTypes = map[string]struct {
+	formatType string
+	size       int
+}{
+	"char":               {"char", 1},
+	"signed char":        {"char", 1},
+	"unsigned char":      {"u8", 1},
+	"u8":                 {"u8", 1},
+	"__u8":               {"u8", 1},
+	"uint8_t":            {"u8", 1},
+	"short":              {"int16", 2},
+	"s16":                {"int16", 2},
+	"__s16":              {"int16", 2},
+	"int16_t":            {"int16", 2},
+	"unsigned short":     {"u16", 2},
+	"u16":                {"u16", 2},
+	"__u16":              {"u16", 2},
+	"__be16":             {"u16", 2},
+	"uint16_t":           {"u16", 2},
+	"int":                {"int32", 4},
+	"signed int":         {"int32", 4},
+	"s32":                {"int32", 4},
+	"__s32":              {"int32", 4},
+	"int32_t":            {"int32", 4},
+	"unsigned":           {"u32", 4},
+	"unsigned int":       {"u32", 4},
+	"u32":                {"u32", 4},
+	"__u32":              {"u32", 4},
+	"__be32":             {"u32", 4},
+	"uint32_t":           {"u32", 4},
+	"long":               {"int64", 8},
+	"long int":           {"int64", 8},
+	"long long":          {"int64", 8},
+	"s64":                {"int64", 8},
+	"__s64":              {"int64", 8},
+	"int64_t":            {"int64", 8},
+	"unsigned long":      {"u64", 8},
+	"unsigned long long": {"u64", 8},
+	"u64":                {"u64", 8},
+	"__u64":              {"u64", 8},
+	"uint64_t":           {"u64", 8},
+}
+
+var (
+	blockCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	lineCommentRe  = regexp.MustCompile(`//[^\n]*`)
+	defineRe       = regexp.MustCompile(
+		`(?m)^\s*#define\s+(\w+)\s+(0[xX][0-9a-fA-F]+|\d+)\s*$`)
+	structRe = regexp.MustCompile(
+		`(typedef\s+)?struct\s+(\w+)?\s*\{([^{}]*)\}\s*(\w+)?\s*;`)
+	typedefRe = regexp.MustCompile(`typedef\s+([^;{}]+?)\s+(\w+)\s*;`)
+	mapRe     = regexp.MustCompile(
+		`\b(BPF_PERF_OUTPUT|BPF_HASH|BPF_HISTOGRAM|BPF_ARRAY|BPF_TABLE)\s*\(([^;]*)\)\s*;`)
+	arrayDimRe = regexp.MustCompile(`\[\s*(\w+)\s*\]`)
+)
+
+// Member of a struct declared in the C source
+type cMember struct {
+	typeName string
+	name     string
+	dims     []string
+}
+
+// Map declared in the C source with the C types of its key and value
+type cMap struct {
+	macro    string
+	keyType  string
+	leafType string
+}
+
+// Struct, typedef and map declarations pulled out of a BCC C source
+type cSource struct {
+	text     string
+	defines  map[string]int
+	typedefs map[string]string
+	structs  map[string][]cMember
+	maps     map[string]cMap
+}
+
+// Layout of one map derived from the program
+type sourceLayout struct {
+	outputType string
+	key        []BPFOutputFormat
+	value      []BPFOutputFormat
+}
+
+// Anything that can describe the layout of a program's maps. Implemented by
+// C source and by BTF
+type layoutSource interface {
+	outputLayout(output *BPFOutput) (*sourceLayout, error)
+}
+
+// Read the struct, typedef and map declarations out of C source. This is not a
+// C parser. It understands the flat declarations BCC programs use for output
+// structs, and resolution errors are only raised for the maps asked for.
+// Defines are the program's -D flags
+func parseCSource(source string, defines map[string]string) *cSource {
+	text := blockCommentRe.ReplaceAllString(source, "")
+	text = lineCommentRe.ReplaceAllString(text, "")
+
+	src := &cSource{
+		text:     text,
+		defines:  map[string]int{},
+		typedefs: map[string]string{},
+		structs:  map[string][]cMember{},
+		maps:     map[string]cMap{},
+	}
+	for name, value := range kernelDefines {
+		src.defines[name] = value
+	}
+	for _, match := range defineRe.FindAllStringSubmatch(text, -1) {
+		value, err := strconv.ParseInt(match[2], 0, 64)
+		if err == nil {
+			src.defines[match[1]] = int(value)
+		}
+	}
+	// Defines passed as -D flags can size arrays too
+	for name, define := range defines {
+		value, err := strconv.ParseInt(define, 0, 64)
+		if err == nil {
+			src.defines[name] = int(value)
+		}
+	}
+
+	for _, match := range structRe.FindAllStringSubmatch(text, -1) {
+		members := parseCMembers(match[3])
+		if match[2] != "" {
+			src.structs["struct "+match[2]] = members
+		}
+		if match[1] != "" && match[4] != "" {
+			src.structs[match[4]] = members
+		}
+	}
+	// Struct bodies are gone from this copy so only simple typedefs match
+	for _, match := range typedefRe.FindAllStringSubmatch(
+		structRe.ReplaceAllString(text, ""), -1) {
+		src.typedefs[match[2]] = normalizeCType(match[1])
+	}
+
+	for _, match := range mapRe.FindAllStringSubmatch(text, -1) {
+		args := strings.Split(match[2], ",")
+		for i := range args {
+			args[i] = normalizeCType(args[i])
+		}
+		// Fill in the defaults BCC uses for omitted key and leaf types
+		arg := func(i int, def string) string {
+			if i < len(args) && args[i] != "" {
+				return args[i]
+			}
+			return def
+		}
+		switch match[1] {
+		case "BPF_PERF_OUTPUT":
+			src.maps[arg(0, "")] = cMap{macro: match[1]}
+		case "BPF_HASH":
+			src.maps[arg(0, "")] = cMap{macro: match[1], keyType: arg(1, "u64"),
+				leafType: arg(2, "u64")}
+		case "BPF_HISTOGRAM":
+			src.maps[arg(0, "")] = cMap{macro: match[1], keyType: arg(1, "int"),
+				leafType: "u64"}
+		case "BPF_ARRAY":
+			src.maps[arg(0, "")] = cMap{macro: match[1], keyType: "int",
+				leafType: arg(1, "u64")}
+		case "BPF_TABLE":
+			src.maps[arg(3, "")] = cMap{macro: strings.Trim(arg(0, ""), `"`),
+				keyType: arg(1, ""), leafType: arg(2, "")}
+		}
+	}
+
+	return src
+}
+
+// Split a struct body into members
+func parseCMembers(body string) []cMember {
+	var members []cMember
+	for _, decl := range strings.Split(body, ";") {
+		decl = strings.TrimSpace(decl)
+		if decl == "" {
+			continue
+		}
+		member := cMember{}
+		for _, dim := range arrayDimRe.FindAllStringSubmatch(decl, -1) {
+			member.dims = append(member.dims, dim[1])
+		}
+		decl = strings.TrimSpace(arrayDimRe.ReplaceAllString(decl, ""))
+		// Name is the last identifier, everything before it is the type
+		split := strings.LastIndexAny(decl, " \t\n*")
+		member.name = decl[split+1:]
+		member.typeName = normalizeCType(decl[:split+1])
+		members = append(members, member)
+	}
+	return members
+}
+
+// Drop qualifiers and collapse whitespace so types can be looked up. Pointer
+// stars are kept, separated from the type name
+func normalizeCType(typeName string) string {
+	typeName = strings.Replace(typeName, "*", " * ", -1)
+	var words []string
+	for _, word := range strings.Fields(typeName) {
+		switch word {
+		case "const", "volatile", "__user":
+			continue
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// Resolve a C type to a greggd format type and its size and alignment
+func (src *cSource) resolveScalar(typeName string, dims []string) (string,
+	int, int, error) {
+
+	if strings.Contains(typeName, "*") {
+		typeName = "u64"
+	}
+	for {
+		underlying, ok := src.typedefs[typeName]
+		if !ok {
+			break
+		}
+		typeName = underlying
+		if strings.Contains(typeName, "*") {
+			typeName = "u64"
+		}
+	}
+	scalar, ok := cScalarTypes[typeName]
+	if !ok {
+		if _, isStruct := src.structs[typeName]; isStruct {
+			return "", 0, 0, fmt.Errorf("csource.go: Nested %s is not supported",
+				typeName)
+		}
+		return "", 0, 0, fmt.Errorf("csource.go: C type %s is not supported",
+			typeName)
+	}
+	if len(dims) == 0 {
+		return scalar.formatType, scalar.size, scalar.size, nil
+	}
+
+	// Arrays are decoded as strings, so only allow byte elements
+	if scalar.size != 1 {
+		return "", 0, 0, fmt.Errorf(
+			"csource.go: Arrays of C type %s are not supported", typeName)
+	}
+	formatType := "char"
+	size := 1
+	for _, dim := range dims {
+		length, err := strconv.Atoi(dim)
+		if err != nil {
+			var ok bool
+			length, ok = src.defines[dim]
+			if !ok {
+				return "", 0, 0, fmt.Errorf(
+					"csource.go: Unknown array length %s", dim)
+			}
+		}
+		formatType = fmt.Sprintf("%s[%d]", formatType, length)
+		size *= length
+	}
+	return formatType, size, 1, nil
+}
+
+// Lay out a C type as a list of formats. Structs are laid out with the
+// natural C alignment of their members, with padding made explicit so the
+// binary decode lines up. Scalars become a single format with the given name
+func (src *cSource) layout(typeName string, scalarName string) (
+	[]BPFOutputFormat, error) {
+
+	for {
+		underlying, ok := src.typedefs[typeName]
+		if !ok {
+			break
+		}
+		typeName = underlying
+	}
+	members, isStruct := src.structs[typeName]
+	if !isStruct {
+		formatType, _, _, err := src.resolveScalar(typeName, nil)
+		if err != nil {
+			return nil, err
+		}
+		return []BPFOutputFormat{{Name: scalarName, Type: formatType}}, nil
+	}
+
+	var formats []BPFOutputFormat
+	offset, maxAlign := 0, 1
+	for _, member := range members {
+		formatType, size, align, err := src.resolveScalar(member.typeName,
+			member.dims)
+		if err != nil {
+			return nil, fmt.Errorf("csource.go: Error laying out %s.%s: %s",
+				typeName, member.name, err)
+		}
+		if pad := (align - offset%align) % align; pad != 0 {
+			formats = append(formats, padFormat(pad))
+			offset += pad
+		}
+		formats = append(formats, BPFOutputFormat{Name: member.name,
+			Type: formatType})
+		offset += size
+		if align > maxAlign {
+			maxAlign = align
+		}
+	}
+	if pad := (maxAlign - offset%maxAlign) % maxAlign; pad != 0 {
+		formats = append(formats, padFormat(pad))
+	}
+	return formats, nil
+}
+
+// Build a padding format of n bytes
+func padFormat(n int) BPFOutputFormat {
+	return BPFOutputFormat{Type: fmt.Sprintf("pad[%d]", n)}
+}
+
+// Find the C type submitted to a perf output. Use the sizeof argument from
+// the perf_submit call, looking up the variable's declaration if needed
+func (src *cSource) perfSubmitType(mapName string) (string, error) {
+	submitRe := regexp.MustCompile(`\b` + regexp.QuoteMeta(mapName) +
+		`\s*\.\s*perf_submit\s*\([^,]+,[^,]+,\s*sizeof\s*\(\s*([^)]+?)\s*\)\s*\)`)
+	match := submitRe.FindStringSubmatch(src.text)
+	if match == nil {
+		return "", fmt.Errorf("csource.go: No perf_submit call found for %s",
+			mapName)
+	}
+	sizeofArg := normalizeCType(match[1])
+	if _, ok := src.structs[sizeofArg]; ok {
+		return sizeofArg, nil
+	}
+	if _, ok := src.typedefs[sizeofArg]; ok {
+		return sizeofArg, nil
+	}
+
+	declRe := regexp.MustCompile(`(struct\s+\w+|\w+)\s*\*?\s*\b` +
+		regexp.QuoteMeta(sizeofArg) + `\s*[=;]`)
+	for _, decl := range declRe.FindAllStringSubmatch(src.text, -1) {
+		declType := normalizeCType(decl[1])
+		if _, ok := src.structs[declType]; ok {
+			return declType, nil
+		}
+	}
+	return "", fmt.Errorf("csource.go: Unable to find type of %s submitted to %s",
+		sizeofArg, mapName)
+}
+
+// Derive the output type, key layout and value layout of an output's map
+func (src *cSource) outputLayout(output *BPFOutput) (*sourceLayout, error) {
+	mapName := output.Id
+	declared, ok := src.maps[mapName]
+	if !ok {
+		return nil, fmt.Errorf("csource.go: Map %s is not declared in source",
+			mapName)
+	}
+
+	switch declared.macro {
+	case "BPF_PERF_OUTPUT", "perf_output":
+		valueType, err := src.perfSubmitType(mapName)
+		if err != nil {
+			return nil, err
+		}
+		value, err := src.layout(valueType, "value")
+		if err != nil {
+			return nil, err
+		}
+		return &sourceLayout{outputType: "BPF_PERF_OUTPUT", value: value}, nil
+	case "BPF_HASH", "BPF_HISTOGRAM", "hash", "histogram":
+		outputType := "BPF_HASH"
+		if declared.macro == "BPF_HISTOGRAM" || declared.macro == "histogram" {
+			outputType = "BPF_HISTOGRAM"
+		}
+		key, err := src.layout(declared.keyType, "hash_key")
+		if err != nil {
+			return nil, err
+		}
+		value, err := src.layout(declared.leafType, "value")
+		if err != nil {
+			return nil, err
+		}
+		return &sourceLayout{outputType: outputType, key: key, value: value}, nil
+	default:
+		return nil, fmt.Errorf("csource.go: Map %s of type %s is not supported",
+			mapName, declared.macro)
+	}
+}
+
+// Check if an output needs its layout derived from source. Outputs with no
+// format, or with format entries missing a type, are treated as overrides
+func needsDerivedFormat(output *BPFOutput) bool {
+	if output.Id == "" {
+		return false
+	}
+	if len(output.Format) == 0 {
+		return true
+	}
+	for _, format := range output.Format {
+		if format.Type == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply per-field overrides from the config on top of derived formats.
+// Overrides are matched by name and may not change a field's type. flags
+// holds the flags each override sets, if they are known
+func mergeFormatOverrides(derived []BPFOutputFormat,
+	overrides []BPFOutputFormat, flags []FormatOverride) ([]BPFOutputFormat,
+	error) {
+
+	merged := make([]BPFOutputFormat, len(derived))
+	copy(merged, derived)
+	for iOverride, override := range overrides {
+		var overrideFlags FormatOverride
+		if iOverride < len(flags) {
+			overrideFlags = flags[iOverride]
+		}
+		found := false
+		for i := range merged {
+			if merged[i].Name != override.Name || override.Name == "" {
+				continue
+			}
+			found = true
+			if override.Type != "" && override.Type != merged[i].Type {
+				return nil, fmt.Errorf(
+					"csource.go: Field %s is %s in source but configured as %s",
+					override.Name, merged[i].Type, override.Type)
+			}
+			mergeFormat(&merged[i], override, overrideFlags)
+		}
+		if !found {
+			return nil, fmt.Errorf("csource.go: Field %s is not in source struct",
+				override.Name)
+		}
+	}
+	return merged, nil
+}
+
+// Apply the settings an override sets on top of a field
+func mergeFormat(format *BPFOutputFormat, override BPFOutputFormat,
+	flags FormatOverride) {
+
+	if override.FormatString != "" {
+		format.FormatString = override.FormatString
+	}
+	format.IsTag = mergeFlag(format.IsTag, override.IsTag, flags.IsTag)
+	format.IsIP = mergeFlag(format.IsIP, override.IsIP, flags.IsIP)
+	format.Timestamp = mergeFlag(format.Timestamp, override.Timestamp,
+		flags.Timestamp)
+	if len(override.Enum) != 0 {
+		format.Enum = override.Enum
+	}
+	if override.Filter != nil {
+		format.Filter = override.Filter
+	}
+	if override.FilterAction != "" {
+		format.FilterAction = override.FilterAction
+	}
+}
+
+// Fill in missing output formats and keys of a program from its BTF or C
+// source
+func deriveProgramFormats(prog *BPFProgram) error {
+	derive := false
+	for iOutput := range prog.Outputs {
+		if needsDerivedFormat(&prog.Outputs[iOutput]) {
+			derive = true
+		}
+	}
+	if !derive {
+		return nil
+	}
+
+	// Prefer real offsets and sizes from BTF when the program has it. Objects
+	// carry their own BTF
+	btfPath := prog.BTF
+	if btfPath == "" {
+		btfPath = prog.Object
+	}
+	var src layoutSource
+	if btfPath != "" {
+		btfSrc, err := loadBTFSource(btfPath)
+		if err != nil {
+			return err
+		}
+		src = btfSrc
+	} else {
+		source, err := prog.readRawSource()
+		if os.IsNotExist(err) {
+			// Leave missing sources for the tracer to report
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("csource.go: Error reading source %s: %s",
+				prog.Name(), err)
+		}
+		rendered, err := prog.renderSource(string(source))
+		if err != nil {
+			return err
+		}
+		src = parseCSource(rendered, prog.Defines)
+	}
+
+	for iOutput := range prog.Outputs {
+		output := &prog.Outputs[iOutput]
+		if !needsDerivedFormat(output) {
+			continue
+		}
+		layout, err := src.outputLayout(output)
+		if err != nil {
+			return fmt.Errorf("csource.go: Error deriving format of %s from %s: %s",
+				output.Id, prog.Name(), err)
+		}
+
+		if output.Type == "" {
+			output.Type = layout.outputType
+		}
+		output.Format, err = mergeFormatOverrides(layout.value, output.Format,
+			nil)
+		if err != nil {
+			return fmt.Errorf("csource.go: Error in format of %s: %s", output.Id,
+				err)
+		}
+
+		// Keys set in the config win. Single value keys keep using `key`, struct
+		// keys are described by `keyFormat`
+		if output.Key.Type != "" || len(layout.key) == 0 {
+			continue
+		}
+		if len(layout.key) == 1 {
+			derivedKey := layout.key[0]
+			if output.Key.Name != "" {
+				derivedKey.Name = output.Key.Name
+			}
+			mergeFormat(&derivedKey, output.Key, FormatOverride{})
+			output.Key = derivedKey
+			continue
+		}
+		output.KeyFormat, err = mergeFormatOverrides(layout.key,
+			output.KeyFormat, nil)
+		if err != nil {
+			return fmt.Errorf("csource.go: Error in key format of %s: %s",
+				output.Id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// Confirm layouts of the bundled programs are derived with C padding
+func TestOutputLayoutBundledSources(t *testing.T) {
+	tables := []struct {
+		source        string
+		mapName       string
+		expectedType  string
+		expectedKey   []BPFOutputFormat
+		expectedValue []BPFOutputFormat
+	}{
+		{
+			"../../csrc/opensnoop.c", "opensnoop", "BPF_PERF_OUTPUT", nil,
+			[]BPFOutputFormat{{Name: "id", Type: "u64"}, {Name: "pid", Type: "u32"},
+				{Name: "uid", Type: "u32"}, {Name: "ret", Type: "int32"},
+				{Name: "comm", Type: "char[16]"}, {Name: "fname", Type: "char[255]"},
+				{Type: "pad[1]"}, {Name: "flags", Type: "int32"}},
+		},
+		{
+			"../../csrc/execsnoop.c", "execs", "BPF_PERF_OUTPUT", nil,
+			[]BPFOutputFormat{{Name: "pid", Type: "u32"}, {Name: "ppid", Type: "u32"},
+				{Name: "uid", Type: "u32"}, {Name: "comm", Type: "char[16]"},
+				{Name: "env", Type: "char[12][32]"},
+				{Name: "argv", Type: "char[12][32]"}, {Name: "rc", Type: "int32"},
+				{Name: "span_us", Type: "u64"}},
+		},
+		{
+			"../../csrc/tcplife.c", "ipv4_events", "BPF_PERF_OUTPUT", nil,
+			[]BPFOutputFormat{{Name: "pid", Type: "u32"},
+				{Name: "saddr", Type: "u32"}, {Name: "daddr", Type: "u32"},
+				{Name: "lport", Type: "u16"}, {Name: "rport", Type: "u16"},
+				{Name: "rx_b", Type: "u64"}, {Name: "tx_b", Type: "u64"},
+				{Name: "span_us", Type: "u64"}, {Name: "comm", Type: "char[16]"},
+				{Name: "uid", Type: "u32"}, {Type: "pad[4]"}},
+		},
+		{
+			"../../csrc/biolatency.c", "biolatency_dist", "BPF_HISTOGRAM",
+			[]BPFOutputFormat{{Name: "disk", Type: "char[32]"},
+				{Name: "slot", Type: "u64"}},
+			[]BPFOutputFormat{{Name: "value", Type: "u64"}},
+		},
+		{
+			"../../csrc/nfsdist.c", "nfsdist_hist", "BPF_HISTOGRAM",
+			[]BPFOutputFormat{{Name: "slot", Type: "u64"}},
+			[]BPFOutputFormat{{Name: "value", Type: "u64"}},
+		},
+	}
+
+	for _, tbl := range tables {
+		source, err := ioutil.ReadFile(tbl.source)
+		if err != nil {
+			t.Errorf("Error reading source fixture %s: %v", tbl.source, err)
+			continue
+		}
+		layout, err := parseCSource(string(source), nil).outputLayout(&BPFOutput{Id: tbl.mapName})
+		if err != nil {
+			t.Errorf("Error deriving layout of %s: %v", tbl.mapName, err)
+			continue
+		}
+		if layout.outputType != tbl.expectedType {
+			t.Errorf("Output type of %s is %s, expected %s", tbl.mapName,
+				layout.outputType, tbl.expectedType)
+		}
+		if !cmp.Equal(layout.key, tbl.expectedKey) {
+			t.Errorf("Key layout of %s does not match: %s", tbl.mapName,
+				cmp.Diff(tbl.expectedKey, layout.key))
+		}
+		if !cmp.Equal(layout.value, tbl.expectedValue) {
+			t.Errorf("Value layout of %s does not match: %s", tbl.mapName,
+				cmp.Diff(tbl.expectedValue, layout.value))
+		}
+	}
+}
+
+// Confirm unsupported or missing declarations error out
+func TestOutputLayoutErrors(t *testing.T) {
+	tables := []struct {
+		source  string
+		mapName string
+	}{
+		// Map isn't declared
+		{`BPF_PERF_OUTPUT(events);`, "missing"},
+		// Perf output is never submitted to
+		{`BPF_PERF_OUTPUT(events);`, "events"},
+		// Array length can't be resolved
+		{`struct data_t { char name[UNKNOWN_LEN]; };
+BPF_HASH(counts, u32, struct data_t);`, "counts"},
+		// Nested structs aren't supported
+		{`struct inner_t { u32 a; };
+struct data_t { struct inner_t inner; };
+BPF_HASH(counts, u32, struct data_t);`, "counts"},
+	}
+	for _, tbl := range tables {
+		_, err := parseCSource(tbl.source, nil).outputLayout(&BPFOutput{Id: tbl.mapName})
+		if err == nil {
+			t.Errorf("Invalid source did not throw error: %s", tbl.source)
+		}
+	}
+}
+
+// Confirm ParseConfig derives formats and applies overrides from the config
+func TestParseConfigDerivedFormat(t *testing.T) {
+	sourceFile, err := ioutil.TempFile("", "greggd-*.c")
+	if err != nil {
+		t.Fatalf("Error creating source fixture: %v", err)
+	}
+	defer os.Remove(sourceFile.Name())
+	sourceFile.WriteString(`
+#define NAME_LEN 8
+typedef struct key { u32 cpu; char name[NAME_LEN]; } key_t;
+struct data_t {
+    u8 flag;
+    u64 ts; // padded
+};
+BPF_HASH(counts, key_t, u64);
+BPF_PERF_OUTPUT(events);
+int probe(struct pt_regs *ctx) {
+    struct data_t data = {};
+    events.perf_submit(ctx, &data, sizeof(data));
+    return 0;
+}
+`)
+	sourceFile.Close()
+
+	configTemplate := `programs: [{source: SOURCE, outputs: [
+  {id: events, format: [{name: ts, timestamp: true}]},
+  {id: counts, poll: 1s, keyFormat: [{name: name, isTag: true}]}]}]`
+	testConfig, err := ParseConfig(strings.NewReader(
+		strings.Replace(configTemplate, "SOURCE", sourceFile.Name(), 1)))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+
+	events := testConfig.Programs[0].Outputs[0]
+	expectedEvents := []BPFOutputFormat{{Name: "flag", Type: "u8"},
+		{Type: "pad[7]"}, {Name: "ts", Type: "u64", Timestamp: true}}
+	if events.Type != "BPF_PERF_OUTPUT" {
+		t.Errorf("Output type not derived: %s", events.Type)
+	}
+	if !cmp.Equal(events.Format, expectedEvents) {
+		t.Errorf("Derived format does not match: %s",
+			cmp.Diff(expectedEvents, events.Format))
+	}
+
+	counts := testConfig.Programs[0].Outputs[1]
+	expectedKey := []BPFOutputFormat{{Name: "cpu", Type: "u32"},
+		{Name: "name", Type: "char[8]", IsTag: true}}
+	if counts.Type != "BPF_HASH" {
+		t.Errorf("Output type not derived: %s", counts.Type)
+	}
+	if !cmp.Equal(counts.KeyFormat, expectedKey) {
+		t.Errorf("Derived key format does not match: %s",
+			cmp.Diff(expectedKey, counts.KeyFormat))
+	}
+
+	// Overrides must name a field in the source with a matching type
+	badOverrides := []string{
+		`[{name: missing, isTag: true}]`,
+		`[{name: ts, type: u32}, {name: flag}]`,
+	}
+	for _, overrides := range badOverrides {
+		badConfig := `programs: [{source: ` + sourceFile.Name() +
+			`, outputs: [{id: events, format: ` + overrides + `}]}]`
+		_, err = ParseConfig(strings.NewReader(badConfig))
+		if err == nil {
+			t.Errorf("Invalid override did not throw error: %s", overrides)
+		}
+	}
+}
+
+// Confirm enums and timestamps set in the config are kept on formats and keys
+// derived from the source
+func TestParseConfigDerivedEnums(t *testing.T) {
+	sourceFile, err := ioutil.TempFile("", "greggd-*.c")
+	if err != nil {
+		t.Fatalf("Error creating source fixture: %v", err)
+	}
+	defer os.Remove(sourceFile.Name())
+	sourceFile.WriteString(`
+struct data_t {
+    u8 state;
+    u32 pid;
+};
+BPF_PERF_OUTPUT(events);
+BPF_HASH(states, u8, u64);
+BPF_HASH(starts, u64, u32);
+int probe(struct pt_regs *ctx) {
+    struct data_t data = {};
+    events.perf_submit(ctx, &data, sizeof(data));
+    return 0;
+}
+`)
+	sourceFile.Close()
+
+	input := `programs: [{source: ` + sourceFile.Name() + `, outputs: [
+  {id: events, format: [{name: state, isTag: true, enum: {1: ESTABLISHED}}]},
+  {id: states, poll: 1s, key: {name: state, isTag: true, enum: {7: CLOSE}}},
+  {id: starts, poll: 1s, key: {name: start, timestamp: true}}]}]`
+	testConfig, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+
+	outputs := testConfig.Programs[0].Outputs
+	expectedState := BPFOutputFormat{Name: "state", Type: "u8", IsTag: true,
+		Enum: map[int64]string{1: "ESTABLISHED"}}
+	if !cmp.Equal(outputs[0].Format[0], expectedState,
+		cmpopts.IgnoreFields(BPFOutputFormat{}, "CompiledType")) {
+		t.Errorf("Derived field lost its enum: %+v", outputs[0].Format[0])
+	}
+	if key := outputs[1].Key; key.Type != "u8" || !key.IsTag ||
+		key.Enum[7] != "CLOSE" {
+		t.Errorf("Derived key lost its enum: %+v", key)
+	}
+	if key := outputs[2].Key; key.Type != "u64" || !key.Timestamp {
+		t.Errorf("Derived key lost its timestamp: %+v", key)
+	}
+}
@@ -0,0 +1,564 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Record-level filter expression, compiled from an output's `filter` key.
+// Expressions compare fields of the decoded record with each other and with
+// literals, e.g. `uid == 0 && fname startsWith "/proc"`
+type FilterExpression struct {
+	source string
+	root   exprNode
+}
+
+func (e *FilterExpression) String() string {
+	return e.source
+}
+
+// Evaluate the expression against a decoded record, keyed by field name.
+// Values are the raw decoded values: integers of any width, byte arrays for
+// strings, or strings
+func (e *FilterExpression) Eval(record map[string]interface{}) bool {
+	return e.root.eval(record).(bool)
+}
+
+// Type of value an expression node produces
+type exprKind int
+
+const (
+	exprBool exprKind = iota
+	exprNumber
+	exprString
+)
+
+func (k exprKind) String() string {
+	return [...]string{"bool", "number", "string"}[k]
+}
+
+type exprNode interface {
+	kind() exprKind
+	eval(record map[string]interface{}) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+	k     exprKind
+}
+
+func (n *literalNode) kind() exprKind                          { return n.k }
+func (n *literalNode) eval(map[string]interface{}) interface{} { return n.value }
+
+type fieldNode struct {
+	name string
+	k    exprKind
+}
+
+func (n *fieldNode) kind() exprKind { return n.k }
+
+// Normalize a decoded value to int64, uint64 or string
+func (n *fieldNode) eval(record map[string]interface{}) interface{} {
+	value := reflect.ValueOf(record[n.name])
+	switch value.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return value.Uint()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return value.Int()
+	case reflect.String:
+		return value.String()
+	case reflect.Array, reflect.Slice:
+		raw := make([]byte, value.Len())
+		reflect.Copy(reflect.ValueOf(raw), value)
+		if n := bytes.IndexByte(raw, 0); n >= 0 {
+			raw = raw[:n]
+		}
+		return string(raw)
+	}
+	// Missing fields compare as their zero value
+	if n.k == exprString {
+		return ""
+	}
+	return uint64(0)
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) kind() exprKind { return exprBool }
+func (n *notNode) eval(record map[string]interface{}) interface{} {
+	return !n.operand.eval(record).(bool)
+}
+
+type logicNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *logicNode) kind() exprKind { return exprBool }
+func (n *logicNode) eval(record map[string]interface{}) interface{} {
+	if n.op == "&&" {
+		return n.left.eval(record).(bool) && n.right.eval(record).(bool)
+	}
+	return n.left.eval(record).(bool) || n.right.eval(record).(bool)
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+	// Compiled right hand side of `matches`
+	pattern *regexp.Regexp
+}
+
+func (n *compareNode) kind() exprKind { return exprBool }
+func (n *compareNode) eval(record map[string]interface{}) interface{} {
+	left, right := n.left.eval(record), n.right.eval(record)
+	switch n.op {
+	case "startsWith":
+		return strings.HasPrefix(left.(string), right.(string))
+	case "endsWith":
+		return strings.HasSuffix(left.(string), right.(string))
+	case "contains":
+		return strings.Contains(left.(string), right.(string))
+	case "matches":
+		return n.pattern.MatchString(left.(string))
+	}
+
+	var cmp int
+	switch n.left.kind() {
+	case exprNumber:
+		cmp = compareNumbers(left, right)
+	case exprString:
+		cmp = strings.Compare(left.(string), right.(string))
+	case exprBool:
+		if left.(bool) == right.(bool) {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	}
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// Compare two int64, uint64 or float64 values, returning -1, 0 or 1. Integers
+// are compared exactly regardless of signedness
+func compareNumbers(a, b interface{}) int {
+	_, aFloat := a.(float64)
+	_, bFloat := b.(float64)
+	if aFloat || bFloat {
+		af, bf := toFloat(a), toFloat(b)
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+
+	aNeg, aMag := toMagnitude(a)
+	bNeg, bMag := toMagnitude(b)
+	switch {
+	case aNeg && !bNeg:
+		return -1
+	case !aNeg && bNeg:
+		return 1
+	case aMag == bMag:
+		return 0
+	case (aMag < bMag) != aNeg:
+		return -1
+	}
+	return 1
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return value.(float64)
+}
+
+// Split an integer into its sign and magnitude
+func toMagnitude(value interface{}) (bool, uint64) {
+	if v, ok := value.(int64); ok {
+		if v < 0 {
+			return true, uint64(-(v + 1)) + 1
+		}
+		return false, uint64(v)
+	}
+	return false, value.(uint64)
+}
+
+// Kind of value a format type decodes to in an expression, false if the type
+// can't be used in one
+func formatExprKind(formatType string) (exprKind, bool) {
+	switch {
+	case strings.Count(formatType, "[") == 1 &&
+		(strings.HasPrefix(formatType, "char[") ||
+			strings.HasPrefix(formatType, "u8[")):
+		return exprString, true
+	case strings.Contains(formatType, "["):
+		return 0, false
+	}
+	return exprNumber, contains(FormatTypes, formatType) && formatType != "pad"
+}
+
+// Fields of an output that can be used in its filter expression, mapped to
+// their format types
+func outputFields(output *BPFOutput) map[string]string {
+	fields := make(map[string]string)
+	for _, format := range output.KeyFormat {
+		fields[format.Name] = format.Type
+	}
+	if len(output.KeyFormat) == 0 && IsPolledType(output.Type) {
+		fields[output.Key.Name] = output.Key.Type
+	}
+	for _, format := range output.Format {
+		fields[format.Name] = format.Type
+	}
+	delete(fields, "")
+	return fields
+}
+
+// Compile a filter expression. Fields maps each field the expression may use
+// to its format type; any other identifier is an error
+func CompileFilterExpression(source string,
+	fields map[string]string) (*FilterExpression, error) {
+
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{source: source, tokens: tokens, fields: fields}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorAt(tok, "Unexpected %s", tok.text)
+	}
+	if root.kind() != exprBool {
+		return nil, fmt.Errorf(
+			"expression.go: Filter %q is a %s, expected a condition", source,
+			root.kind())
+	}
+	return &FilterExpression{source: source, root: root}, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Byte offset in the source
+	pos int
+}
+
+// Operators, longest first so `<=` wins over `<`
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">",
+	"!", "(", ")", "-"}
+
+func lexExpression(source string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(source); {
+		c := rune(source[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c == '_' || unicode.IsLetter(c):
+			end := pos + 1
+			for end < len(source) && (source[end] == '_' ||
+				unicode.IsLetter(rune(source[end])) ||
+				unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{tokIdent, source[pos:end], pos})
+			pos = end
+		case unicode.IsDigit(c):
+			// Exponents can be signed, e.g. 1e-3, except in hex where e is a digit
+			hex := strings.HasPrefix(source[pos:], "0x") ||
+				strings.HasPrefix(source[pos:], "0X")
+			end := pos + 1
+			for end < len(source) && (unicode.IsDigit(rune(source[end])) ||
+				strings.ContainsRune(".xXabcdefABCDEF", rune(source[end])) ||
+				(!hex && strings.ContainsRune("+-", rune(source[end])) &&
+					strings.ContainsRune("eE", rune(source[end-1])))) {
+				end++
+			}
+			tokens = append(tokens, token{tokNumber, source[pos:end], pos})
+			pos = end
+		case c == '"':
+			end := pos + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf(
+					"expression.go: Unterminated string at column %d of filter %q",
+					pos+1, source)
+			}
+			tokens = append(tokens, token{tokString, source[pos : end+1], pos})
+			pos = end + 1
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[pos:], op) {
+					tokens = append(tokens, token{tokOp, op, pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf(
+					"expression.go: Unexpected %q at column %d of filter %q", c, pos+1,
+					source)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "end of filter", len(source)}), nil
+}
+
+// Recursive descent parser. Precedence from loosest to tightest is ||, &&, !,
+// then comparisons
+type exprParser struct {
+	source string
+	tokens []token
+	pos    int
+	fields map[string]string
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) errorAt(tok token, format string,
+	args ...interface{}) error {
+
+	return fmt.Errorf("expression.go: %s at column %d of filter %q",
+		fmt.Sprintf(format, args...), tok.pos+1, p.source)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLogic("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLogic("&&", p.parseUnary)
+}
+
+func (p *exprParser) parseLogic(op string,
+	operand func() (exprNode, error)) (exprNode, error) {
+
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == op {
+		opTok := p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != exprBool || right.kind() != exprBool {
+			return nil, p.errorAt(opTok, "%s needs conditions on both sides", op)
+		}
+		left = &logicNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == "!" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if operand.kind() != exprBool {
+			return nil, p.errorAt(tok, "! needs a condition")
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// Comparison operators and the operand kinds they accept
+var exprComparisons = map[string][]exprKind{
+	"==":         {exprBool, exprNumber, exprString},
+	"!=":         {exprBool, exprNumber, exprString},
+	"<":          {exprNumber, exprString},
+	"<=":         {exprNumber, exprString},
+	">":          {exprNumber, exprString},
+	">=":         {exprNumber, exprString},
+	"startsWith": {exprString},
+	"endsWith":   {exprString},
+	"contains":   {exprString},
+	"matches":    {exprString},
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	opTok := p.peek()
+	kinds, ok := exprComparisons[opTok.text]
+	if !ok || (opTok.kind != tokOp && opTok.kind != tokIdent) {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	for _, k := range kinds {
+		allowed = allowed || k == left.kind()
+	}
+	if !allowed {
+		return nil, p.errorAt(opTok, "%s doesn't work on %s values", opTok.text,
+			left.kind())
+	}
+	if left.kind() != right.kind() {
+		return nil, p.errorAt(opTok, "Can't compare %s with %s", left.kind(),
+			right.kind())
+	}
+
+	node := &compareNode{op: opTok.text, left: left, right: right}
+	if node.op == "matches" {
+		literal, ok := right.(*literalNode)
+		if !ok {
+			return nil, p.errorAt(opTok, "matches needs a string literal pattern")
+		}
+		node.pattern, err = regexp.Compile(literal.value.(string))
+		if err != nil {
+			return nil, p.errorAt(opTok, "Invalid pattern: %s", err)
+		}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokOp:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if closing := p.next(); closing.text != ")" || closing.kind != tokOp {
+				return nil, p.errorAt(closing, "Expected ) but got %s", closing.text)
+			}
+			return inner, nil
+		case "-":
+			number := p.next()
+			if number.kind != tokNumber {
+				return nil, p.errorAt(number, "Expected a number after -")
+			}
+			return p.parseNumber(number, true)
+		}
+	case tokNumber:
+		return p.parseNumber(tok, false)
+	case tokString:
+		value, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, p.errorAt(tok, "Invalid string %s", tok.text)
+		}
+		return &literalNode{value: value, k: exprString}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literalNode{value: tok.text == "true", k: exprBool}, nil
+		}
+		formatType, ok := p.fields[tok.text]
+		if !ok {
+			return nil, p.errorAt(tok, "Unknown field %s, expected one of %s",
+				tok.text, strings.Join(sortedKeys(p.fields), ", "))
+		}
+		k, ok := formatExprKind(formatType)
+		if !ok {
+			return nil, p.errorAt(tok, "Field %s of type %s can't be used in a filter",
+				tok.text, formatType)
+		}
+		return &fieldNode{name: tok.text, k: k}, nil
+	}
+	return nil, p.errorAt(tok, "Expected a field or value but got %s", tok.text)
+}
+
+func (p *exprParser) parseNumber(tok token, negative bool) (exprNode, error) {
+	text := tok.text
+	if negative {
+		text = "-" + text
+	}
+	if value, err := strconv.ParseInt(text, 0, 64); err == nil {
+		if value < 0 {
+			return &literalNode{value: value, k: exprNumber}, nil
+		}
+		return &literalNode{value: uint64(value), k: exprNumber}, nil
+	}
+	if value, err := strconv.ParseUint(text, 0, 64); err == nil {
+		return &literalNode{value: value, k: exprNumber}, nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil, p.errorAt(tok, "Invalid number %s", text)
+	}
+	return &literalNode{value: value, k: exprNumber}, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
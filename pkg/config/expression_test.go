@@ -0,0 +1,116 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+var expressionFields = map[string]string{
+	"uid":   "u32",
+	"ret":   "int32",
+	"id":    "u64",
+	"fname": "char[255]",
+	"argv":  "char[4][16]",
+}
+
+func TestFilterExpressionEval(t *testing.T) {
+	fname := [255]byte{}
+	copy(fname[:], "/proc/self/stat")
+	record := map[string]interface{}{
+		"uid":   uint32(0),
+		"ret":   int32(-2),
+		"id":    uint64(18446744073709551615),
+		"fname": fname,
+	}
+
+	tables := []struct {
+		expression string
+		expected   bool
+	}{
+		{`uid == 0 && fname startsWith "/proc"`, true},
+		{`uid == 0 && fname startsWith "/sys"`, false},
+		{`uid != 0 || ret < 0`, true},
+		{`!(uid == 0)`, false},
+		{`ret >= -2 && ret <= -2`, true},
+		{`ret > uid`, false},
+		{`id > 9223372036854775807`, true},
+		{`id == 0xffffffffffffffff`, true},
+		{`ret < 0.5`, true},
+		{`ret < 1e-3 && ret > -2E+6`, true},
+		{`fname endsWith "stat" && fname contains "self"`, true},
+		{`fname matches "^/proc/[a-z]+/"`, true},
+		{`fname == "/proc/self/stat"`, true},
+		{`uid == 1 || uid == 2 || !(ret > 0) && fname != ""`, true},
+		{`(uid == 1 || uid == 2) && ret < 0`, false},
+	}
+	for _, tbl := range tables {
+		expr, err := CompileFilterExpression(tbl.expression, expressionFields)
+		if err != nil {
+			t.Errorf("Error compiling %s: %v", tbl.expression, err)
+			continue
+		}
+		if actual := expr.Eval(record); actual != tbl.expected {
+			t.Errorf("%s evaluated to %v, expected %v", tbl.expression, actual,
+				tbl.expected)
+		}
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	tables := []struct {
+		expression string
+		errPart    string
+	}{
+		{`pid == 0`, "Unknown field pid"},
+		{`argv == "a"`, "can't be used"},
+		{`uid == "0"`, "Can't compare number with string"},
+		{`uid startsWith "0"`, "doesn't work on number"},
+		{`uid`, "expected a condition"},
+		{`uid == 0 &&`, "Expected a field or value"},
+		{`uid == 0 && ret`, "needs conditions"},
+		{`(uid == 0`, "Expected )"},
+		{`fname == "/proc`, "Unterminated string"},
+		{`fname matches "("`, "Invalid pattern"},
+		{`fname matches fname`, "string literal"},
+		{`uid == 0 uid`, "Unexpected uid"},
+		{`uid = 0`, "Unexpected '='"},
+	}
+	for _, tbl := range tables {
+		_, err := CompileFilterExpression(tbl.expression, expressionFields)
+		if err == nil || !strings.Contains(err.Error(), tbl.errPart) {
+			t.Errorf("%s returned error %v, expected one containing %q",
+				tbl.expression, err, tbl.errPart)
+		}
+	}
+}
+
+// Confirm output filters are compiled against every field of the output,
+// including keys
+func TestParseConfigOutputFilter(t *testing.T) {
+	input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: counts
+        type: BPF_HASH
+        poll: 1s
+        key:
+          name: cpu
+        filter: cpu == 0 && count > 10
+        format:
+          - name: count
+            type: u64
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	if config.Programs[0].Outputs[0].CompiledFilter == nil {
+		t.Errorf("Output filter was not compiled")
+	}
+
+	input = strings.Replace(input, "cpu == 0", "pid == 0", 1)
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Output filter with unknown field did not throw error")
+	}
+}
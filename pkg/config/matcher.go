@@ -4,16 +4,109 @@ package config
 
 import (
 	"fmt"
+	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/onsi/gomega"
 	"github.com/onsi/gomega/types"
 )
 
+// Problem compiling one matcher in a filter
+type MatcherError struct {
+	// Name of the offending matcher, e.g. have-prefix. Empty for bare values
+	Matcher string
+	// Value the matcher was given
+	Value interface{}
+	Msg   string
+}
+
+func (e *MatcherError) Error() string {
+	if e.Matcher == "" {
+		return fmt.Sprintf("%s: %v", e.Msg, e.Value)
+	}
+	return fmt.Sprintf("%s %v: %s", e.Matcher, e.Value, e.Msg)
+}
+
+// Malformed filter in a config, naming where it was found
+type FilterError struct {
+	Program string
+	Output  string
+	Field   string
+	Err     *MatcherError
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf(
+		"matcher.go: Invalid filter on program %s, output %s, field %s: %s",
+		e.Program, e.Output, e.Field, e.Err)
+}
+
+// Compile the filter on a format, naming the program, output and field in any
+// error
+func compileFilter(prog *BPFProgram, output *BPFOutput,
+	format *BPFOutputFormat) (types.GomegaMatcher, error) {
+
+	compiled, err := compileGomegaMatcher(format.Filter)
+	if err == nil {
+		err = checkMatcherKinds(format.Filter, format)
+		if err == nil {
+			return compiled, nil
+		}
+	}
+	matcherErr, ok := err.(*MatcherError)
+	if !ok {
+		matcherErr = &MatcherError{Value: format.Filter, Msg: err.Error()}
+	}
+	return nil, &FilterError{Program: prog.Name(), Output: output.Id,
+		Field: format.Name, Err: matcherErr}
+}
+
+// Strings in a filter that contain quote characters. Filters used to see
+// strings after they were quoted for output, so older configs match against
+// values like "\"/proc"
+func quotedFilterStrings(filter interface{}) []string {
+	var quoted []string
+	switch x := filter.(type) {
+	case string:
+		if strings.Contains(x, "\"") {
+			quoted = append(quoted, x)
+		}
+	case []interface{}:
+		for _, item := range x {
+			quoted = append(quoted, quotedFilterStrings(item)...)
+		}
+	case map[interface{}]interface{}:
+		for _, item := range x {
+			quoted = append(quoted, quotedFilterStrings(item)...)
+		}
+	}
+	sort.Strings(quoted)
+	return quoted
+}
+
+// Migration warnings for filters written against quoted strings
+func quotedFilterWarnings(prog *BPFProgram, output *BPFOutput,
+	format *BPFOutputFormat) []string {
+
+	var warnings []string
+	for _, quoted := range quotedFilterStrings(format.Filter) {
+		warnings = append(warnings, fmt.Sprintf(
+			"matcher.go: Filter on program %s, output %s, field %s matches %q, "+
+				"which contains a quote. Filters see raw unquoted values, so the "+
+				"quotes should be removed", prog.Name(), output.Id,
+			format.Name, quoted))
+	}
+	return warnings
+}
+
 func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 	switch x := matcher.(type) {
-	case string, int, bool, float64:
+	case string, bool:
 		return gomega.Equal(x), nil
+	case int, float64:
+		// Decoded numbers come in every width, so compare by value
+		return newInMatcher([]interface{}{x})
 	case []interface{}:
 		var matchers []types.GomegaMatcher
 		for _, valueI := range x {
@@ -25,13 +118,22 @@ func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 		}
 		return gomega.And(matchers...), nil
 	}
-	matcher = sanitizeExpectedValue(matcher)
+	matcher, err := sanitizeExpectedValue(matcher)
+	if err != nil {
+		return nil, err
+	}
 	if matcher == nil {
-		return nil, fmt.Errorf("Missing Required Attribute")
+		return nil, &MatcherError{Msg: "Missing Required Attribute"}
 	}
 	matcherMap, ok := matcher.(map[string]interface{})
 	if !ok {
-		panic(fmt.Sprintf("Unexpected matcher type: %T\n\n", matcher))
+		return nil, &MatcherError{Value: matcher,
+			Msg: fmt.Sprintf("Unexpected matcher type %T", matcher)}
+	}
+	if len(matcherMap) != 1 {
+		return nil, &MatcherError{Value: matcherMap,
+			Msg: fmt.Sprintf("Expected exactly one matcher, got %d",
+				len(matcherMap))}
 	}
 	var matchType string
 	var value interface{}
@@ -39,24 +141,38 @@ func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 		break
 	}
 	switch matchType {
-	case "have-prefix":
-		return gomega.HavePrefix(value.(string)), nil
-	case "have-suffix":
-		return gomega.HaveSuffix(value.(string)), nil
-	case "match-regexp":
-		return gomega.MatchRegexp(value.(string)), nil
+	case "have-prefix", "have-suffix", "match-regexp":
+		str, ok := value.(string)
+		if !ok {
+			return nil, &MatcherError{Matcher: matchType, Value: value,
+				Msg: fmt.Sprintf("Expected a string, got %T", value)}
+		}
+		switch matchType {
+		case "have-prefix":
+			return gomega.HavePrefix(str), nil
+		case "have-suffix":
+			return gomega.HaveSuffix(str), nil
+		}
+		if _, err := regexp.Compile(str); err != nil {
+			return nil, &MatcherError{Matcher: matchType, Value: value,
+				Msg: err.Error()}
+		}
+		return gomega.MatchRegexp(str), nil
 	case "have-len":
-		value = sanitizeExpectedValue(value)
-		return gomega.HaveLen(value.(int)), nil
-	case "have-key-with-value":
-		subMatchers, err := mapToGomega(value)
+		value, err = sanitizeExpectedValue(value)
 		if err != nil {
 			return nil, err
 		}
-		for key, val := range subMatchers {
-			if val == nil {
-				fmt.Printf("%d is nil", key)
-			}
+		length, ok := value.(int)
+		if !ok {
+			return nil, &MatcherError{Matcher: matchType, Value: value,
+				Msg: fmt.Sprintf("Expected an integer, got %T", value)}
+		}
+		return gomega.HaveLen(length), nil
+	case "have-key-with-value":
+		subMatchers, err := mapToGomega(matchType, value)
+		if err != nil {
+			return nil, err
 		}
 		return gomega.And(subMatchers...), nil
 	case "have-key":
@@ -78,7 +194,7 @@ func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 		}
 		return gomega.Not(subMatcher), nil
 	case "consist-of":
-		subMatchers, err := sliceToGomega(value)
+		subMatchers, err := sliceToGomega(matchType, value)
 		if err != nil {
 			return nil, err
 		}
@@ -88,13 +204,13 @@ func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 		}
 		return gomega.ConsistOf(interfaceSlice...), nil
 	case "and":
-		subMatchers, err := sliceToGomega(value)
+		subMatchers, err := sliceToGomega(matchType, value)
 		if err != nil {
 			return nil, err
 		}
 		return gomega.And(subMatchers...), nil
 	case "or":
-		subMatchers, err := sliceToGomega(value)
+		subMatchers, err := sliceToGomega(matchType, value)
 		if err != nil {
 			return nil, err
 		}
@@ -107,18 +223,41 @@ func compileGomegaMatcher(matcher interface{}) (types.GomegaMatcher, error) {
 			"lt": "<",
 			"le": "<=",
 		}[matchType]
+		switch value.(type) {
+		case int, float64:
+		default:
+			return nil, &MatcherError{Matcher: matchType, Value: value,
+				Msg: fmt.Sprintf("Expected a number, got %T", value)}
+		}
 		return gomega.BeNumerically(comparator, value), nil
 
+	case "in":
+		return newInMatcher(value)
+	case "between":
+		return newBetweenMatcher(value)
+	case "cidr":
+		return newCIDRMatcher(value)
+	case "glob":
+		return newGlobMatcher(value)
+
 	default:
-		return nil, fmt.Errorf("Unknown matcher: %s", matchType)
+		return nil, &MatcherError{Matcher: matchType, Value: value,
+			Msg: "Unknown matcher"}
 
 	}
 }
 
-func mapToGomega(value interface{}) (subMatchers []types.GomegaMatcher, err error) {
+func mapToGomega(matchType string,
+	value interface{}) (subMatchers []types.GomegaMatcher, err error) {
+
+	value, err = sanitizeExpectedValue(value)
+	if err != nil {
+		return nil, err
+	}
 	valueI, ok := value.(map[string]interface{})
 	if !ok {
-		return nil, fmt.Errorf("Matcher expected map, got: %t", value)
+		return nil, &MatcherError{Matcher: matchType, Value: value,
+			Msg: fmt.Sprintf("Expected a map, got %T", value)}
 	}
 
 	// Get keys
@@ -130,10 +269,9 @@ func mapToGomega(value interface{}) (subMatchers []types.GomegaMatcher, err erro
 	// does not guarantee order
 	sort.Strings(keys)
 	for _, key := range keys {
-		val := valueI[key]
-		val, err = compileGomegaMatcher(val)
+		val, err := compileGomegaMatcher(valueI[key])
 		if err != nil {
-			return
+			return nil, err
 		}
 
 		subMatcher := gomega.HaveKeyWithValue(key, val)
@@ -142,10 +280,13 @@ func mapToGomega(value interface{}) (subMatchers []types.GomegaMatcher, err erro
 	return
 }
 
-func sliceToGomega(value interface{}) ([]types.GomegaMatcher, error) {
+func sliceToGomega(matchType string,
+	value interface{}) ([]types.GomegaMatcher, error) {
+
 	valueI, ok := value.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("Matcher expected array, got: %t", value)
+		return nil, &MatcherError{Matcher: matchType, Value: value,
+			Msg: fmt.Sprintf("Expected a list, got %T", value)}
 	}
 	var subMatchers []types.GomegaMatcher
 	for _, v := range valueI {
@@ -159,20 +300,25 @@ func sliceToGomega(value interface{}) ([]types.GomegaMatcher, error) {
 }
 
 // Normalize expectedValue so json and yaml are the same
-func sanitizeExpectedValue(i interface{}) interface{} {
+func sanitizeExpectedValue(i interface{}) (interface{}, error) {
 	if e, ok := i.(float64); ok {
-		return int(e)
+		return int(e), nil
 	}
 	if e, ok := i.(map[interface{}]interface{}); ok {
 		out := make(map[string]interface{})
 		for k, v := range e {
 			ks, ok := k.(string)
 			if !ok {
-				panic(fmt.Sprintf("Matcher key type not string: %T\n\n", k))
+				return nil, &MatcherError{Value: k,
+					Msg: fmt.Sprintf("Matcher key type not string: %T", k)}
+			}
+			sanitized, err := sanitizeExpectedValue(v)
+			if err != nil {
+				return nil, err
 			}
-			out[ks] = sanitizeExpectedValue(v)
+			out[ks] = sanitized
 		}
-		return out
+		return out, nil
 	}
-	return i
+	return i, nil
 }
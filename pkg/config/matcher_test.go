@@ -0,0 +1,246 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Confirm malformed filters become errors naming where they were found
+// instead of panicking
+func TestParseConfigFilterErrors(t *testing.T) {
+	tables := []struct {
+		filter  string
+		matcher string
+	}{
+		// Non-string map key
+		{"{1: bash}", ""},
+		// More than one matcher in a map
+		{"{have-prefix: a, have-suffix: b}", ""},
+		// Value types yaml can produce but matchers can't take
+		{"18446744073709551615", ""},
+		{"have-prefix: 3", "have-prefix"},
+		{"have-suffix: [a]", "have-suffix"},
+		{"match-regexp: \"(\"", "match-regexp"},
+		{"have-len: abc", "have-len"},
+		{"gt: abc", "gt"},
+		{"and: abc", "and"},
+		{"or: {have-prefix: a}", "or"},
+		{"consist-of: 3", "consist-of"},
+		{"have-key-with-value: [a]", "have-key-with-value"},
+		{"unknown-matcher: a", "unknown-matcher"},
+		// Errors from nested matchers name the innermost matcher
+		{"not: {have-len: abc}", "have-len"},
+		{"or: [{have-prefix: a}, {lt: a}]", "lt"},
+		{"have-key-with-value: {comm: {have-suffix: 1}}", "have-suffix"},
+		{"not: ~", ""},
+		// Custom matchers
+		{"in: 3", "in"},
+		{"in: [a, [b]]", "in"},
+		{"between: [1]", "between"},
+		{"between: [a, 2]", "between"},
+		{"between: [5, 1]", "between"},
+		{"cidr: 10.0.0.0/33", "cidr"},
+		{"cidr: [10.0.0.0/8, 3]", "cidr"},
+		{"glob: \"[\"", "glob"},
+		{"glob: 3", "glob"},
+	}
+
+	for _, tbl := range tables {
+		input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: comm
+            type: char[16]
+            filter:
+              ` + tbl.filter + "\n"
+
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Filter %s panicked: %v", tbl.filter, r)
+				}
+			}()
+			_, err = ParseConfig(strings.NewReader(input))
+		}()
+
+		filterErr, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("Filter %s returned %T %v, expected *FilterError",
+				tbl.filter, err, err)
+			continue
+		}
+		if filterErr.Program != "test.c" || filterErr.Output != "events" ||
+			filterErr.Field != "comm" {
+			t.Errorf("Filter error %v does not name program, output and field",
+				filterErr)
+		}
+		if filterErr.Err.Matcher != tbl.matcher {
+			t.Errorf("Filter %s failed on matcher %q, expected %q", tbl.filter,
+				filterErr.Err.Matcher, tbl.matcher)
+		}
+	}
+}
+
+// Confirm well formed filters still compile
+func TestParseConfigFilters(t *testing.T) {
+	filters := []string{
+		"bash",
+		"3",
+		"have-prefix: ba",
+		"match-regexp: ^ba.h$",
+		"have-len: 4",
+		"gt: 2.5",
+		"or: [{have-prefix: a}, {not: {have-suffix: b}}]",
+		"have-key-with-value: {comm: bash}",
+	}
+	for _, filter := range filters {
+		input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: comm
+            type: char[16]
+            filter:
+              ` + filter + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("Filter %s returned error: %v", filter, err)
+			continue
+		}
+		if config.Programs[0].Outputs[0].Format[0].CompiledFilter == nil {
+			t.Errorf("Filter %s was not compiled", filter)
+		}
+	}
+}
+
+// Confirm custom matchers are checked against the type of their field
+func TestParseConfigFilterKinds(t *testing.T) {
+	tables := []struct {
+		fieldType string
+		isIP      bool
+		filter    string
+		matcher   string
+	}{
+		{"char[16]", false, "glob: /tmp/*", ""},
+		{"u32", false, "glob: /tmp/*", "glob"},
+		{"u32", true, "glob: 10.*", "glob"},
+		{"u16", false, "between: [1024, 65535]", ""},
+		{"char[16]", false, "between: [1, 2]", "between"},
+		{"u32", true, "cidr: 10.0.0.0/8", ""},
+		{"char[46]", false, "cidr: 10.0.0.0/8", ""},
+		{"u64", false, "cidr: 10.0.0.0/8", "cidr"},
+		{"u32", false, "in: [0, 1000]", ""},
+		{"char[16]", false, "in: [bash, sh]", ""},
+		{"u32", false, "in: [0, root]", "in"},
+		{"char[16]", false, "in: [bash, 3]", "in"},
+		{"u32", true, "in: [10.0.0.1]", "in"},
+		// Nested matchers are checked too
+		{"u32", false, "not: {glob: /tmp/*}", "glob"},
+		{"u32", false, "or: [{between: [1, 2]}, {glob: a}]", "glob"},
+	}
+	for _, tbl := range tables {
+		input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: field
+            type: ` + tbl.fieldType + `
+            isIP: ` + strconv.FormatBool(tbl.isIP) + `
+            filter:
+              ` + tbl.filter + "\n"
+		_, err := ParseConfig(strings.NewReader(input))
+		if tbl.matcher == "" {
+			if err != nil {
+				t.Errorf("Filter %s on %s returned error: %v", tbl.filter,
+					tbl.fieldType, err)
+			}
+			continue
+		}
+		filterErr, ok := err.(*FilterError)
+		if !ok || filterErr.Err.Matcher != tbl.matcher {
+			t.Errorf("Filter %s on %s returned %v, expected a %s error",
+				tbl.filter, tbl.fieldType, err, tbl.matcher)
+		}
+	}
+}
+
+// Confirm only known filter actions are accepted, on fields and outputs
+func TestParseConfigFilterAction(t *testing.T) {
+	tables := []struct {
+		outputAction string
+		fieldAction  string
+		expectErr    bool
+	}{
+		{"", "", false},
+		{"keep", "drop", false},
+		{"drop", "keep", false},
+		{"include", "", true},
+		{"", "Keep", true},
+	}
+	for _, tbl := range tables {
+		input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        filter: pid == 1
+        filterAction: "` + tbl.outputAction + `"
+        format:
+          - name: pid
+            type: u32
+            filter: 1
+            filterAction: "` + tbl.fieldAction + `"
+`
+		_, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Actions %q and %q returned error %v", tbl.outputAction,
+				tbl.fieldAction, err)
+		}
+	}
+}
+
+// Confirm filters written against quoted strings load with a warning
+func TestParseConfigQuotedFilterWarning(t *testing.T) {
+	input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: opens
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: fname
+            type: char[255]
+            filter:
+              or:
+                - have-prefix: "\"/proc"
+                - have-prefix: /sys
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	if len(config.Warnings) != 1 ||
+		!strings.Contains(config.Warnings[0], `"\"/proc"`) {
+		t.Errorf("Expected one warning about the quoted filter, got %v",
+			config.Warnings)
+	}
+
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != 2 || !errs[1].Warning || errs[0].Warning {
+		t.Errorf("Expected a missing source error and a quote warning, got %v",
+			errs)
+	}
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Matchers for values gomega can't express cleanly. They work on decoded
+// values: integers of any width, strings and IPs
+
+// Normalize a decoded or literal number to int64, uint64 or float64
+func normalizeNumber(value interface{}) (interface{}, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		if v.Int() < 0 {
+			return v.Int(), true
+		}
+		return uint64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return v.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return nil, false
+}
+
+// Key for a value in a set. Numbers that are equal share a key regardless of
+// their type
+func setKey(value interface{}) (string, bool) {
+	if str, ok := value.(string); ok {
+		return "s" + str, true
+	}
+	number, ok := normalizeNumber(value)
+	if !ok {
+		return "", false
+	}
+	switch n := number.(type) {
+	case int64:
+		return "n" + strconv.FormatInt(n, 10), true
+	case uint64:
+		return "n" + strconv.FormatUint(n, 10), true
+	}
+	f := number.(float64)
+	if f == float64(int64(f)) {
+		return "n" + strconv.FormatInt(int64(f), 10), true
+	}
+	return "f" + strconv.FormatFloat(f, 'g', -1, 64), true
+}
+
+// Matches values in a set of strings and numbers, with constant time lookup
+type inMatcher struct {
+	values []interface{}
+	set    map[string]struct{}
+}
+
+func newInMatcher(value interface{}) (*inMatcher, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, &MatcherError{Matcher: "in", Value: value,
+			Msg: fmt.Sprintf("Expected a list, got %T", value)}
+	}
+	m := &inMatcher{values: values, set: make(map[string]struct{})}
+	for _, item := range values {
+		key, ok := setKey(item)
+		if !ok {
+			return nil, &MatcherError{Matcher: "in", Value: value,
+				Msg: fmt.Sprintf("Expected strings or numbers, got %T", item)}
+		}
+		m.set[key] = struct{}{}
+	}
+	return m, nil
+}
+
+func (m *inMatcher) Match(actual interface{}) (bool, error) {
+	key, ok := setKey(actual)
+	if !ok {
+		return false, fmt.Errorf("in matcher expects a string or number, got %T",
+			actual)
+	}
+	_, found := m.set[key]
+	return found, nil
+}
+
+func (m *inMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v to be in %v", actual, m.values)
+}
+
+func (m *inMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v not to be in %v", actual, m.values)
+}
+
+// Matches numbers in an inclusive range
+type betweenMatcher struct {
+	low, high interface{}
+}
+
+func newBetweenMatcher(value interface{}) (*betweenMatcher, error) {
+	bounds, ok := value.([]interface{})
+	if !ok || len(bounds) != 2 {
+		return nil, &MatcherError{Matcher: "between", Value: value,
+			Msg: "Expected a list of two numbers"}
+	}
+	low, lowOk := normalizeNumber(bounds[0])
+	high, highOk := normalizeNumber(bounds[1])
+	if !lowOk || !highOk {
+		return nil, &MatcherError{Matcher: "between", Value: value,
+			Msg: "Expected a list of two numbers"}
+	}
+	if compareNumbers(low, high) > 0 {
+		return nil, &MatcherError{Matcher: "between", Value: value,
+			Msg: "Lower bound is above upper bound"}
+	}
+	return &betweenMatcher{low: low, high: high}, nil
+}
+
+func (m *betweenMatcher) Match(actual interface{}) (bool, error) {
+	number, ok := normalizeNumber(actual)
+	if !ok {
+		return false, fmt.Errorf("between matcher expects a number, got %T",
+			actual)
+	}
+	return compareNumbers(number, m.low) >= 0 &&
+		compareNumbers(number, m.high) <= 0, nil
+}
+
+func (m *betweenMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v to be between %v and %v", actual, m.low,
+		m.high)
+}
+
+func (m *betweenMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v not to be between %v and %v", actual, m.low,
+		m.high)
+}
+
+// Matches IPs inside any of a list of CIDR ranges
+type cidrMatcher struct {
+	networks []*net.IPNet
+}
+
+func newCIDRMatcher(value interface{}) (*cidrMatcher, error) {
+	ranges, ok := value.([]interface{})
+	if !ok {
+		ranges = []interface{}{value}
+	}
+	m := &cidrMatcher{}
+	for _, item := range ranges {
+		cidr, ok := item.(string)
+		if !ok {
+			return nil, &MatcherError{Matcher: "cidr", Value: value,
+				Msg: fmt.Sprintf("Expected a CIDR string, got %T", item)}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, &MatcherError{Matcher: "cidr", Value: value,
+				Msg: err.Error()}
+		}
+		m.networks = append(m.networks, network)
+	}
+	return m, nil
+}
+
+// Read an IP out of a decoded value. u32 values are IPv4 addresses in network
+// byte order, as isIP fields are decoded
+func toIP(value interface{}) (net.IP, bool) {
+	switch v := value.(type) {
+	case net.IP:
+		return v, true
+	case string:
+		ip := net.ParseIP(v)
+		return ip, ip != nil
+	case uint32:
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, v)
+		return ip, true
+	}
+	return nil, false
+}
+
+func (m *cidrMatcher) Match(actual interface{}) (bool, error) {
+	ip, ok := toIP(actual)
+	if !ok {
+		return false, fmt.Errorf("cidr matcher expects an IP, got %T", actual)
+	}
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *cidrMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v to be in %v", actual, m.networks)
+}
+
+func (m *cidrMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v not to be in %v", actual, m.networks)
+}
+
+// Matches strings against a shell style glob, where * and ? don't cross /
+type globMatcher struct {
+	pattern string
+}
+
+func newGlobMatcher(value interface{}) (*globMatcher, error) {
+	pattern, ok := value.(string)
+	if !ok {
+		return nil, &MatcherError{Matcher: "glob", Value: value,
+			Msg: fmt.Sprintf("Expected a string, got %T", value)}
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, &MatcherError{Matcher: "glob", Value: value, Msg: err.Error()}
+	}
+	return &globMatcher{pattern: pattern}, nil
+}
+
+func (m *globMatcher) Match(actual interface{}) (bool, error) {
+	str, ok := actual.(string)
+	if !ok {
+		return false, fmt.Errorf("glob matcher expects a string, got %T", actual)
+	}
+	return path.Match(m.pattern, str)
+}
+
+func (m *globMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v to match glob %s", actual, m.pattern)
+}
+
+func (m *globMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected %v not to match glob %s", actual, m.pattern)
+}
+
+// Kind of value a field is decoded to: char arrays become strings and isIP
+// fields IPs, everything else is a number
+func fieldValueKind(format *BPFOutputFormat) string {
+	switch {
+	case strings.Contains(format.Type, "["):
+		return "string"
+	case format.IsIP:
+		return "IP"
+	}
+	return "number"
+}
+
+// Check the custom matchers in a filter can match the field's decoded value,
+// so a mismatch fails at load time rather than on every record
+func checkMatcherKinds(filter interface{}, format *BPFOutputFormat) error {
+	switch x := filter.(type) {
+	case []interface{}:
+		for _, item := range x {
+			if err := checkMatcherKinds(item, format); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, value := range x {
+			matchType, _ := key.(string)
+			if err := checkMatcherKind(matchType, value, format); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkMatcherKind(matchType string, value interface{},
+	format *BPFOutputFormat) error {
+
+	kind := fieldValueKind(format)
+	var expected []string
+	switch matchType {
+	case "not", "and", "or":
+		return checkMatcherKinds(value, format)
+	case "glob":
+		expected = []string{"string"}
+	case "between":
+		expected = []string{"number"}
+	case "cidr":
+		expected = []string{"IP", "string"}
+	case "in":
+		expected = []string{"string", "number"}
+		// Values of another kind than the field's never match
+		for _, item := range value.([]interface{}) {
+			_, isString := item.(string)
+			if kind != "IP" && isString != (kind == "string") {
+				return &MatcherError{Matcher: matchType, Value: value,
+					Msg: fmt.Sprintf("Field %s is a %s, but %v is not", format.Name,
+						kind, item)}
+			}
+		}
+	default:
+		return nil
+	}
+	if !contains(expected, kind) {
+		return &MatcherError{Matcher: matchType, Value: value,
+			Msg: fmt.Sprintf("Field %s of type %s is a %s, expected a %s",
+				format.Name, format.Type, kind, strings.Join(expected, " or "))}
+	}
+	return nil
+}
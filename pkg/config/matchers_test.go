@@ -0,0 +1,88 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+// Confirm the custom matchers work on values as the decoder produces them
+func TestCustomMatchers(t *testing.T) {
+	tables := []struct {
+		filter   map[interface{}]interface{}
+		actual   interface{}
+		expected bool
+	}{
+		{map[interface{}]interface{}{"in": []interface{}{0, 1000, "root"}},
+			uint32(1000), true},
+		{map[interface{}]interface{}{"in": []interface{}{0, 1000, "root"}},
+			int32(-1), false},
+		{map[interface{}]interface{}{"in": []interface{}{0, 1000, "root"}},
+			"root", true},
+		{map[interface{}]interface{}{"in": []interface{}{"bash", "sh"}},
+			"zsh", false},
+		{map[interface{}]interface{}{"between": []interface{}{1024, 65535}},
+			uint16(8080), true},
+		{map[interface{}]interface{}{"between": []interface{}{1024, 65535}},
+			uint16(443), false},
+		{map[interface{}]interface{}{"between": []interface{}{-10, 0.5}},
+			int64(-10), true},
+		{map[interface{}]interface{}{"cidr": "10.0.0.0/8"},
+			net.IPv4(10, 1, 2, 3), true},
+		{map[interface{}]interface{}{"cidr": "10.0.0.0/8"},
+			net.IPv4(192, 168, 0, 1), false},
+		// isIP u32 fields hold addresses in network byte order
+		{map[interface{}]interface{}{
+			"cidr": []interface{}{"192.168.0.0/16", "10.0.0.0/8"}},
+			uint32(0x0100a8c0), true},
+		{map[interface{}]interface{}{"cidr": "fd00::/8"}, "fd00::1", true},
+		{map[interface{}]interface{}{"glob": "/lustre/*/scratch/*"},
+			"/lustre/proj/scratch/out.dat", true},
+		{map[interface{}]interface{}{"glob": "/lustre/*/scratch/*"},
+			"/lustre/proj/home/out.dat", false},
+		{map[interface{}]interface{}{"glob": "*.so.?"}, "libc.so.6", true},
+		{map[interface{}]interface{}{
+			"not": map[interface{}]interface{}{"glob": "/proc/*"}},
+			"/proc/self", false},
+	}
+	for _, tbl := range tables {
+		matcher, err := compileGomegaMatcher(tbl.filter)
+		if err != nil {
+			t.Errorf("Error compiling %v: %v", tbl.filter, err)
+			continue
+		}
+		actual, err := matcher.Match(tbl.actual)
+		if err != nil {
+			t.Errorf("Error matching %v against %v: %v", tbl.actual, tbl.filter,
+				err)
+			continue
+		}
+		if actual != tbl.expected {
+			t.Errorf("%v against %v returned %v, expected %v", tbl.actual,
+				tbl.filter, actual, tbl.expected)
+		}
+	}
+}
+
+// Confirm values of the wrong type are errors at match time
+func TestCustomMatchersWrongType(t *testing.T) {
+	tables := []struct {
+		filter map[interface{}]interface{}
+		actual interface{}
+	}{
+		{map[interface{}]interface{}{"between": []interface{}{1, 2}}, "a"},
+		{map[interface{}]interface{}{"cidr": "10.0.0.0/8"}, "not an ip"},
+		{map[interface{}]interface{}{"glob": "*"}, uint8(1)},
+		{map[interface{}]interface{}{"in": []interface{}{1}}, true},
+	}
+	for _, tbl := range tables {
+		matcher, err := compileGomegaMatcher(tbl.filter)
+		if err != nil {
+			t.Errorf("Error compiling %v: %v", tbl.filter, err)
+			continue
+		}
+		if _, err := matcher.Match(tbl.actual); err == nil {
+			t.Errorf("Matching %v against %v did not throw error", tbl.actual,
+				tbl.filter)
+		}
+	}
+}
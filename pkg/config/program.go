@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"text/template"
+
+	"github.com/olcf/greggd"
+)
+
+// Flags to compile the program's source with: its cflags, then a -D flag for
+// each define in name order
+func (prog *BPFProgram) CompilerFlags() []string {
+	flags := append([]string{}, prog.CFlags...)
+	names := make([]string, 0, len(prog.Defines))
+	for name := range prog.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flags = append(flags, fmt.Sprintf("-D%s=%s", name, prog.Defines[name]))
+	}
+	return flags
+}
+
+// Name a program by the file or sensor it is loaded from
+func (prog *BPFProgram) Name() string {
+	switch {
+	case prog.Source != "":
+		return prog.Source
+	case prog.Object != "":
+		return prog.Object
+	}
+	return prog.Sensor
+}
+
+// Read the program's source, rendered with its defines if it is templated
+func (prog *BPFProgram) ReadSource() (string, error) {
+	source, err := prog.readRawSource()
+	if err != nil {
+		return "", fmt.Errorf("program.go: Failed to read program source %s: %s",
+			prog.Name(), err)
+	}
+	return prog.renderSource(string(source))
+}
+
+// Read the program's source as it is on disk, or from the sensor library when
+// a sensor's bundled source isn't overridden
+func (prog *BPFProgram) readRawSource() ([]byte, error) {
+	if prog.Source == "" && prog.LibrarySource != "" {
+		return greggd.Library.ReadFile(path.Join("csrc", prog.LibrarySource))
+	}
+	return ioutil.ReadFile(prog.Source)
+}
+
+// Programs that set templateSource have their source rendered as a
+// text/template, with the defines as its data, e.g. `{{ .TARGET_UID }}`.
+// Defines that aren't set render as empty strings. Other sources are used as
+// they are, so C that happens to contain `{{` isn't mangled
+func (prog *BPFProgram) renderSource(source string) (string, error) {
+	if !prog.TemplateSource {
+		return source, nil
+	}
+	tmpl, err := template.New(prog.Name()).Option("missingkey=zero").
+		Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("program.go: Error parsing source %s as a template: %s",
+			prog.Name(), err)
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, prog.Defines)
+	if err != nil {
+		return "", fmt.Errorf("program.go: Error rendering source %s: %s",
+			prog.Name(), err)
+	}
+	return rendered.String(), nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Confirm defines become -D flags after the program's own cflags
+func TestCompilerFlags(t *testing.T) {
+	prog := BPFProgram{CFlags: []string{"-O2", "-Wno-unused"},
+		Defines: map[string]string{"TARGET_UID": "1000", "MIN_LATENCY_US": "500"}}
+	expected := []string{"-O2", "-Wno-unused", "-DMIN_LATENCY_US=500",
+		"-DTARGET_UID=1000"}
+	if actual := prog.CompilerFlags(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Flags %v do not match expected %v", actual, expected)
+	}
+	if actual := (&BPFProgram{}).CompilerFlags(); len(actual) != 0 {
+		t.Errorf("Program without flags returned %v", actual)
+	}
+}
+
+// Confirm sources are templated only when the program asks for it
+func TestRenderSource(t *testing.T) {
+	source := `if (uid != {{ .TARGET_UID }}) return 0;{{ if .VERBOSE }} log();{{ end }}`
+	tables := []struct {
+		defines  map[string]string
+		template bool
+		expected string
+	}{
+		{map[string]string{"TARGET_UID": "1000"}, true,
+			"if (uid != 1000) return 0;"},
+		{map[string]string{"TARGET_UID": "0", "VERBOSE": "1"}, true,
+			"if (uid != 0) return 0; log();"},
+		{nil, false, source},
+		// Defines alone only become -D flags
+		{map[string]string{"TARGET_UID": "1000"}, false, source},
+	}
+	for _, tbl := range tables {
+		prog := BPFProgram{Source: "test.c", Defines: tbl.defines,
+			TemplateSource: tbl.template}
+		actual, err := prog.renderSource(source)
+		if err != nil {
+			t.Errorf("Error rendering with %v: %v", tbl.defines, err)
+			continue
+		}
+		if actual != tbl.expected {
+			t.Errorf("Rendered %q, expected %q", actual, tbl.expected)
+		}
+	}
+
+	prog := BPFProgram{Source: "test.c", Defines: map[string]string{"A": "1"},
+		TemplateSource: true}
+	if _, err := prog.renderSource("{{ .A "); err == nil {
+		t.Errorf("Invalid template did not throw error")
+	}
+}
+
+// Confirm defines load from yaml, size arrays in derived formats and are
+// rejected for precompiled objects
+func TestParseConfigDefines(t *testing.T) {
+	sourceFile, err := ioutil.TempFile("", "greggd-*.c")
+	if err != nil {
+		t.Fatalf("Error creating source: %v", err)
+	}
+	defer os.Remove(sourceFile.Name())
+	sourceFile.WriteString(`
+struct data_t {
+    u32 pid;
+    char path[{{ .PATH_LEN }}];
+};
+BPF_PERF_OUTPUT(events);
+int trace(struct pt_regs *ctx) {
+    struct data_t data = {};
+#ifdef TARGET_PID
+    if (bpf_get_current_pid_tgid() >> 32 != TARGET_PID)
+        return 0;
+#endif
+    events.perf_submit(ctx, &data, sizeof(data));
+    return 0;
+}
+`)
+	sourceFile.Close()
+
+	input := `
+programs:
+  - source: ` + sourceFile.Name() + `
+    cflags: [-O2]
+    templateSource: true
+    defines:
+      TARGET_PID: 1234
+      PATH_LEN: 64
+    outputs:
+      - id: events
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	prog := config.Programs[0]
+	expectedFlags := []string{"-O2", "-DPATH_LEN=64", "-DTARGET_PID=1234"}
+	if flags := prog.CompilerFlags(); !reflect.DeepEqual(flags, expectedFlags) {
+		t.Errorf("Flags %v do not match expected %v", flags, expectedFlags)
+	}
+	expectedFormat := []BPFOutputFormat{{Name: "pid", Type: "u32"},
+		{Name: "path", Type: "char[64]"}}
+	if !reflect.DeepEqual(prog.Outputs[0].Format, expectedFormat) {
+		t.Errorf("Derived format %v does not match expected %v",
+			prog.Outputs[0].Format, expectedFormat)
+	}
+	if errs := Validate(strings.NewReader(input)); len(errs) != 0 {
+		t.Errorf("Unexpected validation errors: %v", errs)
+	}
+
+	input = `
+programs:
+  - object: test.o
+    defines:
+      TARGET_PID: 1234
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Defines on a precompiled object did not throw error")
+	}
+}
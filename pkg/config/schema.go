@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/olcf/greggd"
+	"gopkg.in/yaml.v2"
+)
+
+// Definition of a field from the schema registry under api/schemas/fields
+type FieldSchema struct {
+	Name        string `yaml:"name" json:"name"`
+	Title       string `yaml:"title" json:"title,omitempty"`
+	Short       string `yaml:"short" json:"short,omitempty"`
+	Type        string `yaml:"type" json:"type"`
+	Description string `yaml:"description" json:"description,omitempty"`
+}
+
+// A tag or field of a measurement, described for consumers of the output
+type ColumnSchema struct {
+	FieldSchema
+	// How the value is written out: string, integer or ip
+	Kind string `json:"kind"`
+}
+
+// Tags and fields of the measurement written for one output
+type MeasurementSchema struct {
+	// Measurement in measurementMode sensor, before any prefix
+	Name string `json:"name"`
+	// Id of the output, written as the sensor tag
+	Output string         `json:"output"`
+	Tags   []ColumnSchema `json:"tags"`
+	Fields []ColumnSchema `json:"fields"`
+}
+
+// Load every field in the schema registry by name
+func FieldSchemas() (map[string]FieldSchema, error) {
+	files, err := fs.Glob(greggd.Library, "api/schemas/fields/*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("schema.go: Error listing field schemas: %s", err)
+	}
+	schemas := make(map[string]FieldSchema)
+	for _, file := range files {
+		input, err := greggd.Library.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("schema.go: Error reading %s: %s", file, err)
+		}
+		var fields []FieldSchema
+		err = yaml.UnmarshalStrict(input, &fields)
+		if err != nil {
+			return nil, fmt.Errorf("schema.go: Error unmarshalling %s: %s", file,
+				err)
+		}
+		for _, field := range fields {
+			field.Description = strings.TrimSpace(field.Description)
+			schemas[field.Name] = field
+		}
+	}
+	return schemas, nil
+}
+
+// Check a field named in the schema registry uses the type it declares
+func checkFieldSchema(format *BPFOutputFormat,
+	schemas map[string]FieldSchema) error {
+
+	schema, ok := schemas[format.Name]
+	if !ok || format.Type == "" || format.Type == schema.Type {
+		return nil
+	}
+	return fmt.Errorf("schema.go: Field %s is %s, the schema declares %s",
+		format.Name, format.Type, schema.Type)
+}
+
+// Describe the measurement written for an output. Struct keys are split into
+// tags and fields like the data, single value keys are written as a field.
+// Padding and timestamp fields aren't written
+func OutputSchema(prog *BPFProgram, output *BPFOutput,
+	schemas map[string]FieldSchema) MeasurementSchema {
+
+	measurement := MeasurementSchema{Name: output.Measurement,
+		Output: output.Id, Tags: []ColumnSchema{}, Fields: []ColumnSchema{}}
+	if measurement.Name == "" {
+		measurement.Name = ProgramMeasurement(prog)
+	}
+	formats := append(append([]BPFOutputFormat{}, output.KeyFormat...),
+		output.Format...)
+	if len(output.KeyFormat) == 0 && output.Key.Type != "" &&
+		!strings.EqualFold(output.Type, "BPF_PERF_OUTPUT") {
+		measurement.Fields = append(measurement.Fields,
+			columnSchema(output.Key, schemas))
+	}
+	for _, format := range formats {
+		if format.Name == "" || format.Name == "_" || format.Timestamp ||
+			strings.HasPrefix(format.Type, "pad") {
+			continue
+		}
+		column := columnSchema(format, schemas)
+		if format.IsTag || format.IsIP {
+			measurement.Tags = append(measurement.Tags, column)
+		} else {
+			measurement.Fields = append(measurement.Fields, column)
+		}
+	}
+	return measurement
+}
+
+// Describe a field with its schema, if the registry has one
+func columnSchema(format BPFOutputFormat,
+	schemas map[string]FieldSchema) ColumnSchema {
+
+	column := ColumnSchema{FieldSchema: schemas[format.Name], Kind: "integer"}
+	column.Name = format.Name
+	column.Type = format.Type
+	// Formatted and enum values are written as strings, whatever the type
+	switch {
+	case strings.HasPrefix(format.Type, "char"), format.FormatString != "",
+		len(format.Enum) != 0:
+		column.Kind = "string"
+	case format.IsIP:
+		column.Kind = "ip"
+	}
+	return column
+}
+
+// Measurements a sensor writes, for consumers of its output
+type SensorSchema struct {
+	Sensor       string              `json:"sensor"`
+	Description  string              `json:"description"`
+	Measurements []MeasurementSchema `json:"measurements"`
+}
+
+// Describe the measurements written by each of a sensor's outputs
+func (sensor *Sensor) Schema(schemas map[string]FieldSchema) SensorSchema {
+	sensorSchema := SensorSchema{Sensor: sensor.Name,
+		Description: sensor.Description}
+	prog := &BPFProgram{Sensor: sensor.Name}
+	for iOutput := range sensor.Program.Outputs {
+		sensorSchema.Measurements = append(sensorSchema.Measurements,
+			OutputSchema(prog, &sensor.Program.Outputs[iOutput], schemas))
+	}
+	return sensorSchema
+}
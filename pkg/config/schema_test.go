@@ -0,0 +1,128 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Confirm the registry loads and documents every field the sensors write
+func TestFieldSchemas(t *testing.T) {
+	schemas, err := FieldSchemas()
+	if err != nil {
+		t.Fatalf("Error loading field schemas: %v", err)
+	}
+	if schema := schemas["pid"]; schema.Type != "u32" ||
+		schema.Description != "Process ID" {
+		t.Errorf("Schema for pid was not loaded: %+v", schema)
+	}
+
+	sensors, err := Sensors()
+	if err != nil {
+		t.Fatalf("Error loading sensors: %v", err)
+	}
+	for _, sensor := range sensors {
+		for _, measurement := range sensor.Schema(schemas).Measurements {
+			for _, column := range append(measurement.Tags,
+				measurement.Fields...) {
+				if column.Title == "" {
+					t.Errorf("Field %s of sensor %s has no schema", column.Name,
+						sensor.Name)
+				}
+			}
+		}
+	}
+}
+
+// Confirm output schemas list what is written out, split as it is written
+func TestOutputSchema(t *testing.T) {
+	schemas := map[string]FieldSchema{
+		"slot": {Name: "slot", Title: "Slot", Type: "u64"},
+	}
+	tables := []struct {
+		output BPFOutput
+		tags   []string
+		fields []string
+	}{
+		{BPFOutput{Id: "events", Type: "BPF_PERF_OUTPUT",
+			Key: BPFOutputFormat{Name: "hash_key", Type: "u32"},
+			Format: []BPFOutputFormat{{Name: "ts", Type: "u64", Timestamp: true},
+				{Name: "pid", Type: "u32", IsTag: true}, {Name: "_", Type: "pad[4]"},
+				{Name: "addr", Type: "u32", IsIP: true}, {Name: "ret", Type: "int32"},
+				{Name: "flags", Type: "int32", FormatString: "%#o"},
+				{Name: "op", Type: "u8", Enum: map[int64]string{1: "read"}}}},
+			[]string{"pid", "addr"}, []string{"ret", "flags", "op"}},
+		{BPFOutput{Id: "dist", Type: "BPF_HASH",
+			Key:    BPFOutputFormat{Name: "slot", Type: "u64", IsTag: true},
+			Format: []BPFOutputFormat{{Name: "count", Type: "u64"}}},
+			[]string{}, []string{"slot", "count"}},
+		{BPFOutput{Id: "dist", Type: "BPF_HASH",
+			Key: BPFOutputFormat{Name: "hash_key", Type: "u32"},
+			KeyFormat: []BPFOutputFormat{{Name: "disk", Type: "char[32]",
+				IsTag: true}, {Name: "slot", Type: "u64"}},
+			Format: []BPFOutputFormat{{Name: "count", Type: "u64"}}},
+			[]string{"disk"}, []string{"slot", "count"}},
+	}
+	names := func(columns []ColumnSchema) []string {
+		list := []string{}
+		for _, column := range columns {
+			list = append(list, column.Name)
+		}
+		return list
+	}
+	for _, tbl := range tables {
+		measurement := OutputSchema(&BPFProgram{Source: "/opt/biolatency.c"},
+			&tbl.output, schemas)
+		if measurement.Name != "biolatency" ||
+			measurement.Output != tbl.output.Id ||
+			!reflect.DeepEqual(names(measurement.Tags), tbl.tags) ||
+			!reflect.DeepEqual(names(measurement.Fields), tbl.fields) {
+			t.Errorf("Schema %+v does not match tags %v and fields %v",
+				measurement, tbl.tags, tbl.fields)
+		}
+		for _, column := range append(measurement.Tags, measurement.Fields...) {
+			if column.Name == "slot" && column.Title != "Slot" {
+				t.Errorf("Field slot was not described from the registry: %+v",
+					column)
+			}
+			if column.Name == "addr" && column.Kind != "ip" ||
+				column.Name == "disk" && column.Kind != "string" ||
+				column.Name == "flags" && column.Kind != "string" ||
+				column.Name == "op" && column.Kind != "string" ||
+				column.Name == "count" && column.Kind != "integer" {
+				t.Errorf("Field %s has kind %s", column.Name, column.Kind)
+			}
+		}
+	}
+}
+
+// Confirm fields the registry knows are checked against its types
+func TestParseConfigFieldSchemas(t *testing.T) {
+	input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: events
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: pid
+            type: u64
+          - name: custom
+            type: u64
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	if len(config.Warnings) != 1 ||
+		!strings.Contains(config.Warnings[0], "pid is u64, the schema declares u32") {
+		t.Errorf("Expected one warning about pid, got %v", config.Warnings)
+	}
+
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != 2 || errs[1].Path != "programs[0].outputs[0].format[0].type" ||
+		errs[1].Warning {
+		t.Errorf("Expected a missing source error and a pid type error, got %v",
+			errs)
+	}
+}
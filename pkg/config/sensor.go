@@ -0,0 +1,250 @@
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/olcf/greggd"
+	"gopkg.in/yaml.v2"
+)
+
+// A program from the bundled sensor library with its canonical config
+type Sensor struct {
+	// Name programs refer to the sensor by, taken from its file name
+	Name string `yaml:"-"`
+	// What the sensor traces
+	Description string `yaml:"description"`
+	// Canonical config. Source names a file in the library's csrc directory
+	Program BPFProgram `yaml:"program"`
+}
+
+// Every sensor in the library, sorted by name
+func Sensors() ([]Sensor, error) {
+	files, err := fs.Glob(greggd.Library, "sensors/*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("sensor.go: Error listing sensors: %s", err)
+	}
+	sort.Strings(files)
+	var sensors []Sensor
+	for _, file := range files {
+		sensor, err := LoadSensor(strings.TrimSuffix(path.Base(file), ".yaml"))
+		if err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, *sensor)
+	}
+	return sensors, nil
+}
+
+// Load a sensor from the library by name
+func LoadSensor(name string) (*Sensor, error) {
+	input, err := greggd.Library.ReadFile(path.Join("sensors", name+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("sensor.go: Unknown sensor %q", name)
+	}
+	sensor := Sensor{Name: name}
+	err = yaml.UnmarshalStrict(input, &sensor)
+	if err != nil {
+		return nil, fmt.Errorf("sensor.go: Error unmarshalling sensor %s: %s", name,
+			err)
+	}
+	return &sensor, nil
+}
+
+// Fill in a program that names a sensor from the library. Settings in the
+// program override the sensor's: events replace the sensor's events, cflags
+// are appended, defines are merged and outputs are matched by id. Output
+// fields are matched by name, as overrides of derived formats are
+func applySensor(prog *BPFProgram) error {
+	if prog.Sensor == "" {
+		return nil
+	}
+	sensor, err := LoadSensor(prog.Sensor)
+	if err != nil {
+		return err
+	}
+	if prog.Object != "" {
+		return fmt.Errorf(
+			"sensor.go: Sensor %s is compiled from source, it can't use object %s",
+			prog.Sensor, prog.Object)
+	}
+	base := sensor.Program
+
+	prog.LibrarySource = base.Source
+	if len(prog.Events) == 0 {
+		prog.Events = base.Events
+	}
+	prog.CFlags = append(base.CFlags, prog.CFlags...)
+	prog.TemplateSource = prog.TemplateSource || base.TemplateSource
+	if len(base.Defines) != 0 {
+		defines := make(map[string]string)
+		for name, value := range base.Defines {
+			defines[name] = value
+		}
+		for name, value := range prog.Defines {
+			defines[name] = value
+		}
+		prog.Defines = defines
+	}
+
+	outputs := base.Outputs
+	for iOverride, override := range prog.Outputs {
+		var flags OutputOverride
+		if iOverride < len(prog.OutputOverrides) {
+			flags = prog.OutputOverrides[iOverride]
+		}
+		found := false
+		for i := range outputs {
+			if outputs[i].Id != override.Id {
+				continue
+			}
+			found = true
+			err = mergeOutputOverride(&outputs[i], &override, flags)
+			if err != nil {
+				return fmt.Errorf("sensor.go: Error in output %s of sensor %s: %s",
+					override.Id, prog.Sensor, err)
+			}
+		}
+		if !found {
+			return fmt.Errorf("sensor.go: Sensor %s has no output %s", prog.Sensor,
+				override.Id)
+		}
+	}
+	prog.Outputs = outputs
+	return nil
+}
+
+// Flags set on an output overriding a sensor's. Pointers tell a flag left
+// out from one turned off
+type OutputOverride struct {
+	Clear     *bool            `yaml:"clear"`
+	Key       FormatOverride   `yaml:"key"`
+	KeyFormat []FormatOverride `yaml:"keyFormat"`
+	Format    []FormatOverride `yaml:"format"`
+}
+
+// Flags set on a field overriding a sensor's or a derived field's
+type FormatOverride struct {
+	IsTag     *bool `yaml:"isTag"`
+	IsIP      *bool `yaml:"isIP"`
+	Timestamp *bool `yaml:"timestamp"`
+}
+
+// Decode a program, keeping the flags its outputs set when it overrides a
+// sensor
+func (prog *BPFProgram) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainProgram BPFProgram
+	err := unmarshal((*plainProgram)(prog))
+	// Values of the wrong kind leave the rest of the program decoded
+	if _, ok := err.(*yaml.TypeError); (err != nil && !ok) || prog.Sensor == "" {
+		return err
+	}
+	var overrides struct {
+		Outputs []OutputOverride `yaml:"outputs"`
+	}
+	overrideErr := unmarshal(&overrides)
+	prog.OutputOverrides = overrides.Outputs
+	if err == nil {
+		err = overrideErr
+	}
+	return err
+}
+
+// A flag an override sets replaces the field's. Without the flags from the
+// config, an override can only turn a flag on
+func mergeFlag(flag bool, override bool, set *bool) bool {
+	if set != nil {
+		return *set
+	}
+	return flag || override
+}
+
+// Apply settings from a config output on top of a sensor's output. Only
+// settings the override sets replace the sensor's
+func mergeOutputOverride(output *BPFOutput, override *BPFOutput,
+	flags OutputOverride) error {
+	if override.Type != "" {
+		output.Type = override.Type
+	}
+	if override.Poll != "" {
+		output.Poll = override.Poll
+	}
+	output.Clear = mergeFlag(output.Clear, override.Clear, flags.Clear)
+	if override.BTFType != "" {
+		output.BTFType = override.BTFType
+	}
+	if override.BTFKeyType != "" {
+		output.BTFKeyType = override.BTFKeyType
+	}
+	if override.Filter != "" {
+		output.Filter = override.Filter
+	}
+	if override.FilterAction != "" {
+		output.FilterAction = override.FilterAction
+	}
+	if override.Encoding != "" {
+		output.Encoding = override.Encoding
+	}
+	if override.Metric.Type != "" {
+		output.Metric.Type = override.Metric.Type
+	}
+	if override.Metric.Name != "" {
+		output.Metric.Name = override.Metric.Name
+	}
+	if override.Metric.Bucket != "" {
+		output.Metric.Bucket = override.Metric.Bucket
+	}
+	if override.Template != "" {
+		output.Template = override.Template
+	}
+	if override.Measurement != "" {
+		output.Measurement = override.Measurement
+	}
+
+	// Fields a sensor leaves to be derived are checked against its source
+	// once they are
+	if needsDerivedFormat(output) {
+		for _, format := range override.Format {
+			if !hasFormat(output.Format, format.Name) {
+				output.Format = append(output.Format,
+					BPFOutputFormat{Name: format.Name})
+			}
+		}
+	}
+	var err error
+	output.Format, err = mergeFormatOverrides(output.Format, override.Format,
+		flags.Format)
+	if err != nil {
+		return err
+	}
+	output.KeyFormat, err = mergeFormatOverrides(output.KeyFormat,
+		override.KeyFormat, flags.KeyFormat)
+	if err != nil {
+		return err
+	}
+	if override.Key.Name != "" {
+		if override.Key.Name != output.Key.Name {
+			return fmt.Errorf("sensor.go: Key is %s, not %s", output.Key.Name,
+				override.Key.Name)
+		}
+		keys, err := mergeFormatOverrides([]BPFOutputFormat{output.Key},
+			[]BPFOutputFormat{override.Key}, []FormatOverride{flags.Key})
+		if err != nil {
+			return err
+		}
+		output.Key = keys[0]
+	}
+	return nil
+}
+
+func hasFormat(formats []BPFOutputFormat, name string) bool {
+	for _, format := range formats {
+		if format.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Confirm every sensor in the library loads, has its source bundled and
+// passes the checks a config would
+func TestSensors(t *testing.T) {
+	sensors, err := Sensors()
+	if err != nil {
+		t.Fatalf("Error loading sensors: %v", err)
+	}
+	var names []string
+	for _, sensor := range sensors {
+		names = append(names, sensor.Name)
+	}
+	expected := []string{"biolatency", "cachestat", "execsnoop", "nfsdist",
+		"opensnoop", "tcplife"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Sensors %v do not match expected %v", names, expected)
+	}
+
+	for _, sensor := range sensors {
+		if sensor.Description == "" {
+			t.Errorf("Sensor %s has no description", sensor.Name)
+		}
+		input := "programs:\n  - sensor: " + sensor.Name + "\n"
+		if errs := Validate(strings.NewReader(input)); len(errs) != 0 {
+			t.Errorf("Sensor %s does not validate: %v", sensor.Name, errs)
+		}
+		config, err := ParseConfig(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("Sensor %s does not parse: %v", sensor.Name, err)
+			continue
+		}
+		if _, err := config.Programs[0].ReadSource(); err != nil {
+			t.Errorf("Sensor %s source is not bundled: %v", sensor.Name, err)
+		}
+	}
+
+	if _, err := LoadSensor("nosuchsensor"); err == nil {
+		t.Errorf("Unknown sensor did not throw error")
+	}
+}
+
+// Confirm overrides can turn a sensor's flags off as well as on
+func TestParseConfigSensorOverridesFlags(t *testing.T) {
+	input := `
+programs:
+  - sensor: biolatency
+    outputs:
+      - id: biolatency_dist
+        clear: false
+        keyFormat:
+          - name: disk
+            isTag: false
+  - sensor: opensnoop
+    outputs:
+      - id: opensnoop
+        format:
+          - name: fname
+            isTag: false
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	output := config.Programs[0].Outputs[0]
+	if output.Clear || output.KeyFormat[0].IsTag || !output.KeyFormat[1].IsTag {
+		t.Errorf("Flags were not overridden: clear %v, key format %+v",
+			output.Clear, output.KeyFormat)
+	}
+	for _, format := range config.Programs[1].Outputs[0].Format {
+		if format.IsTag != (format.Name == "pid" || format.Name == "uid") {
+			t.Errorf("Field %s has isTag %v", format.Name, format.IsTag)
+		}
+	}
+}
+
+// Confirm overrides can name fields a sensor leaves to be derived, and only
+// fields in its source
+func TestParseConfigSensorOverridesDerived(t *testing.T) {
+	input := `
+programs:
+  - sensor: opensnoop
+    outputs:
+      - id: opensnoop
+        format:
+          - name: comm
+            isTag: true
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	for _, format := range config.Programs[0].Outputs[0].Format {
+		if format.Name == "comm" && (!format.IsTag || format.Type != "char[16]") {
+			t.Errorf("Field comm was not merged with its derived type: %+v", format)
+		}
+	}
+
+	input = strings.Replace(input, "name: comm", "name: missing", 1)
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("Override of a field not in the source did not throw error")
+	}
+}
+
+// Confirm sensors can be loaded together, but not twice, since records are
+// told apart by their output id
+func TestParseConfigOutputIds(t *testing.T) {
+	tables := []struct {
+		input     string
+		expectErr bool
+	}{
+		{"programs: [{sensor: biolatency}, {sensor: cachestat}]", false},
+		{"programs: [{sensor: opensnoop}, {sensor: opensnoop}]", true},
+		{`programs: [{sensor: opensnoop}, {source: test.c,
+  outputs: [{id: opensnoop, type: BPF_PERF_OUTPUT, format: [{name: pid, type: u32}]}]}]`,
+			true},
+	}
+	for _, tbl := range tables {
+		_, err := ParseConfig(strings.NewReader(tbl.input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("%s returned error %v", tbl.input, err)
+		}
+		errs := Validate(strings.NewReader(tbl.input))
+		if (len(errs) != 0) != tbl.expectErr {
+			t.Errorf("%s returned validation errors %v", tbl.input, errs)
+		}
+	}
+}
+
+// Confirm the layout of every sensor's outputs matches the structs in its
+// source, so hand-written formats can't drift from the C
+func TestSensorLayouts(t *testing.T) {
+	sensors, err := Sensors()
+	if err != nil {
+		t.Fatalf("Error loading sensors: %v", err)
+	}
+	for _, sensor := range sensors {
+		input := "programs:\n  - sensor: " + sensor.Name + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if err != nil {
+			t.Errorf("Sensor %s does not parse: %v", sensor.Name, err)
+			continue
+		}
+		prog := &config.Programs[0]
+		source, err := prog.readRawSource()
+		if err != nil {
+			t.Errorf("Sensor %s source is not bundled: %v", sensor.Name, err)
+			continue
+		}
+		rendered, err := prog.renderSource(string(source))
+		if err != nil {
+			t.Errorf("Error rendering sensor %s: %v", sensor.Name, err)
+			continue
+		}
+		src := parseCSource(rendered, prog.Defines)
+		for i := range prog.Outputs {
+			output := &prog.Outputs[i]
+			layout, err := src.outputLayout(output)
+			if err != nil {
+				t.Errorf("Error deriving %s of sensor %s: %v", output.Id,
+					sensor.Name, err)
+				continue
+			}
+			if actual, expected := layoutTypes(output.Format),
+				layoutTypes(layout.value); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("Sensor %s output %s has format %v, the source has %v",
+					sensor.Name, output.Id, actual, expected)
+			}
+			if !IsPolledType(output.Type) {
+				continue
+			}
+			key := output.KeyFormat
+			if len(key) == 0 {
+				key = []BPFOutputFormat{output.Key}
+			}
+			if actual, expected := layoutTypes(key),
+				layoutTypes(layout.key); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("Sensor %s output %s has key %v, the source has %v",
+					sensor.Name, output.Id, actual, expected)
+			}
+		}
+	}
+}
+
+// Types of a layout's fields. Trailing padding is left out, the decoder
+// doesn't read past the last field
+func layoutTypes(formats []BPFOutputFormat) []string {
+	var types []string
+	for _, format := range formats {
+		types = append(types, format.Type)
+	}
+	for len(types) != 0 && strings.HasPrefix(types[len(types)-1], "pad") {
+		types = types[:len(types)-1]
+	}
+	return types
+}
+
+// Confirm settings in the config override the sensor's
+func TestParseConfigSensorOverrides(t *testing.T) {
+	input := `
+programs:
+  - sensor: opensnoop
+    defines:
+      TARGET_UID: 1000
+    outputs:
+      - id: opensnoop
+        filter: ret < 0
+        format:
+          - name: fname
+            filter:
+              have-prefix: /proc
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	prog := config.Programs[0]
+	if prog.Name() != "opensnoop" || len(prog.Events) != 2 {
+		t.Errorf("Program %s did not start from the sensor: %+v", prog.Name(),
+			prog)
+	}
+	if flags := prog.CompilerFlags(); !reflect.DeepEqual(flags,
+		[]string{"-DTARGET_UID=1000"}) {
+		t.Errorf("Defines were not passed on, got flags %v", flags)
+	}
+	output := prog.Outputs[0]
+	if len(output.Format) != 8 || output.CompiledFilter == nil {
+		t.Errorf("Output was not merged with the sensor's: %+v", output)
+	}
+	for _, format := range output.Format {
+		if format.Name == "fname" && (format.CompiledFilter == nil ||
+			format.Type != "char[255]") {
+			t.Errorf("Field override was not merged: %+v", format)
+		}
+	}
+
+	tables := []struct {
+		program string
+		errPart string
+	}{
+		{"sensor: nosuchsensor", "Unknown sensor"},
+		{"sensor: opensnoop\n    object: test.o", "can't use object"},
+		{"sensor: opensnoop\n    outputs:\n      - id: events", "no output events"},
+		{"sensor: opensnoop\n    outputs:\n      - id: opensnoop\n" +
+			"        format:\n          - name: pid\n            type: u64",
+			"configured as u64"},
+		{"sensor: opensnoop\n    outputs:\n      - id: opensnoop\n" +
+			"        format:\n          - name: tid", "not in source"},
+	}
+	for _, tbl := range tables {
+		input := "programs:\n  - " + tbl.program + "\n"
+		_, err := ParseConfig(strings.NewReader(input))
+		if err == nil || !strings.Contains(err.Error(), tbl.errPart) {
+			t.Errorf("%q returned error %v, expected one containing %q",
+				tbl.program, err, tbl.errPart)
+		}
+		errs := Validate(strings.NewReader(input))
+		if len(errs) == 0 {
+			t.Errorf("%q passed validation", tbl.program)
+		}
+	}
+}
+
+// Confirm overriding one setting keeps the sensor's others
+func TestParseConfigSensorOverridesKeepSettings(t *testing.T) {
+	input := `
+programs:
+  - sensor: opensnoop
+    outputs:
+      - id: opensnoop
+        template: "{{.comm}} opened {{.fname}}"
+        format:
+          - name: flags
+            filter: {gt: 5}
+  - sensor: biolatency
+    outputs:
+      - id: biolatency_dist
+        encoding: json
+        metric: {type: counter}
+`
+	config, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Error thrown when not expected: %v", err)
+	}
+	output := config.Programs[0].Outputs[0]
+	if output.Encoding != "template" || output.CompiledTemplate == nil {
+		t.Errorf("Template override was dropped: %+v", output)
+	}
+	for _, format := range output.Format {
+		switch format.Name {
+		case "flags":
+			if format.FormatString != "%#o" || format.CompiledFilter == nil {
+				t.Errorf("Field flags lost the sensor's settings: %+v", format)
+			}
+		case "fname":
+			if !format.IsTag {
+				t.Errorf("Field fname is no longer a tag: %+v", format)
+			}
+		}
+	}
+
+	output = config.Programs[1].Outputs[0]
+	expected := MetricConfig{Type: "counter", Name: "biolatency_dist"}
+	if output.Metric != expected || output.Encoding != "json" ||
+		output.Poll != "10s" || !output.Clear || output.Type != "BPF_HISTOGRAM" {
+		t.Errorf("Output override was not merged with the sensor's: %+v", output)
+	}
+	if len(output.KeyFormat) != 2 || !output.KeyFormat[1].IsTag {
+		t.Errorf("Output lost the sensor's key format: %+v", output.KeyFormat)
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Helper functions output templates can use
+var TemplateFuncs = template.FuncMap{
+	// Value as JSON, e.g. a quoted and escaped string
+	"json": func(value interface{}) (string, error) {
+		output, err := json.Marshal(value)
+		return string(output), err
+	},
+	// Value as a Go quoted string
+	"quote": func(value interface{}) string {
+		return strconv.Quote(fmt.Sprint(value))
+	},
+	// Value quoted only if it has spaces, quotes or equals signs, as in logfmt
+	"logfmt": func(value interface{}) string {
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \"=\n") {
+			return strconv.Quote(s)
+		}
+		return s
+	},
+	"upper": func(value interface{}) string {
+		return strings.ToUpper(fmt.Sprint(value))
+	},
+	"lower": func(value interface{}) string {
+		return strings.ToLower(fmt.Sprint(value))
+	},
+	// Value, or def if the value is empty
+	"default": func(def interface{}, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// Compile an output's template, checking it renders for a record of the
+// output with the global tags. Fields the template names that the output
+// doesn't have are errors
+func compileOutputTemplate(output *BPFOutput, globalTags []string) error {
+	compiled, err := template.New(output.Id).Funcs(TemplateFuncs).
+		Option("missingkey=error").Parse(output.Template)
+	if err != nil {
+		return fmt.Errorf("template.go: Error compiling template for output %s: %s",
+			output.Id, err)
+	}
+	err = compiled.Execute(io.Discard, TemplateSample(output, globalTags))
+	if err != nil {
+		return fmt.Errorf("template.go: Template for output %s does not render: %s",
+			output.Id, err)
+	}
+	output.CompiledTemplate = compiled
+	return nil
+}
+
+// Template data for a record of an output with every value zero. Fields and
+// tags, including globalTags, are keyed by name, next to Host, Sensor,
+// Measurement, Timestamp and the Tags and Fields maps. Records fill in their
+// own values over it, so values they leave out render as zero
+func TemplateSample(output *BPFOutput,
+	globalTags []string) map[string]interface{} {
+
+	tags := map[string]string{"sensor": ""}
+	for _, name := range globalTags {
+		tags[name] = ""
+	}
+	fields := make(map[string]interface{})
+	formats := append(append([]BPFOutputFormat{}, output.KeyFormat...),
+		output.Format...)
+	if len(output.KeyFormat) == 0 && IsPolledType(output.Type) {
+		formats = append(formats, output.Key)
+	}
+	for _, format := range formats {
+		if format.Name == "" {
+			continue
+		}
+		var value interface{}
+		switch {
+		case strings.Contains(format.Type, "["), format.IsIP,
+			format.FormatString != "", len(format.Enum) != 0:
+			value = ""
+		case strings.HasPrefix(format.Type, "u"):
+			value = uint64(0)
+		default:
+			value = int64(0)
+		}
+		if format.IsTag {
+			tags[format.Name] = ""
+		} else {
+			fields[format.Name] = value
+		}
+	}
+
+	data := make(map[string]interface{})
+	for name, value := range fields {
+		data[name] = value
+	}
+	for name, value := range tags {
+		data[name] = value
+	}
+	data["Host"] = ""
+	data["Sensor"] = ""
+	data["Measurement"] = ""
+	data["Timestamp"] = time.Time{}
+	data["Tags"] = tags
+	data["Fields"] = fields
+	return data
+}
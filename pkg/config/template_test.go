@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// Confirm output templates are compiled against the output's fields
+func TestParseConfigTemplates(t *testing.T) {
+	tables := []struct {
+		options   string
+		expectErr bool
+	}{
+		{`template: "Exec {{.comm}} by uid {{.uid}}: {{json .argv}}"`, false},
+		{`template: "{{.Host}} {{.Timestamp.Unix}} {{.Tags.sensor}} {{logfmt .Fields.argv}}"`,
+			false},
+		{`encoding: template
+        template: "{{upper .comm}} {{default \"-\" .argv}}"`, false},
+		// Syntax errors, unknown functions and fields the output doesn't have
+		{`template: "{{.comm"`, true},
+		{`template: "{{.command}}"`, true},
+		{`template: "{{shout .comm}}"`, true},
+		// Templates need the template encoding and the reverse
+		{`encoding: json
+        template: "{{.comm}}"`, true},
+		{`encoding: template`, true},
+	}
+	for _, tbl := range tables {
+		input := `
+programs:
+  - source: test.c
+    outputs:
+      - id: execs
+        type: BPF_PERF_OUTPUT
+        format:
+          - {name: uid, type: u32}
+          - {name: comm, type: "char[16]", isTag: true}
+          - {name: argv, type: "char[128]"}
+        ` + tbl.options + "\n"
+		config, err := ParseConfig(strings.NewReader(input))
+		if (err != nil) != tbl.expectErr {
+			t.Errorf("Output with %s returned error %v", tbl.options, err)
+			continue
+		}
+		if err != nil {
+			// Validate points at the template or encoding
+			found := false
+			for _, e := range Validate(strings.NewReader(input)) {
+				found = found || strings.Contains(e.Error(), "outputs[0].template") ||
+					strings.Contains(e.Error(), "outputs[0].encoding")
+			}
+			if !found {
+				t.Errorf("Output with %s did not fail validation", tbl.options)
+			}
+			continue
+		}
+		output := config.Programs[0].Outputs[0]
+		if output.Encoding != "template" || output.CompiledTemplate == nil {
+			t.Errorf("Output with %s has encoding %q and template %v", tbl.options,
+				output.Encoding, output.CompiledTemplate)
+		}
+	}
+
+	// Only outputs have templates
+	for _, globals := range []string{
+		"sinks: [{type: stdout, encoding: template}]",
+		"verboseFormat: template",
+	} {
+		input := "globals:\n  " + globals + "\n"
+		if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+			t.Errorf("Globals %s did not throw error", globals)
+		}
+	}
+}
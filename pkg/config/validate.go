@@ -0,0 +1,308 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Scalar format types the binary decoder understands. Any of them can be
+// suffixed with one or two array sizes, e.g. char[16] or char[4][16]
+var FormatTypes = []string{"u64", "u32", "u16", "u8", "int64", "int",
+	"int32", "int16", "char", "pad"}
+
+// Event types a program can attach to. Matched case insensitively
+var EventTypes = []string{"kprobe", "kretprobe", "rawtracepoint", "tracepoint"}
+
+// Map types outputs can be read from. Matched case insensitively
+var OutputTypes = []string{"BPF_PERF_OUTPUT", "BPF_HASH", "BPF_HISTOGRAM"}
+
+// Ways records can be written out
+var SinkTypes = []string{"unix", "tcp", "udp", "stdout", "otlp", "syslog",
+	"journald"}
+
+// Transports OTLP sinks can use. Empty means grpc
+var OTLPProtocols = []string{"grpc", "http"}
+
+// Transports syslog sinks can use. Empty means unix
+var SyslogProtocols = []string{"unix", "udp", "tcp"}
+
+// Syslog facility names, indexed by their code
+var SyslogFacilities = []string{"kern", "user", "mail", "daemon", "auth",
+	"syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp", "security",
+	"console", "solaris-cron", "local0", "local1", "local2", "local3", "local4",
+	"local5", "local6", "local7"}
+
+// Encodings records can be written in
+var Encodings = []string{"influx", "json", "syslog", "graphite", "statsd",
+	"template", "msgpack", "protobuf"}
+
+// Ways outputs can be split into measurements
+var MeasurementModes = []string{"single", "sensor"}
+
+// Metadata of this host that can be added to every record as tags
+var HostTagNames = []string{"host", "kernel_release", "boot_id", "machine_id"}
+
+// Prometheus metric types hash and histogram outputs can be exported as
+var MetricTypes = []string{"gauge", "counter", "histogram", "none"}
+
+// Problem found in a config file, located by its line and column in the YAML
+// and the path to the offending value
+type ValidationError struct {
+	Line   int
+	Column int
+	Path   string
+	Msg    string
+	// Set for problems that don't stop the config loading
+	Warning bool
+}
+
+func (e ValidationError) Error() string {
+	location := fmt.Sprintf("%d:%d", e.Line, e.Column)
+	if e.Warning {
+		location += ": warning"
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", location, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, e.Path, e.Msg)
+}
+
+// Matches the line number in yaml syntax errors
+var yamlErrorLine = regexp.MustCompile(`line (\d+):`)
+
+// Collects validation errors, locating them by path in the YAML document
+type validator struct {
+	nodes  map[string]*yamlv3.Node
+	errors []ValidationError
+}
+
+// Record an error at path. Paths not present in the document, such as derived
+// formats, are reported at their closest ancestor that is
+func (v *validator) report(path string, format string, args ...interface{}) {
+	var line, column int
+	for search := path; ; {
+		if node, ok := v.nodes[search]; ok {
+			line, column = node.Line, node.Column
+			break
+		}
+		cut := strings.LastIndexAny(search, ".[")
+		if cut < 0 {
+			break
+		}
+		search = search[:cut]
+	}
+	v.errors = append(v.errors, ValidationError{Line: line, Column: column,
+		Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Record a warning at path
+func (v *validator) warn(path string, format string, args ...interface{}) {
+	v.report(path, format, args...)
+	v.errors[len(v.errors)-1].Warning = true
+}
+
+// Check a config without starting anything. Unknown keys and values of the
+// wrong kind are found in the YAML, then the config goes through the same
+// checks as ParseConfig and its files are looked for. Every problem is
+// reported, sorted by where it appears in the document, along with warnings.
+// Returns nil if the config is valid
+func Validate(input io.Reader) []ValidationError {
+	buf := bytes.NewBuffer([]byte{})
+	_, err := buf.ReadFrom(input)
+	if err != nil {
+		return []ValidationError{{Msg: fmt.Sprintf(
+			"validate.go: Error reading input to buffer: %s", err)}}
+	}
+
+	var document yamlv3.Node
+	err = yamlv3.Unmarshal(buf.Bytes(), &document)
+	if err != nil {
+		syntaxErr := ValidationError{Msg: err.Error()}
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			syntaxErr.Line, _ = strconv.Atoi(match[1])
+		}
+		return []ValidationError{syntaxErr}
+	}
+
+	v := &validator{nodes: make(map[string]*yamlv3.Node)}
+	if len(document.Content) != 0 {
+		v.walk(document.Content[0], reflect.TypeOf(GreggdConfig{}), "")
+	}
+	// Run the same loading as ParseConfig on whatever decodes. Values of the
+	// wrong kind are left at their defaults and were reported by the walk
+	configStruct := defaultConfig()
+	err = yaml.Unmarshal(buf.Bytes(), &configStruct)
+	if _, ok := err.(*yaml.TypeError); err != nil && (!ok || len(v.errors) == 0) {
+		v.report("", "%s", err)
+	}
+	for _, problem := range loadConfig(&configStruct) {
+		if problem.warning && !problem.strict {
+			v.warn(problem.path, "%s", problem.err)
+		} else {
+			v.report(problem.path, "%s", problem.err)
+		}
+	}
+	for iProg := range configStruct.Programs {
+		v.checkFiles(&configStruct.Programs[iProg],
+			fmt.Sprintf("programs[%d]", iProg))
+	}
+
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		if v.errors[i].Line != v.errors[j].Line {
+			return v.errors[i].Line < v.errors[j].Line
+		}
+		return v.errors[i].Column < v.errors[j].Column
+	})
+	return v.errors
+}
+
+// Check node matches typ, recording the location of every value by path.
+// Only struct fields with a yaml tag are config keys
+func (v *validator) walk(node *yamlv3.Node, typ reflect.Type, path string) {
+	if node.Kind == yamlv3.AliasNode {
+		node = node.Alias
+	}
+	v.nodes[path] = node
+	// Null values leave the default in place
+	if node.Kind == yamlv3.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Interface:
+		// Filters take any shape, they are checked when compiled
+	case reflect.Struct:
+		if node.Kind != yamlv3.MappingNode {
+			v.report(path, "Expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			keyPath := keyNode.Value
+			if path != "" {
+				keyPath = path + "." + keyNode.Value
+			}
+			field, ok := yamlField(typ, keyNode.Value)
+			if !ok {
+				v.nodes[keyPath] = keyNode
+				v.report(keyPath, "Unknown key %s", keyNode.Value)
+				continue
+			}
+			v.walk(valueNode, field.Type, keyPath)
+		}
+	case reflect.Map:
+		if node.Kind != yamlv3.MappingNode {
+			v.report(path, "Expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := path + "." + node.Content[i].Value
+			if typ.Key().Kind() == reflect.Int64 &&
+				node.Content[i].Tag != "!!int" {
+				v.nodes[keyPath] = node.Content[i]
+				v.report(keyPath, "Expected an integer key, got %s",
+					node.Content[i].Value)
+				continue
+			}
+			v.walk(node.Content[i+1], typ.Elem(), keyPath)
+		}
+	case reflect.Slice:
+		if node.Kind != yamlv3.SequenceNode {
+			v.report(path, "Expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			v.walk(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Bool:
+		if node.Kind != yamlv3.ScalarNode || node.Tag != "!!bool" {
+			v.report(path, "Expected true or false, got %s", node.Value)
+		}
+	case reflect.Int:
+		if node.Kind != yamlv3.ScalarNode || node.Tag != "!!int" {
+			v.report(path, "Expected an integer, got %s", node.Value)
+		}
+	case reflect.String:
+		if node.Kind != yamlv3.ScalarNode {
+			v.report(path, "Expected a string")
+		}
+	}
+}
+
+// Find the struct field a yaml key decodes into
+func yamlField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if tag != "" && tag != "-" && tag == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Check the files a program points at exist and its source renders. The
+// loader leaves missing files for the tracer to report
+func (v *validator) checkFiles(prog *BPFProgram, progPath string) {
+	files := map[string]string{"source": prog.Source, "object": prog.Object,
+		"btf": prog.BTF}
+	missing := false
+	for _, key := range []string{"source", "object", "btf"} {
+		if files[key] == "" {
+			continue
+		}
+		if _, err := os.Stat(files[key]); err != nil {
+			v.report(progPath+"."+key, "%s", err)
+			missing = true
+		}
+	}
+	if !missing && (prog.Source != "" || prog.LibrarySource != "") {
+		if _, err := prog.ReadSource(); err != nil {
+			v.report(progPath+".defines", "%s", err)
+		}
+	}
+}
+
+// Matches a format type and its optional array sizes
+var formatTypePattern = regexp.MustCompile(`^([a-z0-9]+)((\[\d+\]){0,2})$`)
+
+// Check a format type is one the binary decoder understands
+func CheckFormatType(formatType string) error {
+	match := formatTypePattern.FindStringSubmatch(formatType)
+	if match == nil || !contains(FormatTypes, match[1]) {
+		return fmt.Errorf("validate.go: Format type %q is not supported, "+
+			"expected one of %s", formatType, strings.Join(FormatTypes, ", "))
+	}
+	if match[1] == "pad" && match[2] == "" {
+		return fmt.Errorf("validate.go: Padding %s must have a size", formatType)
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
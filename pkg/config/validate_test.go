@@ -0,0 +1,250 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Confirm a good config has no errors
+func TestValidateValid(t *testing.T) {
+	input := `
+globals:
+  retryDelay: 50ms
+programs:
+  - source: ../../csrc/opensnoop.c
+    events:
+      - type: kprobe
+        loadFunc: trace_entry
+        attachTo: do_sys_open
+    outputs:
+      - type: BPF_HASH
+        id: counts
+        poll: 10s
+        format:
+          - name: comm
+            type: char[16]
+            filter:
+              have-prefix: bash
+`
+	errs := Validate(strings.NewReader(input))
+	for _, err := range errs {
+		t.Errorf("Unexpected validation error: %v", err)
+	}
+}
+
+// Confirm every error in a config is reported at its line and column
+func TestValidateErrors(t *testing.T) {
+	input := `globals:
+  retryDelay: soon
+  verbose: maybe
+  socketPth: /run/greggd.sock
+programs:
+  - source: /does/not/exist.c
+    events:
+      - type: uprobe
+        attachTo: do_sys_open
+    outputs:
+      - type: BPF_HASH
+        id: counts
+        poll: often
+        format:
+          - name: count
+            type: u23
+          - name: when
+            type: u32
+            timestamp: true
+`
+	expected := []struct {
+		line   int
+		column int
+		path   string
+	}{
+		{2, 15, "globals.retryDelay"},
+		{3, 12, "globals.verbose"},
+		{4, 3, "globals.socketPth"},
+		{6, 13, "programs[0].source"},
+		{8, 15, "programs[0].events[0].type"},
+		{13, 15, "programs[0].outputs[0].poll"},
+		{15, 11, "programs[0].outputs[0].format"},
+		{16, 19, "programs[0].outputs[0].format[0].type"},
+	}
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != len(expected) {
+		t.Fatalf("Got %d errors, expected %d: %v", len(errs), len(expected), errs)
+	}
+	for i, tbl := range expected {
+		if errs[i].Line != tbl.line || errs[i].Column != tbl.column ||
+			errs[i].Path != tbl.path {
+			t.Errorf("Error %v does not match %d:%d %s", errs[i], tbl.line,
+				tbl.column, tbl.path)
+		}
+	}
+
+	// With the structure fixed, the other errors are still reported
+	input = strings.Replace(input, "  verbose: maybe\n  socketPth", "  socketPath",
+		1)
+	expected = []struct {
+		line   int
+		column int
+		path   string
+	}{
+		{2, 15, "globals.retryDelay"},
+		{5, 13, "programs[0].source"},
+		{7, 15, "programs[0].events[0].type"},
+		{12, 15, "programs[0].outputs[0].poll"},
+		{14, 11, "programs[0].outputs[0].format"},
+		{15, 19, "programs[0].outputs[0].format[0].type"},
+	}
+	errs = Validate(strings.NewReader(input))
+	if len(errs) != len(expected) {
+		t.Fatalf("Got %d errors, expected %d: %v", len(errs), len(expected), errs)
+	}
+	for i, tbl := range expected {
+		if errs[i].Line != tbl.line || errs[i].Column != tbl.column ||
+			errs[i].Path != tbl.path {
+			t.Errorf("Error %v does not match %d:%d %s", errs[i], tbl.line,
+				tbl.column, tbl.path)
+		}
+	}
+}
+
+// Confirm syntax errors carry their line
+func TestValidateSyntax(t *testing.T) {
+	errs := Validate(strings.NewReader("globals:\n  verbose: true\n bad"))
+	if len(errs) != 1 || errs[0].Line == 0 {
+		t.Errorf("Expected one located syntax error, got %v", errs)
+	}
+}
+
+// Confirm the example config only fails on its missing source
+func TestValidateExample(t *testing.T) {
+	f, err := os.Open("../../test/data/example_config.yaml")
+	if err != nil {
+		t.Fatalf("Error opening config fixture: %v", err)
+	}
+	defer f.Close()
+	errs := Validate(f)
+	if len(errs) != 1 || errs[0].Path != "programs[0].source" {
+		t.Errorf("Expected only a missing source error, got %v", errs)
+	}
+}
+
+func TestCheckFormatType(t *testing.T) {
+	tables := []struct {
+		input string
+		isErr bool
+	}{
+		{"u64", false},
+		{"char[16]", false},
+		{"char[4][16]", false},
+		{"pad[3]", false},
+		{"pad", true},
+		{"U64", true},
+		{"u23", true},
+		{"char[16", true},
+	}
+	for _, tbl := range tables {
+		err := CheckFormatType(tbl.input)
+		if (err != nil) != tbl.isErr {
+			t.Errorf("Format type %s returned error %v", tbl.input, err)
+		}
+	}
+}
+
+// Confirm enum values are keyed by integers
+func TestValidateEnumKeys(t *testing.T) {
+	input := `
+programs:
+  - source: ../../csrc/tcplife.c
+    outputs:
+      - type: BPF_PERF_OUTPUT
+        id: ipv4_events
+        format:
+          - name: state
+            type: u8
+            enum:
+              1: ESTABLISHED
+              close: CLOSE
+`
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != 1 || errs[0].Line != 12 ||
+		errs[0].Path != "programs[0].outputs[0].format[0].enum.close" {
+		t.Errorf("Expected one error for the enum key close, got %v", errs)
+	}
+}
+
+// Confirm validation runs the same checks as ParseConfig
+func TestValidateMatchesParseConfig(t *testing.T) {
+	input := `globals:
+  prometheus:
+    listen: ":9464"
+programs:
+  - source: ../../csrc/opensnoop.c
+    events:
+      - type: kprobe
+        attachTo: do_sys_open
+    outputs:
+      - type: BPF_HASH
+        id: counts
+        poll: 0s
+        format: [{name: count, type: u64}]
+        metric:
+          name: opens
+      - type: BPF_HASH
+        id: totals
+        poll: 10s
+        format: [{name: count, type: u64}]
+        metric:
+          name: opens
+`
+	if _, err := ParseConfig(strings.NewReader(input)); err == nil {
+		t.Errorf("ParseConfig accepted a config expected to fail")
+	}
+	expected := []struct {
+		line int
+		path string
+	}{
+		{12, "programs[0].outputs[0].poll"},
+		{21, "programs[0].outputs[1].metric.name"},
+	}
+	errs := Validate(strings.NewReader(input))
+	if len(errs) != len(expected) {
+		t.Fatalf("Got %d errors, expected %d: %v", len(errs), len(expected), errs)
+	}
+	for i, tbl := range expected {
+		if errs[i].Line != tbl.line || errs[i].Path != tbl.path {
+			t.Errorf("Error %v does not match line %d %s", errs[i], tbl.line,
+				tbl.path)
+		}
+	}
+}
+
+// Confirm problems with derived and sensor fields are reported at the entry
+// the config wrote for the field
+func TestValidateDerivedPaths(t *testing.T) {
+	tables := []struct {
+		program string
+		path    string
+	}{
+		{"source: ../../csrc/opensnoop.c\n    events:\n" +
+			"      - {type: kprobe, attachTo: do_sys_open}",
+			"programs[0].outputs[0].format[0].filterAction"},
+		{"sensor: opensnoop", "programs[0].outputs[0].format[0].filterAction"},
+	}
+	for _, tbl := range tables {
+		input := `programs:
+  - ` + tbl.program + `
+    outputs:
+      - id: opensnoop
+        type: BPF_PERF_OUTPUT
+        format:
+          - name: flags
+            filterAction: sometimes
+`
+		errs := Validate(strings.NewReader(input))
+		if len(errs) != 1 || errs[0].Path != tbl.path {
+			t.Errorf("Errors %v do not match %s", errs, tbl.path)
+		}
+	}
+}
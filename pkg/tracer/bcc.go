@@ -0,0 +1,102 @@
+//go:build !nobcc
+// +build !nobcc
+
+package tracer
+
+import (
+	"fmt"
+
+	bcc "github.com/josephvoss/gobpf/bcc"
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Module compiled from C source by BCC
+type bccModule struct {
+	module *bcc.Module
+}
+
+// Compile a program's source with BCC and load it into the kernel
+func newBCCModule(program config.BPFProgram) (Module, error) {
+	source, err := program.ReadSource()
+	if err != nil {
+		return nil, fmt.Errorf("bcc.go: %s", err)
+	}
+
+	// Config defines reach the program as -D flags
+	m := bcc.NewModule(source, program.CompilerFlags())
+	if m == nil {
+		return nil, fmt.Errorf("bcc.go: Failed to compile program source %s",
+			program.Name())
+	}
+	return &bccModule{module: m}, nil
+}
+
+func (m *bccModule) AttachKprobe(loadFunc string, attachTo string) error {
+	fd, err := m.module.LoadKprobe(loadFunc)
+	if err != nil {
+		return err
+	}
+	// use kernel default for maxactive instances probed simultaneously
+	return m.module.AttachKprobe(attachTo, fd, -1)
+}
+
+func (m *bccModule) AttachKretprobe(loadFunc string, attachTo string) error {
+	fd, err := m.module.LoadKprobe(loadFunc)
+	if err != nil {
+		return err
+	}
+	// use kernel default for maxactive instances probed simultaneously
+	return m.module.AttachKretprobe(attachTo, fd, -1)
+}
+
+func (m *bccModule) AttachTracepoint(loadFunc string, attachTo string) error {
+	fd, err := m.module.LoadTracepoint(loadFunc)
+	if err != nil {
+		return err
+	}
+	return m.module.AttachTracepoint(attachTo, fd)
+}
+
+func (m *bccModule) AttachRawTracepoint(loadFunc string,
+	attachTo string) error {
+
+	fd, err := m.module.LoadRawTracepoint(loadFunc)
+	if err != nil {
+		return err
+	}
+	return m.module.AttachRawTracepoint(attachTo, fd)
+}
+
+func (m *bccModule) Table(id string) (Table, error) {
+	return &bccTable{table: bcc.NewTable(m.module.TableId(id), m.module)}, nil
+}
+
+func (m *bccModule) Close() {
+	m.module.Close()
+}
+
+// Map of a BCC module
+type bccTable struct {
+	table *bcc.Table
+}
+
+func (t *bccTable) ID() string {
+	return t.table.ID()
+}
+
+func (t *bccTable) Iter() TableIterator {
+	return t.table.Iter()
+}
+
+func (t *bccTable) Get(key []byte) ([]byte, error) {
+	return t.table.Get(key)
+}
+
+func (t *bccTable) Set(key []byte, leaf []byte) error {
+	return t.table.Set(key, leaf)
+}
+
+func (t *bccTable) PerfReader(dataChan chan []byte) (PerfReader, error) {
+	// Lost perf messages chan not implemented, set to nil
+	return bcc.InitPerfMap(t.table, dataChan, nil)
+}
@@ -0,0 +1,17 @@
+//go:build nobcc
+// +build nobcc
+
+package tracer
+
+import (
+	"fmt"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Built without BCC. Only precompiled objects can be loaded
+func newBCCModule(program config.BPFProgram) (Module, error) {
+	return nil, fmt.Errorf(
+		"bcc_disabled.go: greggd was built without BCC, unable to compile %s. Use `object`",
+		program.Name())
+}
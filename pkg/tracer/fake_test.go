@@ -0,0 +1,156 @@
+package tracer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// In-memory Module for tests. Attach failures are scripted per load function
+// and tables are scripted per map name
+type fakeModule struct {
+	attachErrs map[string]error
+	tables     map[string]*fakeTable
+
+	mu       sync.Mutex
+	attached []string
+	closed   bool
+}
+
+func (m *fakeModule) attach(kind string, loadFunc string,
+	attachTo string) error {
+
+	if err, ok := m.attachErrs[loadFunc]; ok {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attached = append(m.attached, kind+":"+loadFunc+":"+attachTo)
+	return nil
+}
+
+func (m *fakeModule) AttachKprobe(loadFunc string, attachTo string) error {
+	return m.attach("kprobe", loadFunc, attachTo)
+}
+
+func (m *fakeModule) AttachKretprobe(loadFunc string, attachTo string) error {
+	return m.attach("kretprobe", loadFunc, attachTo)
+}
+
+func (m *fakeModule) AttachTracepoint(loadFunc string, attachTo string) error {
+	return m.attach("tracepoint", loadFunc, attachTo)
+}
+
+func (m *fakeModule) AttachRawTracepoint(loadFunc string,
+	attachTo string) error {
+
+	return m.attach("rawtracepoint", loadFunc, attachTo)
+}
+
+func (m *fakeModule) Table(id string) (Table, error) {
+	table, ok := m.tables[id]
+	if !ok {
+		return nil, fmt.Errorf("fake: Map %s not found", id)
+	}
+	return table, nil
+}
+
+func (m *fakeModule) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+}
+
+// In-memory Table. Hash contents are kept in key order, perf events are sent
+// once the perf reader is started
+type fakeTable struct {
+	id      string
+	keys    [][]byte
+	values  map[string][]byte
+	events  [][]byte
+	getErr  error
+	setErr  error
+	perfErr error
+
+	mu sync.Mutex
+}
+
+func (t *fakeTable) ID() string {
+	return t.id
+}
+
+func (t *fakeTable) Iter() TableIterator {
+	return &fakeIterator{table: t, index: -1}
+}
+
+func (t *fakeTable) Get(key []byte) ([]byte, error) {
+	if t.getErr != nil {
+		return nil, t.getErr
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte{}, t.values[string(key)]...), nil
+}
+
+func (t *fakeTable) Set(key []byte, leaf []byte) error {
+	if t.setErr != nil {
+		return t.setErr
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.values[string(key)] = append([]byte{}, leaf...)
+	return nil
+}
+
+func (t *fakeTable) PerfReader(dataChan chan []byte) (PerfReader, error) {
+	if t.perfErr != nil {
+		return nil, t.perfErr
+	}
+	return &fakePerfReader{events: t.events, dataChan: dataChan,
+		done: make(chan struct{})}, nil
+}
+
+// Iterator over a fakeTable's scripted keys
+type fakeIterator struct {
+	table *fakeTable
+	index int
+}
+
+func (it *fakeIterator) Next() bool {
+	it.index++
+	return it.index < len(it.table.keys)
+}
+
+func (it *fakeIterator) Key() []byte {
+	return it.table.keys[it.index]
+}
+
+func (it *fakeIterator) Err() error {
+	return nil
+}
+
+// PerfReader sending scripted events until stopped
+type fakePerfReader struct {
+	events   [][]byte
+	dataChan chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (r *fakePerfReader) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for _, event := range r.events {
+			select {
+			case r.dataChan <- event:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+func (r *fakePerfReader) Stop() {
+	close(r.done)
+	r.wg.Wait()
+}
@@ -0,0 +1,52 @@
+package tracer
+
+import (
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// A compiled eBPF program loaded into the kernel. Hides whether it was built
+// by BCC at runtime or loaded from a precompiled object
+type Module interface {
+	// Load function loadFunc and attach it to a kernel event
+	AttachKprobe(loadFunc string, attachTo string) error
+	AttachKretprobe(loadFunc string, attachTo string) error
+	AttachTracepoint(loadFunc string, attachTo string) error
+	AttachRawTracepoint(loadFunc string, attachTo string) error
+	// Look up a map by name
+	Table(id string) (Table, error)
+	// Detach all events and unload the program
+	Close()
+}
+
+// A map owned by a Module
+type Table interface {
+	ID() string
+	// Iterate over keys in the map
+	Iter() TableIterator
+	Get(key []byte) ([]byte, error)
+	Set(key []byte, leaf []byte) error
+	// Open a reader sending each event in a perf output map to dataChan
+	PerfReader(dataChan chan []byte) (PerfReader, error)
+}
+
+// Iterator over the keys of a Table
+type TableIterator interface {
+	Next() bool
+	Key() []byte
+	Err() error
+}
+
+// Reader for events submitted to a perf output map
+type PerfReader interface {
+	Start()
+	Stop()
+}
+
+// Load a program into the kernel. Precompiled objects are loaded directly,
+// sources are compiled by BCC
+func loadModule(program config.BPFProgram) (Module, error) {
+	if program.Object != "" {
+		return newObjectModule(program)
+	}
+	return newBCCModule(program)
+}
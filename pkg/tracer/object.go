@@ -0,0 +1,212 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Pages of perf buffer to allocate per CPU for perf output maps
+const perfBufferPages = 8
+
+// Module loaded from a precompiled eBPF ELF object
+type objectModule struct {
+	collection *ebpf.Collection
+	links      []link.Link
+}
+
+// Load a precompiled object into the kernel. CO-RE relocations are resolved
+// against the running kernel's BTF
+func newObjectModule(program config.BPFProgram) (Module, error) {
+	// Kernels before 5.11 charge eBPF memory against the memlock limit
+	err := rlimit.RemoveMemlock()
+	if err != nil {
+		return nil, fmt.Errorf("object.go: Error removing memlock limit: %s", err)
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(program.Object)
+	if err != nil {
+		return nil, fmt.Errorf("object.go: Error reading object %s: %s",
+			program.Object, err)
+	}
+	collection, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return nil, fmt.Errorf("object.go: Error loading object %s: %s",
+			program.Object, err)
+	}
+	return &objectModule{collection: collection}, nil
+}
+
+// Look up a program in the object by function name
+func (m *objectModule) program(loadFunc string) (*ebpf.Program, error) {
+	prog, ok := m.collection.Programs[loadFunc]
+	if !ok {
+		return nil, fmt.Errorf("object.go: Program %s not found in object",
+			loadFunc)
+	}
+	return prog, nil
+}
+
+// Keep an attached link around so it can be closed with the module
+func (m *objectModule) keep(l link.Link, err error) error {
+	if err != nil {
+		return err
+	}
+	m.links = append(m.links, l)
+	return nil
+}
+
+func (m *objectModule) AttachKprobe(loadFunc string, attachTo string) error {
+	prog, err := m.program(loadFunc)
+	if err != nil {
+		return err
+	}
+	return m.keep(link.Kprobe(attachTo, prog, nil))
+}
+
+func (m *objectModule) AttachKretprobe(loadFunc string,
+	attachTo string) error {
+
+	prog, err := m.program(loadFunc)
+	if err != nil {
+		return err
+	}
+	return m.keep(link.Kretprobe(attachTo, prog, nil))
+}
+
+// Tracepoints are named like BCC, `group:name`
+func (m *objectModule) AttachTracepoint(loadFunc string,
+	attachTo string) error {
+
+	prog, err := m.program(loadFunc)
+	if err != nil {
+		return err
+	}
+	split := strings.SplitN(attachTo, ":", 2)
+	if len(split) != 2 {
+		return fmt.Errorf("object.go: Tracepoint %s is not in group:name form",
+			attachTo)
+	}
+	return m.keep(link.Tracepoint(split[0], split[1], prog, nil))
+}
+
+func (m *objectModule) AttachRawTracepoint(loadFunc string,
+	attachTo string) error {
+
+	prog, err := m.program(loadFunc)
+	if err != nil {
+		return err
+	}
+	return m.keep(link.AttachRawTracepoint(link.RawTracepointOptions{
+		Name: attachTo, Program: prog}))
+}
+
+func (m *objectModule) Table(id string) (Table, error) {
+	table, ok := m.collection.Maps[id]
+	if !ok {
+		return nil, fmt.Errorf("object.go: Map %s not found in object", id)
+	}
+	return &objectTable{id: id, table: table}, nil
+}
+
+func (m *objectModule) Close() {
+	for _, l := range m.links {
+		l.Close()
+	}
+	m.collection.Close()
+}
+
+// Map of an object module
+type objectTable struct {
+	id    string
+	table *ebpf.Map
+}
+
+func (t *objectTable) ID() string {
+	return t.id
+}
+
+func (t *objectTable) Iter() TableIterator {
+	return &objectIterator{iter: t.table.Iterate()}
+}
+
+func (t *objectTable) Get(key []byte) ([]byte, error) {
+	var leaf []byte
+	err := t.table.Lookup(key, &leaf)
+	return leaf, err
+}
+
+func (t *objectTable) Set(key []byte, leaf []byte) error {
+	return t.table.Put(key, leaf)
+}
+
+func (t *objectTable) PerfReader(dataChan chan []byte) (PerfReader, error) {
+	reader, err := perf.NewReader(t.table, perfBufferPages*os.Getpagesize())
+	if err != nil {
+		return nil, err
+	}
+	return &objectPerfReader{reader: reader, dataChan: dataChan,
+		done: make(chan struct{})}, nil
+}
+
+// Iterator over an object map, holding the last key read
+type objectIterator struct {
+	iter *ebpf.MapIterator
+	key  []byte
+}
+
+func (it *objectIterator) Next() bool {
+	var leaf []byte
+	return it.iter.Next(&it.key, &leaf)
+}
+
+func (it *objectIterator) Key() []byte {
+	return it.key
+}
+
+func (it *objectIterator) Err() error {
+	return it.iter.Err()
+}
+
+// Reader forwarding perf records from an object map to a channel
+type objectPerfReader struct {
+	reader   *perf.Reader
+	dataChan chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (r *objectPerfReader) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			record, err := r.reader.Read()
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			} else if err != nil || record.LostSamples != 0 {
+				// Lost perf messages not implemented, skip
+				continue
+			}
+			select {
+			case r.dataChan <- record.RawSample:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+func (r *objectPerfReader) Stop() {
+	close(r.done)
+	r.reader.Close()
+	r.wg.Wait()
+}
@@ -7,12 +7,11 @@ import (
 	"time"
 
 	"github.com/olcf/greggd/pkg/config"
-	bcc "github.com/josephvoss/gobpf/bcc"
 )
 
 func readPerfChannel(ctx context.Context, outType reflect.Type,
 	dataChan chan []byte, outputChan chan config.SocketInput, errChan chan error,
-	output *config.BPFOutput, globals config.GlobalOptions,
+	program string, output *config.BPFOutput, globals config.GlobalOptions,
 	mapName string) {
 
 	for {
@@ -21,18 +20,18 @@ func readPerfChannel(ctx context.Context, outType reflect.Type,
 			fmt.Println("Done")
 			return
 		case inputBytes := <-dataChan:
-			tags, fields := make(map[string]string), make(map[string]string)
 			outputChan <- config.SocketInput{
-				MeasurementName: mapName, Fields: fields, Tags: tags,
+				MeasurementName: mapName, Program: program,
 				DataBytes: inputBytes, OutputConfig: output, DataType: outType,
+				ReceiveTime: time.Now(),
 			}
 		}
 	}
 }
 
-func iterateHashMap(ctx context.Context, table *bcc.Table,
+func iterateHashMap(ctx context.Context, table Table,
 	outType reflect.Type, keyType reflect.Type,
-	socketChan chan config.SocketInput, errChan chan error,
+	socketChan chan config.SocketInput, errChan chan error, program string,
 	output *config.BPFOutput, globals config.GlobalOptions) {
 
 	sleepDuration, err := time.ParseDuration(output.Poll)
@@ -46,27 +45,28 @@ func iterateHashMap(ctx context.Context, table *bcc.Table,
 	defer ticker.Stop()
 
 	// Infinite loop, call loopHashMap every polling period
-	loopHashMap(ctx, table, outType, keyType, socketChan, errChan, output,
-		globals)
+	loopHashMap(ctx, table, outType, keyType, socketChan, errChan, program,
+		output, globals)
 	for {
 		select {
 		case <-ctx.Done():
 			fmt.Println("Done")
 			return
 		case <-ticker.C:
-			loopHashMap(ctx, table, outType, keyType, socketChan, errChan, output,
-				globals)
+			loopHashMap(ctx, table, outType, keyType, socketChan, errChan, program,
+				output, globals)
 		}
 	}
 }
 
-func loopHashMap(ctx context.Context, table *bcc.Table,
+func loopHashMap(ctx context.Context, table Table,
 	outType reflect.Type, keyType reflect.Type,
-	socketChan chan config.SocketInput, errChan chan error,
+	socketChan chan config.SocketInput, errChan chan error, program string,
 	output *config.BPFOutput, globals config.GlobalOptions) {
 
 	// Get table iterator and iterate over keys
 	tableIter := table.Iter()
+	pollTime := time.Now()
 
 	for {
 		// Iterate. Break if no more keys
@@ -86,7 +86,7 @@ func loopHashMap(ctx context.Context, table *bcc.Table,
 		val, err := table.Get(tableIter.Key())
 		if err != nil {
 			errChan <- fmt.Errorf("tracer.go: Error getting key %s from table %s: %s\n",
-				tableIter.Key(), table.ID(), tableIter.Err())
+				tableIter.Key(), table.ID(), err)
 			return
 		}
 
@@ -104,9 +104,10 @@ func loopHashMap(ctx context.Context, table *bcc.Table,
 
 		// Write data to struct and send it on
 		socketChan <- config.SocketInput{
-			MeasurementName: table.ID(), Fields: map[string]string{},
-			Tags: map[string]string{}, KeyData: tableIter.Key(), KeyType: keyType,
-			DataType: outType, DataBytes: val, OutputConfig: output,
+			MeasurementName: table.ID(), Program: program,
+			KeyData: tableIter.Key(), KeyType: keyType, DataType: outType,
+			DataBytes: val, OutputConfig: output, ReceiveTime: time.Now(),
+			PollTime: pollTime,
 		}
 	}
 }
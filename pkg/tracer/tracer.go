@@ -3,19 +3,17 @@ package tracer
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"strings"
 	"sync"
 
-	bcc "github.com/josephvoss/gobpf/bcc"
 	"github.com/olcf/greggd/pkg/communication"
 	"github.com/olcf/greggd/pkg/config"
 )
 
 // Watch each configured memory map. Read perf events as they are sent.
 // Otherwise output contents of memory maps as a poll
-func pollOutputMaps(ctx context.Context, output config.BPFOutput,
-	m *bcc.Module, dataChan chan config.SocketInput, errChan chan error,
+func pollOutputMaps(ctx context.Context, program string,
+	output config.BPFOutput, m Module, dataChan chan config.SocketInput, errChan chan error,
 	globals config.GlobalOptions, wg *sync.WaitGroup) {
 
 	defer wg.Done()
@@ -28,7 +26,11 @@ func pollOutputMaps(ctx context.Context, output config.BPFOutput,
 	}
 
 	// Load in table to pass to individual watchers
-	table := bcc.NewTable(m.TableId(output.Id), m)
+	table, err := m.Table(output.Id)
+	if err != nil {
+		errChan <- fmt.Errorf("tracer.go: Error loading table: %s\n", err)
+		return
+	}
 
 	// Switch to individual watcher function based on hash type
 	uppercaseType := strings.ToUpper(output.Type)
@@ -42,8 +44,7 @@ func pollOutputMaps(ctx context.Context, output config.BPFOutput,
 		inputChan := make(chan []byte)
 		defer close(inputChan)
 
-		// Lost perf messages chan not implemented, set to nil
-		perfMap, err := bcc.InitPerfMap(table, inputChan, nil)
+		perfMap, err := table.PerfReader(inputChan)
 		if err != nil {
 			errChan <- fmt.Errorf("tracer.go: Error building perf map: %s\n", err)
 			return
@@ -52,80 +53,43 @@ func pollOutputMaps(ctx context.Context, output config.BPFOutput,
 		// Set up listening on the output perf map channel. Needs to accept ctx
 		// cancel
 		readPerfChannel(ctx, outputType, inputChan, dataChan, errChan,
-			&output, globals, output.Id)
+			program, &output, globals, output.Id)
 		perfMap.Stop()
-	case "BPF_HASH":
+	case "BPF_HASH", "BPF_HISTOGRAM":
 		// If hash, build output hash key data structure
-		keyType, err := communication.BuildStructFromArray(
-			[]config.BPFOutputFormat{output.Key})
+		keyType, err := communication.BuildKeyType(output)
 		if err != nil {
 			errChan <- fmt.Errorf(
 				"tracer.go: Error building hash key type: %s\n", err)
 			return
 		}
 
-		iterateHashMap(ctx, table, outputType, keyType.Field(0).Type, dataChan,
-			errChan, &output, globals)
+		iterateHashMap(ctx, table, outputType, keyType, dataChan,
+			errChan, program, &output, globals)
 	default:
 		errChan <- fmt.Errorf("tracer.go: Output type %s is not supported",
 			output.Type)
 	}
 }
 
-func attachAndLoadEvent(event config.BPFEvent, m *bcc.Module) error {
+func attachAndLoadEvent(event config.BPFEvent, m Module) error {
 	if event.AttachTo == "" || event.Type == "" {
 		return fmt.Errorf("tracer.go: Event has missing keys")
 	}
 	lowercaseType := strings.ToLower(event.Type)
 	switch lowercaseType {
 	case "kprobe":
-		fd, err := m.LoadKprobe(event.LoadFunc)
-		if err != nil {
-			return err
-		}
-
-		// use kernel default for maxactive instances probed simultaneously
-		err = m.AttachKprobe(event.AttachTo, fd, -1)
-		if err != nil {
-			return err
-		}
+		return m.AttachKprobe(event.LoadFunc, event.AttachTo)
 	case "kretprobe":
-		fd, err := m.LoadKprobe(event.LoadFunc)
-		if err != nil {
-			return err
-		}
-
-		// use kernel default for maxactive instances probed simultaneously
-		err = m.AttachKretprobe(event.AttachTo, fd, -1)
-		if err != nil {
-			return err
-		}
+		return m.AttachKretprobe(event.LoadFunc, event.AttachTo)
 	case "rawtracepoint":
-		fd, err := m.LoadRawTracepoint(event.LoadFunc)
-		if err != nil {
-			return err
-		}
-
-		err = m.AttachRawTracepoint(event.AttachTo, fd)
-		if err != nil {
-			return err
-		}
+		return m.AttachRawTracepoint(event.LoadFunc, event.AttachTo)
 	case "tracepoint":
-		fd, err := m.LoadTracepoint(event.LoadFunc)
-		if err != nil {
-			return err
-		}
-
-		err = m.AttachTracepoint(event.AttachTo, fd)
-		if err != nil {
-			return err
-		}
+		return m.AttachTracepoint(event.LoadFunc, event.AttachTo)
 	default:
 		return fmt.Errorf("tracer.go: Program type %s is not supported",
 			event.Type)
 	}
-
-	return nil
 }
 
 func Trace(ctx context.Context, program config.BPFProgram,
@@ -134,21 +98,27 @@ func Trace(ctx context.Context, program config.BPFProgram,
 	// Close waitgroup whenever we exit
 	defer wg.Done()
 
-	source, err := ioutil.ReadFile(program.Source)
+	// Compile or load a bpf module into the kernel
+	m, err := loadModule(program)
 	if err != nil {
-		errChan <- fmt.Errorf("tracer.go: Failed to read pgrogra source %s:%s\n",
-			program.Source, err)
+		errChan <- fmt.Errorf("tracer.go: Failed to load program: %s\n", err)
+		return
 	}
-
-	// Compile a bpf module, load it into the kernel. Pass empty c flags to bcc
-	// during compilation
-	m := bcc.NewModule(string(source), []string{})
 	// Close all probes and unload the ebpf module from the kernel
 	defer m.Close()
 
+	traceModule(ctx, program, m, dataChan, errChan, globals)
+}
+
+// Attach events of a loaded module and watch its outputs until the context is
+// cancelled or an output exits
+func traceModule(ctx context.Context, program config.BPFProgram, m Module,
+	dataChan chan config.SocketInput, errChan chan error,
+	globals config.GlobalOptions) {
+
 	// Attach events to kernel calls
 	for _, event := range program.Events {
-		err = attachAndLoadEvent(event, m)
+		err := attachAndLoadEvent(event, m)
 		if err != nil {
 			errChan <- fmt.Errorf("tracer.go: Unable to attach to call %+v: %s\n",
 				event, err)
@@ -156,10 +126,13 @@ func Trace(ctx context.Context, program config.BPFProgram,
 		}
 	}
 
-	// Load and watch output maps
+	// Load and watch output maps. Wait on our own group, the caller's includes
+	// this goroutine
+	var outputWg sync.WaitGroup
 	for _, output := range program.Outputs {
-		wg.Add(1)
-		go pollOutputMaps(ctx, output, m, dataChan, errChan, globals, wg)
+		outputWg.Add(1)
+		go pollOutputMaps(ctx, program.Name(), output, m, dataChan, errChan,
+			globals, &outputWg)
 	}
-	wg.Wait()
+	outputWg.Wait()
 }
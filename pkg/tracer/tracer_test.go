@@ -0,0 +1,291 @@
+package tracer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olcf/greggd/pkg/config"
+)
+
+// Build a scripted hash table with u32 keys and u64 values
+func newFakeHash(id string, values map[uint32]uint64) *fakeTable {
+	table := &fakeTable{id: id, values: map[string][]byte{}}
+	for i := uint32(0); i < uint32(len(values)); i++ {
+		key := []byte{byte(i), 0, 0, 0}
+		value := []byte{byte(values[i]), 0, 0, 0, 0, 0, 0, 0}
+		table.keys = append(table.keys, key)
+		table.values[string(key)] = value
+	}
+	return table
+}
+
+// Output config matching newFakeHash tables
+func fakeHashOutput(id string, clear bool) config.BPFOutput {
+	return config.BPFOutput{Id: id, Type: "BPF_HASH", Poll: "1h", Clear: clear,
+		Key:    config.BPFOutputFormat{Name: "hash_key", Type: "u32"},
+		Format: []config.BPFOutputFormat{{Name: "value", Type: "u64"}}}
+}
+
+// Confirm events are dispatched to the right attach call by type
+func TestAttachAndLoadEvent(t *testing.T) {
+	m := &fakeModule{attachErrs: map[string]error{
+		"broken": errors.New("Intentional Err")}}
+
+	tables := []struct {
+		event     config.BPFEvent
+		expected  string
+		expectErr bool
+	}{
+		{config.BPFEvent{Type: "kprobe", LoadFunc: "a", AttachTo: "do_sys_open"},
+			"kprobe:a:do_sys_open", false},
+		{config.BPFEvent{Type: "KRETPROBE", LoadFunc: "b", AttachTo: "do_sys_open"},
+			"kretprobe:b:do_sys_open", false},
+		{config.BPFEvent{Type: "tracepoint", LoadFunc: "c",
+			AttachTo: "sched:sched_process_exec"},
+			"tracepoint:c:sched:sched_process_exec", false},
+		{config.BPFEvent{Type: "rawtracepoint", LoadFunc: "d",
+			AttachTo: "sched_switch"}, "rawtracepoint:d:sched_switch", false},
+		// Missing keys
+		{config.BPFEvent{Type: "kprobe", LoadFunc: "e"}, "", true},
+		// Unknown type
+		{config.BPFEvent{Type: "uprobe", LoadFunc: "f", AttachTo: "main"}, "", true},
+		// Attach failure
+		{config.BPFEvent{Type: "kprobe", LoadFunc: "broken",
+			AttachTo: "do_sys_open"}, "", true},
+	}
+	for _, tbl := range tables {
+		m.attached = nil
+		err := attachAndLoadEvent(tbl.event, m)
+		if tbl.expectErr {
+			if err == nil {
+				t.Errorf("Invalid event did not throw error: %+v", tbl.event)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error thrown when not expected: %v", err)
+			continue
+		}
+		if len(m.attached) != 1 || m.attached[0] != tbl.expected {
+			t.Errorf("Event attached as %v, expected %s", m.attached, tbl.expected)
+		}
+	}
+}
+
+// Confirm each hash entry is read and sent on, and cleared if configured
+func TestLoopHashMap(t *testing.T) {
+	for _, clear := range []bool{false, true} {
+		table := newFakeHash("counts", map[uint32]uint64{0: 5, 1: 7})
+		output := fakeHashOutput("counts", clear)
+		socketChan := make(chan config.SocketInput, 2)
+		errChan := make(chan error, 1)
+
+		loopHashMap(context.Background(), table, reflect.TypeOf(uint64(0)),
+			reflect.TypeOf(uint32(0)), socketChan, errChan, "counts.c",
+			&output, config.GlobalOptions{})
+
+		if len(errChan) != 0 {
+			t.Fatalf("Error thrown when not expected: %v", <-errChan)
+		}
+		if len(socketChan) != 2 {
+			t.Fatalf("Got %d hash entries, expected 2", len(socketChan))
+		}
+		var pollTime time.Time
+		for _, expected := range []byte{5, 7} {
+			input := <-socketChan
+			if input.DataBytes[0] != expected || input.MeasurementName != "counts" ||
+				input.Program != "counts.c" {
+				t.Errorf("Hash entry %+v does not have value %d", input, expected)
+			}
+			if input.ReceiveTime.IsZero() {
+				t.Errorf("Hash entry does not have a receive time")
+			}
+			// Entries of one poll share its poll time
+			if pollTime.IsZero() {
+				pollTime = input.PollTime
+			}
+			if input.PollTime.IsZero() || !input.PollTime.Equal(pollTime) {
+				t.Errorf("Hash entry has poll time %v, expected %v", input.PollTime,
+					pollTime)
+			}
+		}
+		for _, key := range table.keys {
+			cleared := bytes.Equal(table.values[string(key)], make([]byte, 8))
+			if cleared != clear {
+				t.Errorf("Value of key %v cleared is %t, expected %t", key, cleared,
+					clear)
+			}
+		}
+	}
+}
+
+// Confirm table errors are reported and stop the poll
+func TestLoopHashMapErrors(t *testing.T) {
+	getErrTable := newFakeHash("counts", map[uint32]uint64{0: 5})
+	getErrTable.getErr = errors.New("Intentional Err")
+	setErrTable := newFakeHash("counts", map[uint32]uint64{0: 5})
+	setErrTable.setErr = errors.New("Intentional Err")
+
+	for _, table := range []*fakeTable{getErrTable, setErrTable} {
+		output := fakeHashOutput("counts", true)
+		socketChan := make(chan config.SocketInput, 1)
+		errChan := make(chan error, 1)
+
+		loopHashMap(context.Background(), table, reflect.TypeOf(uint64(0)),
+			reflect.TypeOf(uint32(0)), socketChan, errChan, "counts.c",
+			&output, config.GlobalOptions{})
+
+		if len(errChan) != 1 {
+			t.Errorf("Table error was not reported")
+		}
+		if len(socketChan) != 0 {
+			t.Errorf("Entry was sent on despite table error")
+		}
+	}
+
+	// Keys shorter than the key type end the poll without sending
+	shortTable := newFakeHash("counts", map[uint32]uint64{0: 5})
+	shortTable.keys[0] = shortTable.keys[0][:1]
+	output := fakeHashOutput("counts", false)
+	socketChan := make(chan config.SocketInput, 1)
+	loopHashMap(context.Background(), shortTable, reflect.TypeOf(uint64(0)),
+		reflect.TypeOf(uint32(0)), socketChan, make(chan error, 1), "counts.c",
+		&output, config.GlobalOptions{})
+	if len(socketChan) != 0 {
+		t.Errorf("Short key was sent on")
+	}
+}
+
+// Confirm perf events are forwarded until the context is cancelled
+func TestPollOutputMapsPerf(t *testing.T) {
+	events := [][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}}
+	m := &fakeModule{tables: map[string]*fakeTable{
+		"events": &fakeTable{id: "events", events: events}}}
+	output := config.BPFOutput{Id: "events", Type: "BPF_PERF_OUTPUT",
+		Format: []config.BPFOutputFormat{{Name: "pid", Type: "u32"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	dataChan := make(chan config.SocketInput)
+	errChan := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go pollOutputMaps(ctx, "events.c", output, m, dataChan, errChan,
+		config.GlobalOptions{}, &wg)
+
+	for _, expected := range events {
+		select {
+		case input := <-dataChan:
+			if !bytes.Equal(input.DataBytes, expected) {
+				t.Errorf("Perf event %v does not match expected %v", input.DataBytes,
+					expected)
+			}
+			if input.DataType.Size() != 4 {
+				t.Errorf("Perf event type %v does not match format", input.DataType)
+			}
+			if input.Program != "events.c" {
+				t.Errorf("Perf event program %s does not match events.c",
+					input.Program)
+			}
+		case err := <-errChan:
+			t.Fatalf("Error thrown when not expected: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for perf event")
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
+// Confirm bad outputs are reported instead of polled
+func TestPollOutputMapsErrors(t *testing.T) {
+	m := &fakeModule{tables: map[string]*fakeTable{
+		"counts": newFakeHash("counts", map[uint32]uint64{}),
+		"events": &fakeTable{id: "events",
+			perfErr: errors.New("Intentional Err")}}}
+
+	outputs := []config.BPFOutput{
+		// Map isn't in the module
+		{Id: "missing", Type: "BPF_PERF_OUTPUT"},
+		// Hash without a poll time
+		{Id: "counts", Type: "BPF_HASH"},
+		// Hash with a bad poll time
+		{Id: "counts", Type: "BPF_HASH", Poll: "fake"},
+		// Unsupported output type
+		{Id: "counts", Type: "BPF_ARRAY", Poll: "1s"},
+		// Perf reader can't be opened
+		{Id: "events", Type: "BPF_PERF_OUTPUT"},
+		// Format can't be built
+		{Id: "events", Type: "BPF_PERF_OUTPUT",
+			Format: []config.BPFOutputFormat{{Name: "a", Type: "fake"}}},
+	}
+	for _, output := range outputs {
+		errChan := make(chan error, 1)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		pollOutputMaps(context.Background(), "test.c", output, m, nil,
+			errChan, config.GlobalOptions{}, &wg)
+		if len(errChan) != 1 {
+			t.Errorf("Invalid output did not throw error: %+v", output)
+		}
+	}
+}
+
+// Confirm a traced module attaches events, polls outputs and returns on cancel
+func TestTraceModule(t *testing.T) {
+	m := &fakeModule{tables: map[string]*fakeTable{
+		"counts": newFakeHash("counts", map[uint32]uint64{0: 5})}}
+	program := config.BPFProgram{
+		Events: []config.BPFEvent{{Type: "kprobe", LoadFunc: "count",
+			AttachTo: "do_sys_open"}},
+		Outputs: []config.BPFOutput{fakeHashOutput("counts", false)},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	dataChan := make(chan config.SocketInput, 1)
+	errChan := make(chan error, 1)
+
+	done := make(chan struct{})
+	go func() {
+		traceModule(ctx, program, m, dataChan, errChan, config.GlobalOptions{})
+		close(done)
+	}()
+
+	select {
+	case input := <-dataChan:
+		if input.DataBytes[0] != 5 {
+			t.Errorf("Hash entry %+v does not have value 5", input)
+		}
+	case err := <-errChan:
+		t.Fatalf("Error thrown when not expected: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for hash entry")
+	}
+	if len(m.attached) != 1 {
+		t.Errorf("Events attached %v, expected 1", m.attached)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Trace did not return after cancel")
+	}
+
+	// Attach failures stop the trace before outputs are polled
+	m.attachErrs = map[string]error{"count": errors.New("Intentional Err")}
+	traceModule(context.Background(), program, m, dataChan, errChan,
+		config.GlobalOptions{})
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), "Unable to attach") {
+			t.Errorf("Unexpected error for attach failure: %v", err)
+		}
+	default:
+		t.Errorf("Attach failure was not reported")
+	}
+}
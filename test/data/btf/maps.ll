@@ -0,0 +1,151 @@
+; BTF fixture for pkg/config. Equivalent to compiling the C below with
+; `clang -g -target bpf -c`:
+;
+;   typedef unsigned int u32;
+;   typedef unsigned long long u64;
+;
+;   struct data_t {
+;       u64 id;
+;       u32 pid;
+;       u32 uid;
+;       int ret;
+;       char comm[16];
+;       char fname[255];
+;       int flags;
+;   };
+;
+;   struct key_t {
+;       char disk[32];
+;       u64 slot;
+;   };
+;
+;   struct {
+;       int (*type)[BPF_MAP_TYPE_HASH];
+;       struct key_t *key;
+;       u64 *value;
+;       int (*max_entries)[10240];
+;   } dist SEC(".maps");
+;
+;   struct {
+;       int (*type)[BPF_MAP_TYPE_LRU_HASH];
+;       struct key_t *key;
+;       u64 *value;
+;   } lru_dist SEC(".maps");
+;
+;   struct {
+;       int (*type)[BPF_MAP_TYPE_ARRAY];
+;       u32 *key;
+;       u64 *value;
+;   } counts SEC(".maps");
+;
+;   struct data_t data;
+;
+; Rebuild the object with:
+;
+;   llc -march=bpfel -filetype=obj maps.ll -o maps.o
+
+target datalayout = "e-m:e-p:64:64-i64:64-i128:128-n32:64-S128"
+target triple = "bpf"
+
+%struct.anon = type { [1 x i32]*, %struct.key_t*, i64*, [10240 x i32]* }
+%struct.anon.0 = type { [9 x i32]*, %struct.key_t*, i64* }
+%struct.anon.1 = type { [2 x i32]*, i32*, i64* }
+%struct.key_t = type { [32 x i8], i64 }
+%struct.data_t = type { i64, i32, i32, i32, [16 x i8], [255 x i8], i32 }
+
+@dist = dso_local global %struct.anon zeroinitializer, section ".maps", align 8, !dbg !0
+@data = dso_local global %struct.data_t zeroinitializer, align 8, !dbg !40
+@lru_dist = dso_local global %struct.anon.0 zeroinitializer, section ".maps", align 8, !dbg !80
+@counts = dso_local global %struct.anon.1 zeroinitializer, section ".maps", align 8, !dbg !90
+
+!llvm.dbg.cu = !{!2}
+!llvm.module.flags = !{!70, !71}
+
+!0 = !DIGlobalVariableExpression(var: !1, expr: !DIExpression())
+!1 = distinct !DIGlobalVariable(name: "dist", scope: !2, file: !3, line: 23, type: !5, isLocal: false, isDefinition: true)
+!2 = distinct !DICompileUnit(language: DW_LANG_C99, file: !3, producer: "greggd test fixture", isOptimized: false, runtimeVersion: 0, emissionKind: FullDebug, globals: !4)
+!3 = !DIFile(filename: "maps.c", directory: "/")
+!4 = !{!0, !40, !80, !90}
+
+; Anonymous libbpf map definition
+!5 = distinct !DICompositeType(tag: DW_TAG_structure_type, file: !3, line: 18, size: 256, elements: !6)
+!6 = !{!7, !13, !30, !32}
+!7 = !DIDerivedType(tag: DW_TAG_member, name: "type", scope: !5, file: !3, line: 19, baseType: !8, size: 64)
+!8 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !9, size: 64)
+!9 = !DICompositeType(tag: DW_TAG_array_type, baseType: !10, size: 32, elements: !11)
+!10 = !DIBasicType(name: "int", size: 32, encoding: DW_ATE_signed)
+!11 = !{!12}
+!12 = !DISubrange(count: 1)
+!13 = !DIDerivedType(tag: DW_TAG_member, name: "key", scope: !5, file: !3, line: 20, baseType: !14, size: 64, offset: 64)
+!14 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !15, size: 64)
+
+; struct key_t
+!15 = distinct !DICompositeType(tag: DW_TAG_structure_type, name: "key_t", file: !3, line: 13, size: 320, elements: !16)
+!16 = !{!17, !22}
+!17 = !DIDerivedType(tag: DW_TAG_member, name: "disk", scope: !15, file: !3, line: 14, baseType: !18, size: 256)
+!18 = !DICompositeType(tag: DW_TAG_array_type, baseType: !19, size: 256, elements: !20)
+!19 = !DIBasicType(name: "char", size: 8, encoding: DW_ATE_signed_char)
+!20 = !{!21}
+!21 = !DISubrange(count: 32)
+!22 = !DIDerivedType(tag: DW_TAG_member, name: "slot", scope: !15, file: !3, line: 15, baseType: !23, size: 64, offset: 256)
+!23 = !DIDerivedType(tag: DW_TAG_typedef, name: "u64", file: !3, line: 2, baseType: !24)
+!24 = !DIBasicType(name: "unsigned long long", size: 64, encoding: DW_ATE_unsigned)
+
+!30 = !DIDerivedType(tag: DW_TAG_member, name: "value", scope: !5, file: !3, line: 21, baseType: !31, size: 64, offset: 128)
+!31 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !23, size: 64)
+!32 = !DIDerivedType(tag: DW_TAG_member, name: "max_entries", scope: !5, file: !3, line: 22, baseType: !33, size: 64, offset: 192)
+!33 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !34, size: 64)
+!34 = !DICompositeType(tag: DW_TAG_array_type, baseType: !10, size: 327680, elements: !35)
+!35 = !{!36}
+!36 = !DISubrange(count: 10240)
+
+; struct data_t
+!40 = !DIGlobalVariableExpression(var: !41, expr: !DIExpression())
+!41 = distinct !DIGlobalVariable(name: "data", scope: !2, file: !3, line: 25, type: !42, isLocal: false, isDefinition: true)
+!42 = distinct !DICompositeType(tag: DW_TAG_structure_type, name: "data_t", file: !3, line: 3, size: 2368, elements: !43)
+!43 = !{!44, !45, !47, !48, !49, !53, !57}
+!44 = !DIDerivedType(tag: DW_TAG_member, name: "id", scope: !42, file: !3, line: 4, baseType: !23, size: 64)
+!45 = !DIDerivedType(tag: DW_TAG_member, name: "pid", scope: !42, file: !3, line: 5, baseType: !46, size: 32, offset: 64)
+!46 = !DIDerivedType(tag: DW_TAG_typedef, name: "u32", file: !3, line: 1, baseType: !58)
+!47 = !DIDerivedType(tag: DW_TAG_member, name: "uid", scope: !42, file: !3, line: 6, baseType: !46, size: 32, offset: 96)
+!48 = !DIDerivedType(tag: DW_TAG_member, name: "ret", scope: !42, file: !3, line: 7, baseType: !10, size: 32, offset: 128)
+!49 = !DIDerivedType(tag: DW_TAG_member, name: "comm", scope: !42, file: !3, line: 8, baseType: !50, size: 128, offset: 160)
+!50 = !DICompositeType(tag: DW_TAG_array_type, baseType: !19, size: 128, elements: !51)
+!51 = !{!52}
+!52 = !DISubrange(count: 16)
+!53 = !DIDerivedType(tag: DW_TAG_member, name: "fname", scope: !42, file: !3, line: 9, baseType: !54, size: 2040, offset: 288)
+!54 = !DICompositeType(tag: DW_TAG_array_type, baseType: !19, size: 2040, elements: !55)
+!55 = !{!56}
+!56 = !DISubrange(count: 255)
+!57 = !DIDerivedType(tag: DW_TAG_member, name: "flags", scope: !42, file: !3, line: 10, baseType: !10, size: 32, offset: 2336)
+!58 = !DIBasicType(name: "unsigned int", size: 32, encoding: DW_ATE_unsigned)
+
+; LRU hash map definition
+!80 = !DIGlobalVariableExpression(var: !81, expr: !DIExpression())
+!81 = distinct !DIGlobalVariable(name: "lru_dist", scope: !2, file: !3, line: 31, type: !82, isLocal: false, isDefinition: true)
+!82 = distinct !DICompositeType(tag: DW_TAG_structure_type, file: !3, line: 27, size: 192, elements: !83)
+!83 = !{!84, !88, !89}
+!84 = !DIDerivedType(tag: DW_TAG_member, name: "type", scope: !82, file: !3, line: 28, baseType: !85, size: 64)
+!85 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !86, size: 64)
+!86 = !DICompositeType(tag: DW_TAG_array_type, baseType: !10, size: 288, elements: !87)
+!87 = !{!100}
+!88 = !DIDerivedType(tag: DW_TAG_member, name: "key", scope: !82, file: !3, line: 29, baseType: !14, size: 64, offset: 64)
+!89 = !DIDerivedType(tag: DW_TAG_member, name: "value", scope: !82, file: !3, line: 30, baseType: !31, size: 64, offset: 128)
+
+; Array map definition
+!90 = !DIGlobalVariableExpression(var: !91, expr: !DIExpression())
+!91 = distinct !DIGlobalVariable(name: "counts", scope: !2, file: !3, line: 37, type: !92, isLocal: false, isDefinition: true)
+!92 = distinct !DICompositeType(tag: DW_TAG_structure_type, file: !3, line: 33, size: 192, elements: !93)
+!93 = !{!94, !98, !99}
+!94 = !DIDerivedType(tag: DW_TAG_member, name: "type", scope: !92, file: !3, line: 34, baseType: !95, size: 64)
+!95 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !96, size: 64)
+!96 = !DICompositeType(tag: DW_TAG_array_type, baseType: !10, size: 64, elements: !97)
+!97 = !{!101}
+!98 = !DIDerivedType(tag: DW_TAG_member, name: "key", scope: !92, file: !3, line: 35, baseType: !102, size: 64, offset: 64)
+!99 = !DIDerivedType(tag: DW_TAG_member, name: "value", scope: !92, file: !3, line: 36, baseType: !31, size: 64, offset: 128)
+!100 = !DISubrange(count: 9)
+!101 = !DISubrange(count: 2)
+!102 = !DIDerivedType(tag: DW_TAG_pointer_type, baseType: !46, size: 64)
+
+!70 = !{i32 7, !"Dwarf Version", i32 5}
+!71 = !{i32 2, !"Debug Info Version", i32 3}